@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// UDP on a busy WiFi network drops packets, so when we ask a socket to change state, we wait for it to tell us it's done so
+// ("statechanged"). If it doesn't, we ask again, waiting a bit longer each time. Only once the socket confirms do we tell the Sphere
+
+// How many times we'll ask a socket to change state before giving up
+const stateAttempts = 3
+
+// How long we wait for the first confirmation. Doubles after every attempt (1s, 2s, 4s)
+const stateTimeout = time.Second
+
+// Anyone waiting for a socket to change state has a channel in here, keyed by MAC address. Two people can be waiting on the
+// same socket (say, the Sphere and a timer), so each call gets its own. theloop feeds them all via notifyState
+var stateWaiters = make(map[string][]chan bool)
+var stateWaitersLock sync.Mutex
+
+// How many state changes a waiter can have queued up before we start dropping them. Plenty, since they're read straight away
+const stateWaiterBuffer = 4
+
+// notifyState is called from theloop when a socket tells us its state has changed. Anyone waiting on it gets told
+func notifyState(mac string, state bool) {
+	stateWaitersLock.Lock()
+	defer stateWaitersLock.Unlock()
+
+	for _, waiter := range stateWaiters[mac] {
+		select {
+		case waiter <- state:
+		default: // They've got plenty waiting already. Don't block theloop
+		}
+	}
+}
+
+// stopWaiting takes a waiter back out of stateWaiters
+func stopWaiting(mac string, waiter chan bool) {
+	stateWaitersLock.Lock()
+	defer stateWaitersLock.Unlock()
+
+	var waiters []chan bool
+	for _, other := range stateWaiters[mac] {
+		if other != waiter {
+			waiters = append(waiters, other)
+		}
+	}
+	if len(waiters) == 0 {
+		delete(stateWaiters, mac)
+	} else {
+		stateWaiters[mac] = waiters
+	}
+}
+
+// setStateAndWait asks a socket to change state, then waits for it to confirm. Returns an error if it never does
+func setStateAndWait(mac string, state bool) error {
+	waiter := make(chan bool, stateWaiterBuffer)
+
+	stateWaitersLock.Lock()
+	stateWaiters[mac] = append(stateWaiters[mac], waiter)
+	stateWaitersLock.Unlock()
+	defer stopWaiting(mac, waiter)
+
+	timeout := stateTimeout
+	for attempt := 1; attempt <= stateAttempts; attempt++ {
+		if attempt > 1 {
+			fmt.Println("No answer from", mac, "- trying again (attempt", attempt, "of", stateAttempts, ")")
+			commandRetries.Inc(mac)
+		}
+
+		onLoop(func() { orvibo.SetState(mac, state) }) // It looks the socket up in orvibo.Devices. See loop.go
+		packetsSent.Inc("setstate")
+
+		deadline := time.After(timeout)
+	wait:
+		for {
+			select {
+			case confirmed := <-waiter:
+				if confirmed == state {
+					return nil
+				}
+				// Someone pressed the button at the same time, or it's a late reply to an earlier attempt. Keep waiting
+			case <-deadline:
+				break wait
+			}
+		}
+
+		timeout *= 2
+	}
+
+	commandFailures.Inc(mac)
+	return fmt.Errorf("Socket %s didn't confirm it was turned %s after %d attempts", mac, onOff(state), stateAttempts)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Grayda/go-orvibo"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// In an apartment building, broadcast discovery finds the neighbours' sockets too. This file decides which devices we adopt.
+// Devices on the deny list are ignored as soon as they turn up, so we never subscribe to them. Devices on the allow list
+// (or added as static devices) are adopted straight away. Anything else is adopted too, unless RequireApproval is turned on,
+// in which case it waits on the "Device Adoption" screen in the Labs until someone approves or denies it. Denying a device
+// that's already been adopted stops us talking to it, but it stays in the Sphere until the driver restarts
+
+// The three answers adoption() can give
+const (
+	adoptAllowed = "allowed"
+	adoptDenied  = "denied"
+	adoptPending = "pending"
+)
+
+// Devices waiting for approval, keyed by MAC address
+var pendingDevices = make(map[string]*orvibo.Device)
+var adoptionLock sync.Mutex
+
+// adoption works out what we should do with a device
+func adoption(mac string) string {
+	mac = normaliseMAC(mac)
+
+	for _, denied := range driver.config.DeniedMACs {
+		if normaliseMAC(denied) == mac {
+			return adoptDenied
+		}
+	}
+
+	for _, allowed := range driver.config.AllowedMACs {
+		if normaliseMAC(allowed) == mac {
+			return adoptAllowed
+		}
+	}
+
+	for _, static := range driver.config.StaticDevices { // If we went to the trouble of adding it by hand, we want it
+		if normaliseMAC(static.MACAddress) == mac {
+			return adoptAllowed
+		}
+	}
+
+	if driver.config.RequireApproval {
+		return adoptPending
+	}
+	return adoptAllowed
+}
+
+// Denied devices that have turned up, keyed by MAC address. Only touched on theloop
+var deniedDevices = make(map[string]bool)
+
+// ignoreDenied makes go-orvibo leave denied devices alone. They stay in orvibo.Devices, marked as subscribed and queried, so
+// orvibo.Subscribe and orvibo.Query skip them. Deleting them would only mean finding them again on the next discovery, and a
+// "found" event every time. Devices that aren't denied any more are marked unsubscribed again, so they get picked up. This
+// changes orvibo.Devices, so it has to run on theloop (see loop.go)
+func ignoreDenied() {
+	for mac, device := range orvibo.Devices {
+		switch {
+		case adoption(mac) == adoptDenied:
+			device.Subscribed, device.Queried = true, true
+			deniedDevices[mac] = true
+		case deniedDevices[mac]:
+			device.Subscribed, device.Queried = false, false
+			delete(deniedDevices, mac)
+		}
+	}
+}
+
+// isDenied tells handleEvent whether to ignore a device altogether. Runs on theloop
+func isDenied(mac string) bool {
+	if adoption(mac) != adoptDenied {
+		return false
+	}
+	ignoreDenied() // In case it's only just turned up
+	return true
+}
+
+// adopt makes an OrviboDevice for a device we've queried, and if it's a socket, lets the Sphere know about it
+func (d *OrviboDriver) adopt(info *orvibo.Device) {
+	device := NewOrviboDevice(d, info) // Now we add this to d.device[].Device because we can now control it
+	device.Device.Name = info.Name
+	deviceLock.Lock()
+	d.device[info.ID] = device
+	deviceLock.Unlock()
+
+	if info.DeviceType == orvibo.SOCKET { // If it's a socket,
+		_ = d.Conn.ExportDevice(device)                                 // Let the Sphere know about it
+		_ = d.Conn.ExportChannel(device, device.onOffChannel, "on-off") // Let the Sphere know we've got an on-off channel ready
+		_ = d.Conn.ExportChannel(device, device.powerChannel, "power")  // And a power channel, so the Sphere app can graph our estimated usage
+		device.Device.State = info.State                                // Set the state for internal reference
+		device.sendState(info.State)                                    // And tell the Sphere what the initial state is. Easy!
+		device.updateEnergy(info.State)                                 // Start tracking on-time from here
+		d.exportOutlets(device)                                         // And if it's really a power strip, its outlets too. See powerstrip.go
+		// Now when you go into the Sphere app, there will be a thing ready to add ("Promoted" is true, I think, which makes it show up in the Add Things menu)
+	} else if info.DeviceType == orvibo.KEPLER { // Keplers get an alarm channel and a channel for their readings. See kepler.go
+		_ = d.Conn.ExportDevice(device)
+		_ = d.Conn.ExportChannel(device, device.alarmChannel, "alarm")
+		_ = d.Conn.ExportChannel(device, device.gasChannel, "gas")
+		device.keplerAlarm(info.State, "driver") // Let the Sphere know whether it's already going off
+	}
+}
+
+// addPending puts a device on the waiting list
+func addPending(info *orvibo.Device) {
+	adoptionLock.Lock()
+	defer adoptionLock.Unlock()
+
+	if _, ok := pendingDevices[info.MACAddress]; !ok {
+		fmt.Println("Device", info.MACAddress, "is waiting for approval in the Labs")
+		logEvent("pending", info.MACAddress, "driver", info.Name)
+	}
+	pendingDevices[info.MACAddress] = info
+}
+
+// takePending removes a device from the waiting list and returns it (or nil if it wasn't there)
+func takePending(mac string) *orvibo.Device {
+	adoptionLock.Lock()
+	defer adoptionLock.Unlock()
+
+	info := pendingDevices[mac]
+	delete(pendingDevices, mac)
+	return info
+}
+
+// splitMACs turns "ac:cf:23:12:34:56, accf23654321" into a list of normalised MAC addresses
+func splitMACs(list string) ([]string, error) {
+	var macs []string
+	for _, mac := range strings.Split(list, ",") {
+		mac = normaliseMAC(mac)
+		if mac == "" {
+			continue
+		}
+		if len(mac) != 12 {
+			return nil, fmt.Errorf("%s isn't a MAC address", mac)
+		}
+		macs = append(macs, mac)
+	}
+	return macs, nil
+}
+
+// Shows devices waiting for approval, plus our allow and deny lists
+func (c *configService) adoption() (*suit.ConfigurationScreen, error) {
+	adoptionLock.Lock()
+	var pending []suit.ActionListOption
+	for mac, info := range pendingDevices {
+		pending = append(pending, suit.ActionListOption{
+			Title:    fmt.Sprintf("%s (%s)", info.Name, deviceTypeNames[info.DeviceType]),
+			Subtitle: mac,
+			Value:    mac,
+		})
+	}
+	adoptionLock.Unlock()
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Value < pending[j].Value })
+
+	var contents []suit.Typed
+	if len(pending) == 0 {
+		contents = append(contents, suit.StaticText{
+			Title: "No devices waiting",
+			Value: "New devices will show up here when 'Adopt new devices automatically' is off",
+		})
+	} else {
+		contents = append(contents, suit.ActionList{
+			Name:    "mac",
+			Options: pending,
+			PrimaryAction: &suit.ReplyAction{
+				Name:         "approve",
+				Label:        "Approve",
+				DisplayIcon:  "ok",
+				DisplayClass: "success",
+			},
+			SecondaryAction: &suit.ReplyAction{
+				Name:         "deny",
+				Label:        "Deny",
+				DisplayIcon:  "ban-circle",
+				DisplayClass: "danger",
+			},
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Device Adoption",
+		Sections: []suit.Section{
+			suit.Section{
+				Title:    "Waiting for approval",
+				Contents: contents,
+			},
+			suit.Section{
+				Title: "Settings",
+				Contents: []suit.Typed{
+					suit.RadioGroup{
+						Title: "Adopt new devices automatically",
+						Name:  "adopt",
+						Value: fmt.Sprint(!driver.config.RequireApproval),
+						Options: []suit.RadioGroupOption{
+							suit.RadioGroupOption{
+								Title:       "Yes",
+								Value:       "true",
+								DisplayIcon: "ok",
+							},
+							suit.RadioGroupOption{
+								Title:       "No, ask me first",
+								Value:       "false",
+								DisplayIcon: "lock",
+							},
+						},
+					},
+					suit.InputText{
+						Name:        "allowed",
+						Before:      "Always adopt",
+						Placeholder: "accf23123456, accf23654321",
+						Value:       strings.Join(driver.config.AllowedMACs, ", "),
+					},
+					suit.InputText{
+						Name:        "denied",
+						Before:      "Never adopt",
+						Placeholder: "accf23abcdef",
+						Value:       strings.Join(driver.config.DeniedMACs, ", "),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveadoption",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// decide approves (or denies) a device that's waiting
+func (c *configService) decide(request *model.ConfigurationRequest, approved bool) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	mac := vals["mac"]
+	info := takePending(mac)
+	if info == nil {
+		return c.error(fmt.Sprintf("%s isn't waiting for approval", mac))
+	}
+
+	if approved {
+		driver.config.AllowedMACs = append(driver.config.AllowedMACs, mac)
+		onLoop(func() { driver.adopt(info) })
+		logEvent("config", mac, "labs", "approved device")
+	} else {
+		driver.config.DeniedMACs = append(driver.config.DeniedMACs, mac)
+		onLoop(ignoreDenied)
+		logEvent("config", mac, "labs", "denied device")
+	}
+
+	driver.saveConfig()
+	return c.adoption()
+}
+
+// saveadoption saves our allow / deny lists and whether new devices need approving
+func (c *configService) saveadoption(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	allowed, err := splitMACs(vals["allowed"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+	denied, err := splitMACs(vals["denied"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	driver.config.AllowedMACs = allowed
+	driver.config.DeniedMACs = denied
+	driver.config.RequireApproval = !stringToBool(vals["adopt"])
+	onLoop(ignoreDenied)
+
+	// Anything waiting that's now allowed (or denied) can be dealt with straight away
+	adoptionLock.Lock()
+	var waiting []string
+	for mac := range pendingDevices {
+		waiting = append(waiting, mac)
+	}
+	adoptionLock.Unlock()
+	for _, mac := range waiting {
+		switch adoption(mac) {
+		case adoptAllowed:
+			if info := takePending(mac); info != nil {
+				onLoop(func() { driver.adopt(info) })
+			}
+		case adoptDenied:
+			takePending(mac)
+		}
+	}
+
+	driver.saveConfig()
+	logEvent("config", "", "labs", "updated adoption settings")
+	return c.adoption()
+}
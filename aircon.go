@@ -0,0 +1,657 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/ninjasphere/go-ninja/api"
+	"github.com/ninjasphere/go-ninja/channels"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// Air conditioners can't be controlled with learned codes, because every press of the remote sends the whole state (see
+// ircode/aircon.go). So an air conditioner here is a device of its own, blasted by an AllOne, that remembers what it's
+// been told to do (in AirConditioners in the config, so it survives a restart). Change anything (from the Sphere, the Labs
+// or /api/aircon) and the whole state gets sent again, the same as the real remote would.
+//
+// In the Sphere, each one looks like a thermostat: an on-off channel, a thermostat channel for the setpoint, and mode, fan
+// and swing channels. on-off and thermostat are the Sphere's own, so its apps know what to do with them. mode, fan and
+// swing aren't. The Sphere has nothing for them, and I'd rather not squeeze three settings into a channel built for
+// something else. So they're ours, and the Sphere's apps won't draw anything for them. Anything that talks to the driver
+// directly (over MQTT, like the Sphere's apps do) can still set them by name, and they report their state like any other
+// channel. For everyone else, the Labs and /api/aircon change them. Changing something while it's off is remembered, and
+// sent when it's turned on, which is what the remote does. Swing is a toggle on the remote, so a change to it while it's off is
+// marked pending (SwingPending) and the toggle is sent when it's turned on
+
+// OrviboAirConditioner is an air conditioner we control through an AllOne
+type OrviboAirConditioner struct {
+	ID       string // e.g. "ac1". Never changes, so the Sphere can keep track of it
+	Name     string
+	AllOne   string // The MAC address of the AllOne to blast from, or ALL
+	Protocol string // One of ircode.ACProtocols
+	State    ircode.ACState
+	// Swing is a toggle, which can't be sent while it's off. If it's changed while it's off, this is set until it's turned
+	// on and the toggle gets sent. Until then, the unit's swing is the opposite of State.Swing
+	SwingPending bool `json:",omitempty"`
+}
+
+// OrviboAC is an air conditioner, as the Sphere sees it. The settings are looked up in the config every time, so a
+// restored backup takes effect straight away
+type OrviboAC struct {
+	ID              string
+	info            *model.Device
+	sendEvent       func(event string, payload interface{}) error
+	onOffChannel    *channels.OnOffChannel
+	setpointChannel *acChannel
+	modeChannel     *acChannel
+	fanChannel      *acChannel
+	swingChannel    *acChannel
+	lock            sync.Mutex // So two changes at once don't both start from the same state
+}
+
+// acChannel is a channel the Sphere can change (with Set) as well as hear from
+type acChannel struct {
+	protocol  string
+	set       func(value interface{}) error
+	sendEvent func(event string, payload interface{}) error
+}
+
+// Our air conditioners, keyed by ID. The Labs, /api/aircon and restores all get at this at once, so it's guarded by
+// airConditionersLock. Use findAC rather than looking in it yourself
+var airConditioners = make(map[string]*OrviboAC)
+var airConditionersLock sync.RWMutex
+
+func init() {
+	mux.HandleFunc("/api/aircon", airconAPI)
+}
+
+// GetProtocol tells the Sphere what kind of channel this is
+func (c *acChannel) GetProtocol() string {
+	return c.protocol
+}
+
+// SetEventHandler is called by the Sphere when we export the channel
+func (c *acChannel) SetEventHandler(sendEvent func(event string, payload interface{}) error) {
+	c.sendEvent = sendEvent
+}
+
+// Set is called by the Sphere to change whatever this channel is for
+func (c *acChannel) Set(value interface{}) error {
+	return c.set(value)
+}
+
+// SendState tells the Sphere what this channel is set to now
+func (c *acChannel) SendState(state interface{}) error {
+	if c.sendEvent == nil {
+		return nil
+	}
+	return c.sendEvent("state", state)
+}
+
+// findAirConditioner finds an air conditioner's settings by ID
+func findAirConditioner(id string) *OrviboAirConditioner {
+	for _, ac := range driver.config.AirConditioners {
+		if ac.ID == id {
+			return ac
+		}
+	}
+	return nil
+}
+
+// findAC finds the Sphere's side of an air conditioner by ID
+func findAC(id string) (*OrviboAC, bool) {
+	airConditionersLock.RLock()
+	defer airConditionersLock.RUnlock()
+	ac, ok := airConditioners[id]
+	return ac, ok
+}
+
+// NewOrviboAC makes the Sphere's side of an air conditioner
+func NewOrviboAC(config *OrviboAirConditioner) *OrviboAC {
+	name := config.Name
+	ac := &OrviboAC{
+		ID: config.ID,
+		info: &model.Device{
+			NaturalID:     fmt.Sprintf("aircon%s", config.ID),
+			NaturalIDType: "aircon",
+			Name:          &name,
+			Signatures: &map[string]string{
+				"ninja:manufacturer": "Orvibo",
+				"ninja:productName":  "OrviboDevice",
+				"ninja:productType":  "AirConditioner",
+				"ninja:thingType":    "thermostat",
+			},
+		},
+	}
+
+	ac.onOffChannel = channels.NewOnOffChannel(ac)
+	ac.setpointChannel = &acChannel{protocol: "thermostat", set: func(value interface{}) error {
+		temperature, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%v isn't a temperature", value)
+		}
+		return ac.change(func(state *ircode.ACState) { state.Temperature = int(math.Floor(temperature + 0.5)) }, "sphere")
+	}}
+	// Our own channels (see the top of this file). mode takes one of ircode.ACModes or "off", fan takes one of
+	// ircode.ACFanSpeeds, and swing takes true or false. Anything else is an error, the same as from the Labs
+	ac.modeChannel = &acChannel{protocol: "mode", set: func(value interface{}) error {
+		mode, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v isn't a mode", value)
+		}
+		return ac.change(func(state *ircode.ACState) {
+			if state.Power = mode != "off"; state.Power {
+				state.Mode = mode
+			}
+		}, "sphere")
+	}}
+	ac.fanChannel = &acChannel{protocol: "fan", set: func(value interface{}) error {
+		fan, ok := value.(string)
+		if !ok {
+			return fmt.Errorf("%v isn't a fan speed", value)
+		}
+		return ac.change(func(state *ircode.ACState) { state.Fan = fan }, "sphere")
+	}}
+	ac.swingChannel = &acChannel{protocol: "swing", set: func(value interface{}) error {
+		swing, ok := value.(bool)
+		if !ok {
+			return fmt.Errorf("Swing is either true or false, not %v", value)
+		}
+		return ac.change(func(state *ircode.ACState) { state.Swing = swing }, "sphere")
+	}}
+	return ac
+}
+
+// GetDeviceInfo tells the Sphere about this air conditioner
+func (ac *OrviboAC) GetDeviceInfo() *model.Device {
+	return ac.info
+}
+
+// GetDriver returns our driver
+func (ac *OrviboAC) GetDriver() ninja.Driver {
+	return driver
+}
+
+// SetEventHandler is the same as OrviboDevice's
+func (ac *OrviboAC) SetEventHandler(sendEvent func(event string, payload interface{}) error) {
+	ac.sendEvent = sendEvent
+}
+
+// SetOnOff turns the air conditioner on (as it was last set) or off
+func (ac *OrviboAC) SetOnOff(state bool) error {
+	return ac.change(func(wanted *ircode.ACState) { wanted.Power = state }, "sphere")
+}
+
+// ToggleOnOff turns it on if it's off, and off if it's on
+func (ac *OrviboAC) ToggleOnOff() error {
+	return ac.change(func(state *ircode.ACState) { state.Power = !state.Power }, "sphere")
+}
+
+// SetName renames an air conditioner. It's only a name in our config, so anything goes
+func (ac *OrviboAC) SetName(name *string) (*string, error) {
+	safe := strings.TrimSpace(*name)
+	config := findAirConditioner(ac.ID)
+	if safe == "" || config == nil {
+		return nil, fmt.Errorf("Air conditioners need a name")
+	}
+
+	logEvent("config", "", "sphere", fmt.Sprintf("renamed air conditioner %s to %s", config.Name, safe))
+	config.Name = safe
+	driver.saveConfig()
+	ac.info.Name = &safe
+	if ac.sendEvent != nil {
+		ac.sendEvent("renamed", safe)
+	}
+	return &safe, nil
+}
+
+// change makes a change to the state we want the air conditioner in, then sends it
+func (ac *OrviboAC) change(change func(state *ircode.ACState), source string) error {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	config := findAirConditioner(ac.ID)
+	if config == nil {
+		return fmt.Errorf("Air conditioner %s has been deleted", ac.ID)
+	}
+	state := config.State
+	change(&state)
+	return ac.setState(config, state, source)
+}
+
+// update is change, for a form (the Labs, or /api/aircon). See parseACState
+func (ac *OrviboAC) update(vals map[string]string, source string) error {
+	ac.lock.Lock()
+	defer ac.lock.Unlock()
+
+	config := findAirConditioner(ac.ID)
+	if config == nil {
+		return fmt.Errorf("Air conditioner %s has been deleted", ac.ID)
+	}
+	state, err := parseACState(config.State, vals)
+	if err != nil {
+		return err
+	}
+	return ac.setState(config, state, source)
+}
+
+// setState sends a new state to the air conditioner, and remembers it. If it's off (and staying off) there's nothing to
+// send, so we just remember it for when it's turned on
+func (ac *OrviboAC) setState(config *OrviboAirConditioner, state ircode.ACState, source string) error {
+	if err := state.Check(config.Protocol); err != nil {
+		return err
+	}
+	actual := config.State // What the unit is really set to, which only differs from what we want if swing is pending
+	if config.SwingPending {
+		actual.Swing = !actual.Swing
+	}
+
+	if state.Power || actual.Power {
+		timings, err := ircode.EncodeAC(config.Protocol, state, actual)
+		if err != nil {
+			return err
+		}
+		code, err := ircode.FormatAllOne(timings)
+		if err != nil {
+			return err
+		}
+		if err = blastCode(OrviboIRCode{Name: config.Name + " " + state.String(), Code: code, AllOne: config.AllOne}, source); err != nil {
+			return err
+		}
+	}
+
+	config.State = state
+	config.SwingPending = !state.Power && state.Swing != actual.Swing // If it's on, EncodeAC has sent the toggle already
+	driver.saveConfig()
+	ac.sendState(state)
+	return nil
+}
+
+// sendState tells the Sphere what the air conditioner is set to
+func (ac *OrviboAC) sendState(state ircode.ACState) {
+	mode := state.Mode
+	if !state.Power {
+		mode = "off"
+	}
+	ac.onOffChannel.SendState(state.Power)
+	ac.setpointChannel.SendState(float64(state.Temperature))
+	ac.modeChannel.SendState(mode)
+	ac.fanChannel.SendState(state.Fan)
+	ac.swingChannel.SendState(state.Swing)
+}
+
+// exportAirConditioners lets the Sphere know about any air conditioners it hasn't heard about yet. Called when the driver
+// starts, and when one is added
+func (d *OrviboDriver) exportAirConditioners() {
+	var added []*OrviboAC
+	airConditionersLock.Lock()
+	for _, config := range d.config.AirConditioners {
+		if _, ok := airConditioners[config.ID]; ok {
+			continue
+		}
+		ac := NewOrviboAC(config)
+		airConditioners[config.ID] = ac
+		added = append(added, ac)
+	}
+	airConditionersLock.Unlock()
+
+	for _, ac := range added { // Outside the lock, as the Sphere can call straight back
+		config := findAirConditioner(ac.ID)
+		if config == nil {
+			continue
+		}
+		_ = d.Conn.ExportDevice(ac)
+		_ = d.Conn.ExportChannel(ac, ac.onOffChannel, "on-off")
+		_ = d.Conn.ExportChannel(ac, ac.setpointChannel, "thermostat")
+		_ = d.Conn.ExportChannel(ac, ac.modeChannel, "mode")
+		_ = d.Conn.ExportChannel(ac, ac.fanChannel, "fan")
+		_ = d.Conn.ExportChannel(ac, ac.swingChannel, "swing")
+		ac.sendState(config.State)
+	}
+}
+
+// addAirConditioner saves a new air conditioner and exports it
+func addAirConditioner(name string, allone string, protocol string) (*OrviboAirConditioner, error) {
+	if strings.TrimSpace(name) == "" {
+		return nil, fmt.Errorf("Air conditioners need a name")
+	}
+	if _, _, err := ircode.ACTemperatureRange(protocol); err != nil {
+		return nil, err
+	}
+	if allone == "" {
+		allone = "ALL"
+	}
+
+	number := 1
+	for findAirConditioner(fmt.Sprintf("ac%d", number)) != nil {
+		number++
+	}
+	config := &OrviboAirConditioner{
+		ID:       fmt.Sprintf("ac%d", number),
+		Name:     strings.TrimSpace(name),
+		AllOne:   allone,
+		Protocol: protocol,
+		State:    ircode.DefaultACState(),
+	}
+	driver.config.AirConditioners = append(driver.config.AirConditioners, config)
+	logEvent("config", allone, "labs", fmt.Sprintf("added %s air conditioner %s", protocol, config.Name))
+	driver.exportAirConditioners()
+	return config, driver.saveConfig()
+}
+
+// parseACState reads a state from a form (the Labs, or /api/aircon). Anything that isn't there is left as it was
+func parseACState(state ircode.ACState, vals map[string]string) (ircode.ACState, error) {
+	if value := vals["power"]; value != "" {
+		state.Power = value == "true" || value == "on"
+	}
+	if value := vals["mode"]; value != "" {
+		state.Mode = value
+	}
+	if value := strings.TrimSpace(vals["temperature"]); value != "" {
+		temperature, err := strconv.Atoi(value)
+		if err != nil {
+			return state, fmt.Errorf("%s isn't a temperature", value)
+		}
+		state.Temperature = temperature
+	}
+	if value := vals["fan"]; value != "" {
+		state.Fan = value
+	}
+	if value := vals["swing"]; value != "" {
+		state.Swing = value == "true" || value == "on"
+	}
+	return state, nil
+}
+
+// airconAPI lists our air conditioners and what they're set to (GET), or changes one (POST with ?id=, and any of power,
+// mode, temperature, fan and swing)
+func airconAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		r.ParseForm()
+		vals := make(map[string]string)
+		for name := range r.Form {
+			vals[name] = r.Form.Get(name)
+		}
+
+		ac, ok := findAC(vals["id"])
+		config := findAirConditioner(vals["id"])
+		if !ok || config == nil {
+			http.Error(w, "There isn't an air conditioner called "+vals["id"], http.StatusNotFound)
+			return
+		}
+		if err := ac.update(vals, "api"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(config)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(driver.config.AirConditioners)
+}
+
+// acOptions is a radio button for each of values
+func acOptions(values []string) []suit.RadioGroupOption {
+	var options []suit.RadioGroupOption
+	for _, value := range values {
+		options = append(options, suit.RadioGroupOption{
+			Title: strings.Title(value),
+			Value: value,
+		})
+	}
+	return options
+}
+
+// Shows our air conditioners, and what they're set to
+func (c *configService) airconditioners() (*suit.ConfigurationScreen, error) {
+	contents := []suit.Typed{
+		suit.StaticText{
+			Title: "About this screen",
+			Value: "Air conditioner remotes send everything (mode, temperature and fan) with every press, so learning their buttons doesn't work well. Add your air conditioner here instead, and the driver will keep track of what it's set to and send the whole lot when anything changes. Each one shows up in the Sphere like a thermostat",
+		},
+	}
+
+	var acs []suit.ActionListOption
+	for _, ac := range driver.config.AirConditioners {
+		acs = append(acs, suit.ActionListOption{
+			Title:    ac.Name,
+			Subtitle: fmt.Sprintf("%s, %s", ac.Protocol, ac.State),
+			Value:    ac.ID,
+		})
+	}
+	if len(acs) > 0 {
+		contents = append(contents, suit.ActionList{
+			Name:    "aircon",
+			Options: acs,
+			PrimaryAction: &suit.ReplyAction{
+				Name:        "aircon",
+				Label:       "Control",
+				DisplayIcon: "fire",
+			},
+			SecondaryAction: &suit.ReplyAction{
+				Name:         "deleteaircon",
+				Label:        "Delete",
+				DisplayIcon:  "trash",
+				DisplayClass: "danger",
+			},
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Air Conditioners",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Add Air Conditioner",
+				Name:         "newaircon",
+				DisplayClass: "success",
+				DisplayIcon:  "plus",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// Shows the UI for adding an air conditioner
+func (c *configService) newaircon() (*suit.ConfigurationScreen, error) {
+	screen := suit.ConfigurationScreen{
+		Title: "Add Air Conditioner",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Pick which protocol your air conditioner's remote uses (Coolix is used by Midea, and lots of brands that buy from them) and which AllOne can see it. It starts off as off, set to cool to 24 degrees",
+					},
+					suit.InputText{
+						Name:        "name",
+						Before:      "Name",
+						Placeholder: "Bedroom Air Conditioner",
+					},
+					suit.RadioGroup{
+						Title:   "Protocol",
+						Name:    "protocol",
+						Value:   ircode.ACProtocols[0],
+						Options: acOptions(ircode.ACProtocols),
+					},
+					suit.RadioGroup{
+						Title:   "Select an AllOne to blast from",
+						Name:    "allone",
+						Value:   "ALL",
+						Options: allOneOptions(),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "airconditioners",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveaircon",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// saveaircon adds the air conditioner from the "Add Air Conditioner" screen
+func (c *configService) saveaircon(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	if _, err = addAirConditioner(vals["name"], vals["allone"], vals["protocol"]); err != nil {
+		return c.error(err.Error())
+	}
+	return c.airconditioners()
+}
+
+// aircon shows what an air conditioner is set to, so it can be changed
+func (c *configService) aircon(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	ac := findAirConditioner(vals["aircon"])
+	if ac == nil {
+		return c.error("There isn't an air conditioner called " + vals["aircon"])
+	}
+	low, high, err := ircode.ACTemperatureRange(ac.Protocol)
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: ac.Name,
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Click 'Send' to set the air conditioner to this. If it's off, the settings are remembered for when it's turned on",
+					},
+					suit.InputHidden{Name: "aircon", Value: ac.ID},
+					suit.RadioGroup{
+						Title:   "Power",
+						Name:    "power",
+						Value:   onOff(ac.State.Power),
+						Options: acOptions([]string{"on", "off"}),
+					},
+					suit.RadioGroup{
+						Title:   "Mode",
+						Name:    "mode",
+						Value:   ac.State.Mode,
+						Options: acOptions(ircode.ACModes),
+					},
+					suit.InputText{
+						Name:      "temperature",
+						Before:    "Temperature",
+						After:     fmt.Sprintf("degrees (%d to %d)", low, high),
+						InputType: "number",
+						Value:     ac.State.Temperature,
+						Minimum:   &low,
+						Maximum:   &high,
+					},
+					suit.RadioGroup{
+						Title:   "Fan",
+						Name:    "fan",
+						Value:   ac.State.Fan,
+						Options: acOptions(ircode.ACFanSpeeds),
+					},
+					suit.RadioGroup{
+						Title:   "Swing",
+						Name:    "swing",
+						Value:   onOff(ac.State.Swing),
+						Options: acOptions([]string{"on", "off"}),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "airconditioners",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Send",
+				Name:         "setaircon",
+				DisplayClass: "success",
+				DisplayIcon:  "send",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// setaircon sends what was picked on an air conditioner's screen
+func (c *configService) setaircon(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	ac, ok := findAC(vals["aircon"])
+	if !ok {
+		return c.error("There isn't an air conditioner called " + vals["aircon"])
+	}
+	if err = ac.update(vals, "labs"); err != nil {
+		return c.error(err.Error())
+	}
+	return c.airconditioners()
+}
+
+// deleteaircon forgets an air conditioner. The Sphere hangs on to it until the driver restarts, but it won't do anything
+func (c *configService) deleteaircon(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	var kept []*OrviboAirConditioner
+	for _, ac := range driver.config.AirConditioners {
+		if ac.ID == vals["aircon"] {
+			snapshotOrWarn("delete")
+			logEvent("config", ac.AllOne, "labs", "deleted air conditioner "+ac.Name)
+			continue
+		}
+		kept = append(kept, ac)
+	}
+	driver.config.AirConditioners = kept
+	airConditionersLock.Lock()
+	delete(airConditioners, vals["aircon"])
+	airConditionersLock.Unlock()
+	driver.saveConfig()
+	return c.airconditioners()
+}
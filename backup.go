@@ -0,0 +1,532 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// Our IR codes, groups, RF switches and everything else only live in the driver config the Sphere keeps for us, and "Reset"
+// on the codes screen wipes the lot. This file backs the whole config up to a versioned JSON document, and restores it again,
+// either replacing what we've got or merging the two. Before anything destructive (resetting codes, deleting a code, or
+// restoring a backup) a snapshot is saved to disk automatically, so there's always a way back
+
+// The version of backups we make. If the backup format changes, bump this and teach parseBackup about the old one
+const backupVersion = 1
+
+// Where snapshots go if the config doesn't say otherwise, and how many we keep
+const (
+	defaultBackupDirectory = "backups"
+	maxSnapshots           = 20
+)
+
+// OrviboBackup is a backup of our whole config
+type OrviboBackup struct {
+	Version int    // backupVersion, when it was made
+	Driver  string // The version of the driver that made it
+	Created time.Time
+	Reason  string `json:",omitempty"` // Why a snapshot was taken (e.g. "reset"). Blank if someone asked for it
+	Config  *OrviboDriverConfig
+}
+
+// BackupReport is what happened when a backup was restored
+type BackupReport struct {
+	Mode      string   // "merge" or "replace"
+	Snapshot  string   // The snapshot we took first, in case this wasn't what you wanted
+	Codes     int      // How many IR codes were added
+	Groups    int      // How many code groups were added
+	Switches  int      // How many RF switches were added
+	Other     int      // How many other things (static devices, power strips etc.) were added
+	Conflicts []string // Things in both that didn't match. In merge mode, ours are kept
+}
+
+func init() {
+	mux.HandleFunc("/api/backup", backupAPI)
+}
+
+// makeBackup makes a backup of our config as it is now. HTTPToken is left out, as it's what protects restoring backups (and
+// everything else) over HTTP, and backups get copied around. Restoring keeps whatever token we've got
+func makeBackup(reason string) ([]byte, error) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	energyLock.Lock() // The energy totals are in there too. See energy.go
+	defer energyLock.Unlock()
+
+	config := *driver.config
+	config.HTTPToken = ""
+	return json.MarshalIndent(OrviboBackup{
+		Version: backupVersion,
+		Driver:  info.Version,
+		Created: time.Now(),
+		Reason:  reason,
+		Config:  &config,
+	}, "", "  ")
+}
+
+// parseBackup reads a backup, checking we know how to restore it
+func parseBackup(data []byte) (*OrviboBackup, error) {
+	var backup OrviboBackup
+	if err := json.Unmarshal(data, &backup); err != nil {
+		return nil, fmt.Errorf("Not a backup: %s", err)
+	}
+	if backup.Version < 1 || backup.Config == nil {
+		return nil, fmt.Errorf("Not a backup of this driver")
+	}
+	if backup.Version > backupVersion {
+		return nil, fmt.Errorf("This backup was made by a newer version of the driver (%s, backup version %d). Please upgrade to restore it", backup.Driver, backup.Version)
+	}
+	return &backup, nil
+}
+
+// backupDirectory works out where our snapshots are saved
+func backupDirectory() string {
+	if driver != nil && driver.config != nil && driver.config.BackupDirectory != "" {
+		return driver.config.BackupDirectory
+	}
+	return defaultBackupDirectory
+}
+
+// snapshot saves a backup to disk before we do something destructive. Old snapshots are deleted so we keep at most
+// maxSnapshots. Returns the snapshot's filename
+func snapshot(reason string) (string, error) {
+	data, err := makeBackup(reason)
+	if err != nil {
+		return "", err
+	}
+
+	directory := backupDirectory()
+	if err = os.MkdirAll(directory, 0700); err != nil {
+		return "", err
+	}
+	filename := filepath.Join(directory, fmt.Sprintf("orvibo-%s-%s.json", time.Now().Format("20060102-150405.000"), strings.Replace(reason, " ", "-", -1)))
+	if err = ioutil.WriteFile(filename, data, 0600); err != nil { // Everything is in there, so only we get to read it
+		return "", err
+	}
+	logEvent("config", "", "driver", "saved snapshot "+filepath.Base(filename))
+
+	snapshots := listSnapshots()
+	for len(snapshots) > maxSnapshots {
+		os.Remove(filepath.Join(directory, snapshots[len(snapshots)-1]))
+		snapshots = snapshots[:len(snapshots)-1]
+	}
+	return filename, nil
+}
+
+// snapshotOrWarn takes a snapshot, and prints (but otherwise ignores) any errors. Not being able to back up shouldn't stop
+// someone deleting a code they don't want
+func snapshotOrWarn(reason string) {
+	if _, err := snapshot(reason); err != nil {
+		fmt.Println("Unable to save a snapshot before", reason, ":", err)
+	}
+}
+
+// What snapshot() calls its files, e.g. orvibo-20261019-120845.123-delete.json
+var snapshotName = regexp.MustCompile(`^orvibo-\d{8}-\d{6}\.\d{3}-.*\.json$`)
+
+// listSnapshots lists our snapshots, newest first
+func listSnapshots() []string {
+	return snapshotsIn(backupDirectory())
+}
+
+// snapshotsIn lists the snapshots in a directory, newest first. Anything else in there is left out
+func snapshotsIn(directory string) []string {
+	files, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return nil
+	}
+
+	var snapshots []string
+	for _, file := range files {
+		if !file.IsDir() && snapshotName.MatchString(file.Name()) {
+			snapshots = append(snapshots, file.Name())
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(snapshots))) // They start with the time, so this puts the newest first
+	return snapshots
+}
+
+// restoreBackup restores a backup. "replace" swaps our whole config for the backup's. "merge" adds anything in the backup we
+// don't have, and reports anything that's in both but different (we keep ours)
+func restoreBackup(backup *OrviboBackup, mode string, source string) (BackupReport, error) {
+	report := BackupReport{Mode: mode}
+	if mode != "merge" && mode != "replace" {
+		return report, fmt.Errorf("Unknown restore mode %s (try merge or replace)", mode)
+	}
+
+	var err error
+	if report.Snapshot, err = snapshot("restore"); err != nil {
+		return report, fmt.Errorf("Unable to save a snapshot first, so nothing has been restored: %s", err)
+	}
+	report.Snapshot = filepath.Base(report.Snapshot)
+
+	configLock.Lock()
+	energyLock.Lock()
+	restored := backup.Config
+	if mode == "replace" {
+		current := driver.config
+		report.Codes, report.Groups, report.Switches = len(restored.Codes), len(restored.CodeGroups), len(restored.Switches)
+
+		// Keep whatever we're in the middle of learning
+		restored.learningIR = current.learningIR
+		restored.learningIRName = current.learningIRName
+		restored.learningIRDescription = current.learningIRDescription
+		restored.learningIRDevice = current.learningIRDevice
+		restored.learningIRGroup = current.learningIRGroup
+		restored.HTTPToken = current.HTTPToken // A backup shouldn't be able to change who's allowed to restore backups
+		restored.Initialised = true
+		*driver.config = *restored
+	} else {
+		mergeConfig(driver.config, restored, &report)
+	}
+
+	// Older backups might not have these
+	if driver.config.Switches == nil {
+		driver.config.Switches = make(map[string]OrviboRFCode)
+	}
+	if driver.config.Energy == nil {
+		driver.config.Energy = make(map[string]*OrviboEnergy)
+	}
+	if driver.config.PowerStrips == nil {
+		driver.config.PowerStrips = make(map[string]*OrviboPowerStrip)
+	}
+	decodeCodes(driver.config.Codes)
+	energyLock.Unlock()
+	configLock.Unlock()
+
+	driver.exportAirConditioners() // Any the Sphere hasn't heard of
+
+	logEvent("config", "", source, fmt.Sprintf("restored a backup from %s (%s): %d codes, %d groups, %d switches added, %d conflicts", backup.Created.Format("2006-01-02 15:04"), mode, report.Codes, report.Groups, report.Switches, len(report.Conflicts)))
+	return report, driver.saveConfig()
+}
+
+// mergeConfig adds everything in restored that's missing from current. Codes are matched by group and name, groups by name,
+// and everything else by its key (MAC address, RF switch ID etc.)
+func mergeConfig(current *OrviboDriverConfig, restored *OrviboDriverConfig, report *BackupReport) {
+	for _, group := range restored.CodeGroups {
+		exists := false
+		for _, ours := range current.CodeGroups {
+			exists = exists || ours.Name == group.Name
+		}
+		if !exists {
+			group.ID = len(current.CodeGroups)
+			current.CodeGroups = append(current.CodeGroups, group)
+			report.Groups++
+		}
+	}
+
+	for _, code := range restored.Codes {
+		exists := false
+		for _, ours := range current.Codes {
+			if ours.Group != code.Group || ours.Name != code.Name {
+				continue
+			}
+			exists = true
+			if ours.Code != code.Code || ours.AllOne != code.AllOne {
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("IR code %s / %s is different in the backup", code.Group, code.Name))
+			}
+		}
+		if !exists {
+			current.Codes = append(current.Codes, code)
+			report.Codes++
+		}
+	}
+
+	if current.Switches == nil {
+		current.Switches = make(map[string]OrviboRFCode)
+	}
+	for id, rf := range restored.Switches {
+		if ours, ok := current.Switches[id]; ok {
+			if ours != rf {
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("RF switch %s (%s) is different in the backup", id, rf.Name))
+			}
+			continue
+		}
+		current.Switches[id] = rf
+		report.Switches++
+	}
+
+	if current.PowerStrips == nil {
+		current.PowerStrips = make(map[string]*OrviboPowerStrip)
+	}
+	for mac, strip := range restored.PowerStrips {
+		if ours, ok := current.PowerStrips[mac]; ok {
+			if ours.Outlets != strip.Outlets {
+				report.Conflicts = append(report.Conflicts, fmt.Sprintf("Power strip %s has %d outlets in the backup", mac, strip.Outlets))
+			}
+			continue
+		}
+		current.PowerStrips[mac] = strip
+		report.Other++
+	}
+
+	if current.Energy == nil {
+		current.Energy = make(map[string]*OrviboEnergy)
+	}
+	for mac, energy := range restored.Energy {
+		if _, ok := current.Energy[mac]; !ok {
+			current.Energy[mac] = energy
+			report.Other++
+		}
+	}
+
+	for _, device := range restored.StaticDevices {
+		exists := false
+		for _, ours := range current.StaticDevices {
+			if normaliseMAC(ours.MACAddress) == normaliseMAC(device.MACAddress) {
+				exists = true
+				if ours.IP != device.IP {
+					report.Conflicts = append(report.Conflicts, fmt.Sprintf("Static device %s is at %s in the backup", device.MACAddress, device.IP))
+				}
+			}
+		}
+		if !exists {
+			current.StaticDevices = append(current.StaticDevices, device)
+			report.Other++
+		}
+	}
+
+	for _, ac := range restored.AirConditioners {
+		exists := false
+		for _, ours := range current.AirConditioners {
+			if ours.ID == ac.ID {
+				exists = true
+				if ours.Protocol != ac.Protocol || ours.AllOne != ac.AllOne {
+					report.Conflicts = append(report.Conflicts, fmt.Sprintf("Air conditioner %s (%s) is different in the backup", ac.ID, ac.Name))
+				}
+			}
+		}
+		if !exists {
+			current.AirConditioners = append(current.AirConditioners, ac)
+			report.Other++
+		}
+	}
+
+	for _, lists := range [][2]*[]string{
+		{&current.AllowedMACs, &restored.AllowedMACs},
+		{&current.DeniedMACs, &restored.DeniedMACs},
+		{&current.BroadcastAddresses, &restored.BroadcastAddresses},
+		{&current.Interfaces, &restored.Interfaces},
+	} {
+		for _, value := range *lists[1] {
+			if !contains(*lists[0], value) {
+				*lists[0] = append(*lists[0], value)
+				report.Other++
+			}
+		}
+	}
+}
+
+// backupAPI gives us a backup of the whole config (GET), or restores one (POST it as the body, with ?mode=merge or
+// ?mode=replace). Both need our token (see http.go), as a backup has everything in it, including the token itself
+func backupAPI(w http.ResponseWriter, r *http.Request) {
+	if !authorised(r) {
+		unauthorised(w)
+		return
+	}
+
+	if r.Method == "POST" {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		backup, err := parseBackup(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		mode := r.URL.Query().Get("mode")
+		if mode == "" {
+			mode = "merge"
+		}
+
+		report, err := restoreBackup(backup, mode, "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+		return
+	}
+
+	data, err := makeBackup("")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"orvibo-%s.json\"", time.Now().Format("20060102")))
+	w.Write(data)
+}
+
+// Shows our snapshots, plus somewhere to paste a backup to restore
+func (c *configService) backup() (*suit.ConfigurationScreen, error) {
+	var snapshots []suit.ActionListOption
+	for _, name := range listSnapshots() {
+		snapshots = append(snapshots, suit.ActionListOption{
+			Title: name,
+			Value: name,
+		})
+	}
+
+	contents := []suit.Typed{
+		suit.StaticText{
+			Title: "About this screen",
+			Value: "Back up everything the driver knows (IR codes, groups, RF switches, settings and so on), or restore a backup. Merging adds anything in the backup that we don't already have, and tells you about anything that's different. Replacing swaps the whole config for the backup's. A snapshot is saved automatically before codes are reset or deleted, and before every restore",
+		},
+		suit.InputText{
+			Name:        "backup",
+			Before:      "Backup to restore",
+			Placeholder: "{\"Version\": 1, ...}",
+		},
+		suit.RadioGroup{
+			Title: "How to restore it",
+			Name:  "mode",
+			Value: "merge",
+			Options: []suit.RadioGroupOption{
+				suit.RadioGroupOption{Title: "Merge with what's here", Value: "merge", DisplayIcon: "plus"},
+				suit.RadioGroupOption{Title: "Replace what's here", Value: "replace", DisplayIcon: "warning-sign"},
+			},
+		},
+	}
+	if len(snapshots) > 0 {
+		contents = append(contents, suit.ActionList{
+			Name:    "snapshot",
+			Title:   "Snapshots (newest first). Restoring one replaces what's here",
+			Options: snapshots,
+			PrimaryAction: &suit.ReplyAction{
+				Name:        "restoresnapshot",
+				Label:       "Restore",
+				DisplayIcon: "repeat",
+			},
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Backup & Restore",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Show Backup",
+				Name:         "showbackup",
+				DisplayClass: "default",
+				DisplayIcon:  "export",
+			},
+			suit.ReplyAction{
+				Label:        "Save Snapshot",
+				Name:         "savesnapshot",
+				DisplayClass: "default",
+				DisplayIcon:  "floppy-disk",
+			},
+			suit.ReplyAction{
+				Label:        "Restore",
+				Name:         "restorebackup",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// showbackup shows a backup of everything, ready to copy somewhere safe
+func (c *configService) showbackup() (*suit.ConfigurationScreen, error) {
+	data, err := makeBackup("")
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	return &suit.ConfigurationScreen{
+		Title: "Backup",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: fmt.Sprintf("Copy this somewhere safe. It can also be downloaded from http://%s/api/backup, with the HTTP API token from Driver Settings", driver.config.HTTPAddress),
+					},
+					suit.StaticText{
+						Title: "Backup",
+						Value: string(data),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "backup",
+				DisplayClass: "default",
+			},
+		},
+	}, nil
+}
+
+// restorebackup restores the backup pasted into the "Backup & Restore" screen, or one of our snapshots
+func (c *configService) restorebackup(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	data := []byte(vals["backup"])
+	mode := vals["mode"]
+	if request.Action == "restoresnapshot" {
+		if data, err = ioutil.ReadFile(filepath.Join(backupDirectory(), filepath.Base(vals["snapshot"]))); err != nil {
+			return c.error(fmt.Sprintf("Unable to read snapshot: %s", err))
+		}
+		mode = "replace"
+	}
+
+	backup, err := parseBackup(data)
+	if err != nil {
+		return c.error(err.Error())
+	}
+	report, err := restoreBackup(backup, mode, "labs")
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	message := fmt.Sprintf("Restored the backup from %s. %d IR codes, %d groups, %d RF switches and %d other things were added. A snapshot of how things were is in %s.", backup.Created.Format("2006-01-02 15:04"), report.Codes, report.Groups, report.Switches, report.Other, report.Snapshot)
+	if mode == "replace" {
+		message = fmt.Sprintf("Replaced everything with the backup from %s. A snapshot of how things were is in %s. Restart the driver to pick up any network settings.", backup.Created.Format("2006-01-02 15:04"), report.Snapshot)
+	}
+	if len(report.Conflicts) > 0 {
+		message += " These were different in the backup, so we kept ours: " + strings.Join(report.Conflicts, ". ")
+	}
+	return c.notice("Backup & Restore", message, "backup")
+}
+
+// notice is like confirm, but the Okay button goes wherever we like
+func (c *configService) notice(title string, message string, next string) (*suit.ConfigurationScreen, error) {
+	screen, err := c.confirm(title, message)
+	screen.Actions = []suit.Typed{
+		suit.ReplyAction{
+			Label:        "Okay",
+			Name:         next,
+			DisplayClass: "success",
+			DisplayIcon:  "ok",
+		},
+	}
+	return screen, err
+}
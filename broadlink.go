@@ -0,0 +1,307 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// Broadlink's RM blasters keep their codes as base64 (see ircode/broadlink.go). This file moves whole libraries of them onto
+// the AllOne, and back again. Libraries come in a few shapes, and we take all of these:
+//
+//	{"TV": {"Power": "JgBQ...", "Mute": "JgBQ..."}, "Amp": {...}}            One group per key (what we export, and BroadlinkManager)
+//	{"version": 1, "data": {"TV": {"Power": "JgBQ..."}}}                    Home Assistant's broadlink_remote_codes files
+//	{"manufacturer": "LG", "supportedModels": [...], "commands": {...}}     SmartIR. Nested commands get names like "cool 24 auto"
+//	Power: JgBQ...                                                          One code per line, into the group picked on the screen
+//
+// Names and groups are kept. Anything that isn't a Broadlink IR code (e.g. an RF code) is skipped and reported
+
+// broadlinkCodes is a library, as group name => code name => code
+type broadlinkCodes map[string]map[string]string
+
+func init() {
+	mux.HandleFunc("/api/broadlink", broadlinkAPI)
+}
+
+// parseBroadlinkLibrary works out what shape a library is, and pulls the codes out of it. group is used for codes that
+// don't say which group they're in
+func parseBroadlinkLibrary(text string, group string) (broadlinkCodes, error) {
+	if group == "" {
+		group = "Broadlink"
+	}
+	codes := make(broadlinkCodes)
+
+	var library map[string]interface{}
+	if err := json.Unmarshal([]byte(text), &library); err != nil { // Not JSON, so hopefully one code per line
+		lines := bufio.NewScanner(strings.NewReader(text))
+		for lines.Scan() {
+			line := strings.Replace(lines.Text(), ":", ": ", 1) // So "Power:JgBQ..." works too. Base64 never has a colon in it
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			name := strings.Trim(strings.Join(fields[:len(fields)-1], " "), ":=\" ")
+			addBroadlinkCode(codes, group, name, fields[len(fields)-1])
+		}
+		if len(codes) == 0 {
+			return nil, fmt.Errorf("There aren't any codes in there")
+		}
+		return codes, nil
+	}
+
+	if data, ok := library["data"].(map[string]interface{}); ok && library["version"] != nil { // Home Assistant
+		library = data
+	}
+
+	if commands, ok := library["commands"].(map[string]interface{}); ok { // SmartIR
+		if manufacturer, ok := library["manufacturer"].(string); ok {
+			group = manufacturer
+			if models, ok := library["supportedModels"].([]interface{}); ok && len(models) > 0 {
+				group = fmt.Sprintf("%s %v", manufacturer, models[0])
+			}
+		}
+		walkBroadlink(codes, group, "", commands)
+		return codes, nil
+	}
+
+	for name, value := range library {
+		switch value := value.(type) {
+		case string:
+			addBroadlinkCode(codes, group, name, value)
+		case map[string]interface{}:
+			if name == "" { // Codes we exported that weren't in a group
+				name = group
+			}
+			walkBroadlink(codes, name, "", value)
+		}
+	}
+	if len(codes) == 0 {
+		return nil, fmt.Errorf("There aren't any codes in there")
+	}
+	return codes, nil
+}
+
+// walkBroadlink adds every code in a (possibly nested) JSON object. Nested codes are named after every key on the way down
+func walkBroadlink(codes broadlinkCodes, group string, prefix string, values map[string]interface{}) {
+	for name, value := range values {
+		if prefix != "" {
+			name = prefix + " " + name
+		}
+		switch value := value.(type) {
+		case string:
+			addBroadlinkCode(codes, group, name, value)
+		case []interface{}: // Some libraries send a few codes in a row for one button. We only take the first
+			if len(value) > 0 {
+				if code, ok := value[0].(string); ok {
+					addBroadlinkCode(codes, group, name, code)
+				}
+			}
+		case map[string]interface{}:
+			walkBroadlink(codes, group, name, value)
+		}
+	}
+}
+
+func addBroadlinkCode(codes broadlinkCodes, group string, name string, code string) {
+	if codes[group] == nil {
+		codes[group] = make(map[string]string)
+	}
+	codes[group][name] = strings.TrimSpace(code)
+}
+
+// importBroadlink saves a library as IR codes. Returns how many were saved, and the ones that couldn't be converted
+func importBroadlink(codes broadlinkCodes, allone string, source string) (int, []string) {
+	added := 0
+	var problems []string
+
+	var groups []string
+	for group := range codes {
+		groups = append(groups, group)
+	}
+	sort.Strings(groups)
+
+	for _, group := range groups {
+		var names []string
+		for name := range codes[group] {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			hex, err := ircode.BroadlinkToAllOne(codes[group][name])
+			if err != nil {
+				problems = append(problems, fmt.Sprintf("%s / %s: %s", group, name, err))
+				continue
+			}
+			driver.ensureGroup(group, "Imported from Broadlink")
+			ir := OrviboIRCode{
+				Name:   name,
+				Code:   hex,
+				AllOne: allone,
+				Group:  group,
+			}
+			decodeIR(&ir)
+			driver.config.Codes = append(driver.config.Codes, ir)
+			added++
+		}
+	}
+
+	if added > 0 {
+		driver.saveConfig()
+		logEvent("config", allone, source, fmt.Sprintf("imported %d Broadlink codes", added))
+	}
+	return added, problems
+}
+
+// exportBroadlink turns our saved codes into a Broadlink library, one group per key. Codes that can't be converted are left out
+func exportBroadlink() broadlinkCodes {
+	codes := make(broadlinkCodes)
+	for _, ir := range driver.config.Codes {
+		converted, err := ircode.AllOneToBroadlink(ir.Code)
+		if err != nil {
+			fmt.Println("Unable to convert", ir.Name, "to Broadlink:", err)
+			continue
+		}
+		addBroadlinkCode(codes, ir.Group, ir.Name, converted)
+	}
+	return codes
+}
+
+// broadlinkAPI exports our codes as a Broadlink library (GET), or imports one (POST it as the body, with ?allone= and
+// ?group= for codes that don't say which group they're in)
+func broadlinkAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		text, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		codes, err := parseBroadlinkLibrary(string(text), r.URL.Query().Get("group"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		allone := r.URL.Query().Get("allone")
+		if allone == "" {
+			allone = "ALL"
+		}
+
+		added, problems := importBroadlink(codes, allone, "api")
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"Imported": added, "Skipped": problems})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exportBroadlink())
+}
+
+// Shows the UI for pasting in Broadlink codes
+func (c *configService) broadlink() (*suit.ConfigurationScreen, error) {
+	screen := suit.ConfigurationScreen{
+		Title: "Import Broadlink Codes",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Paste in codes from a Broadlink RM (base64, like JgBQAAAB...). This can be a JSON library (from Home Assistant, SmartIR or a Broadlink export), where each remote becomes its own group, or one 'Name: code' per line, which go into the group below",
+					},
+					suit.InputText{
+						Name:        "codes",
+						Before:      "Codes",
+						Placeholder: "Power: JgBQAAAB...",
+					},
+					suit.InputText{
+						Name:        "group",
+						Before:      "Group, for codes that don't say",
+						Placeholder: "Broadlink",
+					},
+					suit.RadioGroup{
+						Title:   "Select an AllOne to blast from",
+						Name:    "allone",
+						Value:   "ALL",
+						Options: allOneOptions(),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Import",
+				Name:         "savebroadlink",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savebroadlink imports the codes from the "Import Broadlink Codes" screen
+func (c *configService) savebroadlink(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	codes, err := parseBroadlinkLibrary(vals["codes"], strings.TrimSpace(vals["group"]))
+	if err != nil {
+		return c.error(err.Error())
+	}
+	added, problems := importBroadlink(codes, vals["allone"], "labs")
+	if len(problems) > 0 {
+		return c.confirm("Import Broadlink Codes", fmt.Sprintf("Imported %d codes. These couldn't be converted: %s", added, strings.Join(problems, ". ")))
+	}
+	return c.list()
+}
+
+// Shows every saved code as a Broadlink library, ready to copy into Home Assistant and friends
+func (c *configService) exportbroadlink() (*suit.ConfigurationScreen, error) {
+	library, err := json.MarshalIndent(exportBroadlink(), "", "  ")
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Export Broadlink Codes",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Here are your saved IR codes as a Broadlink library, one group per remote. This can be imported again on the 'Import Broadlink Codes' screen",
+					},
+					suit.StaticText{
+						Title: "Codes",
+						Value: string(library),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+		},
+	}
+
+	return &screen, nil
+}
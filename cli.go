@@ -0,0 +1,495 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/Grayda/go-orvibo"
+)
+
+// This file contains our command line interface. Run the driver with no arguments (or just flags, which is how the Sphere
+// starts it) and it starts up as normal. Give it a command (e.g. "driver-orvibo history") and it does that instead, then exits.
+// "driver-orvibo help" lists them
+
+// A command we can run from the command line. run gets the arguments after the command name, and returns our exit code
+type command struct {
+	description string
+	run         func(args []string) int
+}
+
+var commands = map[string]command{
+	"backup":   {"Back up the running driver's whole config, restore a backup, or list snapshots", backupCommand},
+	"history":  {"Show recent events (state changes, blasts, config changes)", historyCommand},
+	"ircode":   {"Make an AllOne IR code from a protocol, address and command, or decode one", ircodeCommand},
+	"library":  {"Search the IR code library, or check a library file before sharing it", libraryCommand},
+	"lirc":     {"Preview the remotes in a lircd.conf file, or import them into the running driver", lircCommand},
+	"simulate": {"Pretend to be an Orvibo device (e.g. a Kepler), for trying the driver out without one", simulateCommand},
+	"timers":   {"List, add, edit or delete the timers and countdown stored on a socket", timersCommand},
+}
+
+// isCommand tells us whether we've been given a command, rather than the flags the Sphere starts drivers with (which we leave
+// to go-ninja)
+func isCommand(args []string) bool {
+	if len(args) == 0 || strings.HasPrefix(args[0], "-") {
+		return false
+	}
+	_, ok := commands[args[0]]
+	return ok || args[0] == "help"
+}
+
+// runCLI works out which command we're running and runs it
+func runCLI(args []string) int {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		exit := 2
+		if args[0] == "help" {
+			exit = 0
+		} else {
+			fmt.Fprintf(os.Stderr, "Unknown command: %s\n\n", args[0])
+		}
+		fmt.Fprintln(os.Stderr, "Available commands:")
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].description)
+		}
+		return exit
+	}
+
+	return cmd.run(args[1:])
+}
+
+// driver-orvibo library [-search samsung] [-file mine.txt] [-codes]
+func libraryCommand(args []string) int {
+	flags := flag.NewFlagSet("library", flag.ExitOnError)
+	search := flags.String("search", "", "Only show sets with these words in their brand, model or kind")
+	file := flags.String("file", "", "A library file to check, and show alongside the built in sets")
+	codes := flags.Bool("codes", false, "Show every button's code, not just its name")
+	flags.Parse(args)
+
+	var extra []string
+	if *file != "" {
+		extra = append(extra, *file)
+	}
+	library, problems := loadLibrary(extra...)
+	for _, set := range searchLibrary(library, *search) {
+		fmt.Printf("%s (%s, %d buttons, from %s)\n", set.ID(), set.Kind, len(set.Buttons), set.File)
+		for _, button := range set.Buttons {
+			if *codes {
+				fmt.Printf("  %-20s %s\n", button.Name, button.Code)
+			} else {
+				ir := OrviboIRCode{Code: button.Code, Protocol: button.Protocol, Address: button.Address, Command: button.Command}
+				fmt.Printf("  %-20s %s\n", button.Name, describeIR(ir))
+			}
+		}
+	}
+
+	for _, problem := range problems {
+		fmt.Fprintln(os.Stderr, "Problem:", problem)
+	}
+	if len(problems) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// driver-orvibo history [-n 50] [-mac accf23...] [-kind state] [-file history.log]
+func historyCommand(args []string) int {
+	flags := flag.NewFlagSet("history", flag.ExitOnError)
+	limit := flags.Int("n", 50, "How many events to show")
+	mac := flags.String("mac", "", "Only show events for this MAC address")
+	kind := flags.String("kind", "", "Only show events of this kind (state, blastir, blastrf, learn, config, found, online, offline, drift, pending, alarm)")
+	file := flags.String("file", historyFile(), "The history file to read")
+	flags.Parse(args)
+
+	events, err := readHistory(*file, *limit, *mac, *kind)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read history:", err)
+		return 1
+	}
+
+	// readHistory gives us newest first, but oldest first reads better in a terminal
+	for i := len(events) - 1; i >= 0; i-- {
+		fmt.Println(formatEvent(events[i]))
+	}
+	return 0
+}
+
+// driver-orvibo timers -ip 192.168.1.50 -mac accf23123456 [list | add | edit | delete | countdown] [-id 1] [-name Heater]
+// [-state off] [-at 22:30] [-days weekdays] [-minutes 30]. This talks to the socket directly, so the driver doesn't need to be running
+func timersCommand(args []string) int {
+	flags := flag.NewFlagSet("timers", flag.ExitOnError)
+	ip := flags.String("ip", "", "The IP address of the socket")
+	mac := flags.String("mac", "", "The MAC address of the socket")
+	id := flags.Int("id", 0, "Which timer to edit or delete")
+	name := flags.String("name", "", "The name of the timer")
+	state := flags.String("state", "off", "Turn the socket on or off")
+	at := flags.String("at", "", "When, e.g. 22:30 or \"2026-12-25 22:30\"")
+	days := flags.String("days", "", "Which days to repeat on, e.g. mon,wed,fri, daily, weekdays or weekends. Blank for once")
+	minutes := flags.Int("minutes", 0, "How long the countdown runs for. 0 cancels it")
+	flags.Parse(args)
+
+	// Flags can go before or after the action
+	action := "list"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+		flags.Parse(flags.Args()[1:])
+	}
+
+	device, err := cliDevice(*ip, *mac)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	switch action {
+	case "list":
+		timers, err := readTimers(device)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read timers:", err)
+			return 1
+		}
+		for _, timer := range timers {
+			fmt.Printf("%3d  %s\n", timer.ID, timer)
+		}
+		if countdown, err := readCountdown(device); err == nil && countdown.Enabled {
+			fmt.Printf("Countdown: %d minutes, then %s\n", countdown.Seconds/60, onOff(countdown.State))
+		}
+	case "add", "edit":
+		if action == "edit" && *id == 0 {
+			fmt.Fprintln(os.Stderr, "Which timer? Use -id")
+			return 2
+		}
+		timer := OrviboTimer{ID: *id, Name: *name, State: stringToBool(*state)}
+		if action == "add" {
+			timer.ID = 0
+		}
+		if timer.At, err = parseTimerTime(*at); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if timer.Days, err = parseDays(*days); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		if err = saveTimer(device, timer); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to save timer:", err)
+			return 1
+		}
+		logEvent("config", device.MACAddress, "cli", "saved timer "+timer.String())
+	case "delete":
+		if err = deleteTimer(device, *id); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to delete timer:", err)
+			return 1
+		}
+		logEvent("config", device.MACAddress, "cli", fmt.Sprintf("deleted timer %d", *id))
+	case "countdown":
+		countdown := OrviboCountdown{Enabled: *minutes > 0, State: stringToBool(*state), Seconds: *minutes * 60}
+		if err = setCountdown(device, countdown); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to set countdown:", err)
+			return 1
+		}
+		logEvent("config", device.MACAddress, "cli", fmt.Sprintf("countdown %d minutes, then %s", *minutes, onOff(countdown.State)))
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown action:", action, "(try list, add, edit, delete or countdown)")
+		return 2
+	}
+
+	return 0
+}
+
+// driver-orvibo ircode [encode | decode | protocols | frompronto | topronto | frombroadlink | tobroadlink | ac] [-protocol NEC]
+// [-address 0x04] [-command 0x08] [-repeats 0] [-code 2200...] [-frequency 38000] [-pronto "0000 006D ..."]
+// [-broadlink JgBQ...] [-mode cool] [-temperature 24] [-fan auto] [-swing]. Prints the converted code, ready to paste somewhere else
+func ircodeCommand(args []string) int {
+	flags := flag.NewFlagSet("ircode", flag.ExitOnError)
+	protocol := flags.String("protocol", "NEC", "The protocol: "+strings.Join(ircode.Protocols, ", "))
+	address := flags.String("address", "", "The address, e.g. 4 or 0x04")
+	cmd := flags.String("command", "", "The command, e.g. 8 or 0x08")
+	repeats := flags.Int("repeats", 0, "How many extra times to send it, as if the button was held down")
+	code := flags.String("code", "", "The AllOne code to decode or turn into Pronto")
+	frequency := flags.Int("frequency", ircode.DefaultFrequency, "The carrier frequency (in Hz) to mark Pronto codes with")
+	pronto := flags.String("pronto", "", "The Pronto hex code to turn into an AllOne code")
+	broadlink := flags.String("broadlink", "", "The Broadlink code (base64) to turn into an AllOne code")
+	mode := flags.String("mode", "cool", "For air conditioners, the mode: "+strings.Join(ircode.ACModes, ", ")+" or off")
+	temperature := flags.Int("temperature", 24, "For air conditioners, the temperature in degrees C")
+	fan := flags.String("fan", "auto", "For air conditioners, the fan speed: "+strings.Join(ircode.ACFanSpeeds, ", "))
+	swing := flags.Bool("swing", false, "For air conditioners, also press the swing button")
+	flags.Parse(args)
+
+	action := "encode"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+		flags.Parse(flags.Args()[1:])
+	}
+
+	switch action {
+	case "encode":
+		address, err := parseNumber(*address)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid address:", err)
+			return 2
+		}
+		command, err := parseNumber(*cmd)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid command:", err)
+			return 2
+		}
+		hex, err := ircode.EncodeAllOne(ircode.Code{Protocol: *protocol, Address: address, Command: command}, *repeats)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(hex)
+	case "decode":
+		ir := OrviboIRCode{Code: strings.TrimSpace(*code)}
+		decodeIR(&ir)
+		fmt.Println(describeIR(ir))
+	case "protocols":
+		for _, protocol := range ircode.Protocols {
+			fmt.Println(protocol)
+		}
+	case "frompronto":
+		hex, _, err := ircode.ProntoToAllOne(*pronto)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(hex)
+	case "topronto":
+		converted, err := ircode.AllOneToPronto(strings.TrimSpace(*code), *frequency)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(converted)
+	case "frombroadlink":
+		hex, err := ircode.BroadlinkToAllOne(*broadlink)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(hex)
+	case "ac":
+		state := ircode.ACState{Power: *mode != "off", Mode: *mode, Temperature: *temperature, Fan: *fan, Swing: *swing}
+		if !state.Power {
+			state.Mode = "cool"
+		}
+		timings, err := ircode.EncodeAC(*protocol, state, ircode.ACState{})
+		if err == nil {
+			var hex string
+			if hex, err = ircode.FormatAllOne(timings); err == nil {
+				fmt.Println(hex)
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	case "tobroadlink":
+		converted, err := ircode.AllOneToBroadlink(strings.TrimSpace(*code))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		fmt.Println(converted)
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown action:", action, "(try encode, decode, protocols, frompronto, topronto, frombroadlink, tobroadlink or ac)")
+		return 2
+	}
+
+	return 0
+}
+
+// driver-orvibo lirc -file lircd.conf [-import] [-allone accf23123456] [-driver http://127.0.0.1:8100] [-token secret]. Without -import, shows
+// what would be imported. With it, the file is sent to the driver's /api/lirc, because only the driver can save to its config
+func lircCommand(args []string) int {
+	flags := flag.NewFlagSet("lirc", flag.ExitOnError)
+	file := flags.String("file", "", "The lircd.conf file to import")
+	doImport := flags.Bool("import", false, "Import the remotes, instead of just showing what's in the file")
+	allone := flags.String("allone", "ALL", "The MAC address of the AllOne to blast from, or ALL")
+	address := flags.String("driver", defaultDriverURL, "Where the driver's web server is")
+	token := flags.String("token", "", "The driver's HTTPToken, needed to import")
+	flags.Parse(args)
+
+	if *file == "" {
+		fmt.Fprintln(os.Stderr, "Which file? Use -file")
+		return 2
+	}
+	remotes, err := readLIRC(*file, "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to read LIRC file:", err)
+		return 1
+	}
+
+	if !*doImport {
+		for _, remote := range remotes {
+			fmt.Printf("%s (%d buttons)\n", remote.Name, len(remote.Buttons))
+			for _, button := range remote.Buttons {
+				ir := OrviboIRCode{Name: button.Name, Code: button.Code}
+				decodeIR(&ir)
+				fmt.Printf("  %-20s %s\n", button.Name, describeIR(ir))
+			}
+			for _, problem := range remote.Errors {
+				fmt.Println("  Can't import", problem)
+			}
+		}
+		fmt.Println("\nAdd -import to import these into the driver")
+		return 0
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer f.Close()
+	response, err := askDriver("POST", strings.TrimRight(*address, "/")+"/api/lirc?allone="+url.QueryEscape(*allone), "text/plain", f, *token)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to reach the driver:", err)
+		return 1
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(response.Body)
+		fmt.Fprintln(os.Stderr, "The driver couldn't import it:", strings.TrimSpace(string(message)))
+		return 1
+	}
+
+	var previews []LIRCPreview
+	json.NewDecoder(response.Body).Decode(&previews)
+	for _, preview := range previews {
+		fmt.Printf("Imported %d codes into %s\n", len(preview.Buttons), preview.Group)
+	}
+	return 0
+}
+
+// driver-orvibo backup [export | restore | list] [-file backup.json] [-mode merge] [-driver http://127.0.0.1:8100] [-token secret] [-dir backups].
+// Export and restore talk to the running driver's /api/backup, because only the driver can get at its config
+func backupCommand(args []string) int {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	file := flags.String("file", "", "The file to export to (blank for the screen) or restore from")
+	mode := flags.String("mode", "merge", "How to restore: merge (add anything we don't have) or replace (swap everything)")
+	address := flags.String("driver", defaultDriverURL, "Where the driver's web server is")
+	token := flags.String("token", "", "The driver's HTTPToken, needed to export or restore")
+	directory := flags.String("dir", defaultBackupDirectory, "Where the driver saves its snapshots")
+	flags.Parse(args)
+
+	action := "export"
+	if flags.NArg() > 0 {
+		action = flags.Arg(0)
+		flags.Parse(flags.Args()[1:])
+	}
+	api := strings.TrimRight(*address, "/") + "/api/backup"
+
+	switch action {
+	case "export":
+		response, err := askDriver("GET", api, "", nil, *token)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to reach the driver:", err)
+			return 1
+		}
+		defer response.Body.Close()
+		data, err := ioutil.ReadAll(response.Body)
+		if err != nil || response.StatusCode != http.StatusOK {
+			fmt.Fprintln(os.Stderr, "Unable to back up:", err, strings.TrimSpace(string(data)))
+			return 1
+		}
+		if *file == "" {
+			fmt.Println(string(data))
+			return 0
+		}
+		if err = ioutil.WriteFile(*file, data, 0600); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to save backup:", err)
+			return 1
+		}
+		fmt.Println("Saved to", *file)
+	case "restore":
+		data, err := ioutil.ReadFile(*file)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Which backup? Use -file:", err)
+			return 2
+		}
+		if _, err = parseBackup(data); err != nil { // Check it here, so we don't bother the driver with rubbish
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		response, err := askDriver("POST", api+"?mode="+url.QueryEscape(*mode), "application/json", strings.NewReader(string(data)), *token)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to reach the driver:", err)
+			return 1
+		}
+		defer response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			message, _ := ioutil.ReadAll(response.Body)
+			fmt.Fprintln(os.Stderr, "The driver couldn't restore it:", strings.TrimSpace(string(message)))
+			return 1
+		}
+
+		var report BackupReport
+		json.NewDecoder(response.Body).Decode(&report)
+		fmt.Printf("Restored (%s). Added %d IR codes, %d groups, %d RF switches and %d other things\n", report.Mode, report.Codes, report.Groups, report.Switches, report.Other)
+		for _, conflict := range report.Conflicts {
+			fmt.Println("  Kept ours:", conflict)
+		}
+		fmt.Println("A snapshot of how things were is in", report.Snapshot)
+	case "list":
+		if _, err := os.Stat(*directory); err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to list snapshots:", err)
+			return 1
+		}
+		for _, name := range snapshotsIn(*directory) { // Newest first
+			fmt.Println(name)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, "Unknown action:", action, "(try export, restore or list)")
+		return 2
+	}
+
+	return 0
+}
+
+// askDriver sends a request to the running driver, along with its token (see http.go)
+func askDriver(method string, address string, contentType string, body io.Reader, token string) (*http.Response, error) {
+	request, err := http.NewRequest(method, address, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		request.Header.Set("Content-Type", contentType)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	return http.DefaultClient.Do(request)
+}
+
+// cliDevice makes just enough of a device for tables.go to talk to, from an IP and MAC address given on the command line
+func cliDevice(ip string, mac string) (*orvibo.Device, error) {
+	address := net.ParseIP(ip)
+	if address == nil {
+		return nil, fmt.Errorf("Which socket? Use -ip with the socket's IP address")
+	}
+	mac = normaliseMAC(mac)
+	if len(mac) != 12 {
+		return nil, fmt.Errorf("Which socket? Use -mac with the socket's MAC address")
+	}
+
+	return &orvibo.Device{
+		MACAddress: mac,
+		IP:         &net.UDPAddr{IP: address, Port: orviboPort},
+	}, nil
+}
@@ -0,0 +1,367 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// A code pack is one remote's worth of codes (a code group and everything in it), plus what it's for, so you can hand your
+// TV's codes to a neighbour with the same TV instead of them learning 40 buttons. Unlike a backup (see backup.go), a pack
+// doesn't say which AllOne to use, because yours won't be theirs. That gets picked when it's imported
+
+// The format and version of code packs we make. If the format changes, bump codePackVersion and teach parseCodePack about
+// the old one
+const (
+	codePackFormat  = "orvibo-codepack"
+	codePackVersion = 1
+)
+
+// OrviboCodePack is one code group, ready to share
+type OrviboCodePack struct {
+	Format      string // Always codePackFormat, so we can tell a pack from any other JSON
+	Version     int    // codePackVersion, when it was made
+	Driver      string // The version of the driver that made it
+	Brand       string // e.g. "Samsung"
+	Model       string // e.g. "UE40D5000"
+	Description string `json:",omitempty"`
+	Group       string // The name of the group the codes came from
+	Codes       []OrviboCodePackCode
+}
+
+// OrviboCodePackCode is one code in a pack. It's OrviboIRCode, minus the AllOne and group
+type OrviboCodePackCode struct {
+	Name        string
+	Description string `json:",omitempty"`
+	Code        string
+	Protocol    string `json:",omitempty"`
+	Address     uint32 `json:",omitempty"`
+	Command     uint32 `json:",omitempty"`
+	Repeats     int    `json:",omitempty"`
+	RepeatGap   int    `json:",omitempty"`
+	HoldFor     int    `json:",omitempty"`
+	Frequency   int    `json:",omitempty"`
+}
+
+func init() {
+	mux.HandleFunc("/api/codepack", codePackAPI)
+}
+
+// makeCodePack packs up one of our code groups
+func makeCodePack(group string, brand string, model string) (*OrviboCodePack, error) {
+	pack := &OrviboCodePack{
+		Format:  codePackFormat,
+		Version: codePackVersion,
+		Driver:  info.Version,
+		Brand:   strings.TrimSpace(brand),
+		Model:   strings.TrimSpace(model),
+		Group:   group,
+	}
+	for _, codegroup := range driver.config.CodeGroups {
+		if codegroup.Name == group {
+			pack.Description = codegroup.Description
+		}
+	}
+
+	for _, ir := range driver.config.Codes {
+		if ir.Group != group {
+			continue
+		}
+		pack.Codes = append(pack.Codes, OrviboCodePackCode{
+			Name:        ir.Name,
+			Description: ir.Description,
+			Code:        ir.Code,
+			Protocol:    ir.Protocol,
+			Address:     ir.Address,
+			Command:     ir.Command,
+			Repeats:     ir.Repeats,
+			RepeatGap:   ir.RepeatGap,
+			HoldFor:     ir.HoldFor,
+			Frequency:   ir.Frequency,
+		})
+	}
+	if len(pack.Codes) == 0 {
+		return nil, fmt.Errorf("There aren't any codes in %s", group)
+	}
+	return pack, nil
+}
+
+// parseCodePack reads a code pack, and checks it's one we can import
+func parseCodePack(data []byte) (*OrviboCodePack, error) {
+	var pack OrviboCodePack
+	if err := json.Unmarshal(data, &pack); err != nil {
+		return nil, fmt.Errorf("Not a code pack: %s", err)
+	}
+	if pack.Format != codePackFormat || pack.Version < 1 {
+		return nil, fmt.Errorf("Not a code pack")
+	}
+	if pack.Version > codePackVersion {
+		return nil, fmt.Errorf("This code pack was made by a newer version of the driver (%s, pack version %d). Please upgrade to import it", pack.Driver, pack.Version)
+	}
+	if len(pack.Codes) == 0 {
+		return nil, fmt.Errorf("There aren't any codes in this pack")
+	}
+	for _, code := range pack.Codes {
+		if strings.TrimSpace(code.Name) == "" {
+			return nil, fmt.Errorf("One of the codes in this pack doesn't have a name")
+		}
+		if _, err := ircode.ParseAllOne(code.Code); err != nil {
+			return nil, fmt.Errorf("%s isn't a code the AllOne can blast: %s", code.Name, err)
+		}
+	}
+	return &pack, nil
+}
+
+// importCodePack adds a pack's codes to a group (the pack's own name, unless we're given another), blasting from allone.
+// Codes already in the group with the same name are skipped. Returns how many were added and how many were skipped
+func importCodePack(pack *OrviboCodePack, allone string, group string, source string) (int, int, error) {
+	if strings.TrimSpace(group) == "" {
+		group = pack.Group
+	}
+	if strings.TrimSpace(group) == "" {
+		group = strings.TrimSpace(pack.Brand + " " + pack.Model)
+	}
+	if allone == "" {
+		allone = "ALL"
+	}
+
+	description := pack.Description
+	if description == "" {
+		description = strings.TrimSpace(pack.Brand + " " + pack.Model)
+	}
+	driver.ensureGroup(group, description)
+
+	added, skipped := 0, 0
+	for _, code := range pack.Codes {
+		exists := false
+		for _, ours := range driver.config.Codes {
+			exists = exists || ours.Group == group && ours.Name == code.Name
+		}
+		if exists {
+			skipped++
+			continue
+		}
+
+		ir := OrviboIRCode{
+			Name:        code.Name,
+			Description: code.Description,
+			Code:        code.Code,
+			AllOne:      allone,
+			Group:       group,
+			Protocol:    code.Protocol,
+			Address:     code.Address,
+			Command:     code.Command,
+			Repeats:     code.Repeats,
+			RepeatGap:   code.RepeatGap,
+			HoldFor:     code.HoldFor,
+			Frequency:   code.Frequency,
+		}
+		if ir.Protocol == "" {
+			decodeIR(&ir)
+		}
+		driver.config.Codes = append(driver.config.Codes, ir)
+		added++
+	}
+
+	logEvent("config", allone, source, fmt.Sprintf("imported code pack %s %s into %s: %d codes (%d already there)", pack.Brand, pack.Model, group, added, skipped))
+	return added, skipped, driver.saveConfig()
+}
+
+// codePackAPI makes a code pack (GET with ?group=, ?brand= and ?model=) or imports one (POST it as the body, with ?allone=
+// and optionally ?group= to put it in a different group)
+func codePackAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		data, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		pack, err := parseCodePack(data)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		added, skipped, err := importCodePack(pack, r.URL.Query().Get("allone"), r.URL.Query().Get("group"), "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"Imported": added, "Skipped": skipped})
+		return
+	}
+
+	pack, err := makeCodePack(r.FormValue("group"), r.FormValue("brand"), r.FormValue("model"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(pack)
+}
+
+// Shows the UI for sharing a code group as a pack
+func (c *configService) sharecodepack() (*suit.ConfigurationScreen, error) {
+	screen := suit.ConfigurationScreen{
+		Title: "Share a Remote",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Pick a group to share as a code pack, which someone with the same device can import on the 'Import Code Pack' screen. Saying what the codes are for helps them know it'll work",
+					},
+					suit.RadioGroup{
+						Title:   "Group to share",
+						Name:    "group",
+						Options: groupOptions(),
+					},
+					suit.InputText{
+						Name:        "brand",
+						Before:      "Brand",
+						Placeholder: "Samsung",
+					},
+					suit.InputText{
+						Name:        "model",
+						Before:      "Model",
+						Placeholder: "UE40D5000",
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Make Code Pack",
+				Name:         "showcodepack",
+				DisplayClass: "success",
+				DisplayIcon:  "export",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// showcodepack shows the pack made on the "Share a Remote" screen, ready to copy
+func (c *configService) showcodepack(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	pack, err := makeCodePack(vals["group"], vals["brand"], vals["model"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+	data, err := json.MarshalIndent(pack, "", "  ")
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	return &suit.ConfigurationScreen{
+		Title: "Code Pack",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: fmt.Sprintf("This is %d codes from %s. Copy it and pass it on", len(pack.Codes), pack.Group),
+					},
+					suit.StaticText{
+						Title: "Code pack",
+						Value: string(data),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+		},
+	}, nil
+}
+
+// Shows the UI for importing a code pack
+func (c *configService) codepack() (*suit.ConfigurationScreen, error) {
+	screen := suit.ConfigurationScreen{
+		Title: "Import Code Pack",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Paste in a code pack someone has shared with you, and pick which AllOne should blast the codes",
+					},
+					suit.InputText{
+						Name:        "pack",
+						Before:      "Code pack",
+						Placeholder: "{\"Format\": \"orvibo-codepack\", ...}",
+					},
+					suit.InputText{
+						Name:        "group",
+						Before:      "Group (leave blank to use the pack's)",
+						Placeholder: "Living Room TV",
+					},
+					suit.RadioGroup{
+						Title:   "Select an AllOne to blast from",
+						Name:    "allone",
+						Value:   "ALL",
+						Options: allOneOptions(),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Import",
+				Name:         "savecodepack",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savecodepack imports the pack from the "Import Code Pack" screen
+func (c *configService) savecodepack(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	pack, err := parseCodePack([]byte(vals["pack"]))
+	if err != nil {
+		return c.error(err.Error())
+	}
+	added, skipped, err := importCodePack(pack, vals["allone"], strings.TrimSpace(vals["group"]), "labs")
+	if err != nil {
+		return c.error(err.Error())
+	}
+	if skipped > 0 {
+		return c.confirm("Import Code Pack", fmt.Sprintf("Imported %d codes. %d were skipped, because there was already a code with the same name in that group", added, skipped))
+	}
+	return c.list()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strconv"
 	"strings"
 
 	"github.com/Grayda/go-orvibo"
@@ -23,7 +24,7 @@ func (c *configService) GetActions(request *model.ConfigurationRequest) (*[]suit
 	// What we're going to show
 	var screen []suit.ReplyAction
 	// Loop through all Orvibo devices. We do this so we can find an AllOne
-	for _, allone := range driver.device {
+	for _, allone := range driver.devices() {
 		// If it's an AllOne
 		if allone.Device.DeviceType == orvibo.ALLONE {
 			// Add a menu option
@@ -31,12 +32,63 @@ func (c *configService) GetActions(request *model.ConfigurationRequest) (*[]suit
 				Name:        "",
 				Label:       "Configure AllOne",
 				DisplayIcon: "play",
+			}, suit.ReplyAction{
+				Name:        "airconditioners",
+				Label:       "Air Conditioners",
+				DisplayIcon: "fire",
 			},
 			)
 			// We've found at least one AllOne. That's enough to show the UI, so we stop looping
 			break
 		}
 	}
+	// History and settings are always available, whatever devices we've got
+	screen = append(screen, suit.ReplyAction{
+		Name:        "history",
+		Label:       "Event History",
+		DisplayIcon: "time",
+	}, suit.ReplyAction{
+		Name:        "settings",
+		Label:       "Driver Settings",
+		DisplayIcon: "cog",
+	}, suit.ReplyAction{
+		Name:        "devicesettings",
+		Label:       "Device Settings",
+		DisplayIcon: "wrench",
+	}, suit.ReplyAction{
+		Name:        "static",
+		Label:       "Static Devices",
+		DisplayIcon: "map-marker",
+	}, suit.ReplyAction{
+		Name:        "adoption",
+		Label:       "Device Adoption",
+		DisplayIcon: "lock",
+	}, suit.ReplyAction{
+		Name:        "backup",
+		Label:       "Backup & Restore",
+		DisplayIcon: "floppy-disk",
+	},
+	)
+	// Same again, but for sockets. This shows our energy usage and timer screens
+	for _, socket := range driver.devices() {
+		if socket.Device.DeviceType == orvibo.SOCKET {
+			screen = append(screen, suit.ReplyAction{
+				Name:        "energy",
+				Label:       "Socket Energy Usage",
+				DisplayIcon: "flash",
+			}, suit.ReplyAction{
+				Name:        "timers",
+				Label:       "Socket Timers",
+				DisplayIcon: "time",
+			}, suit.ReplyAction{
+				Name:        "powerstrips",
+				Label:       "Power Strips",
+				DisplayIcon: "th-list",
+			},
+			)
+			break
+		}
+	}
 	// Return our screen to the sphere-ui for rendering
 	return &screen, nil
 }
@@ -61,6 +113,9 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		// As inferred from the fmt.Println above, codes[0] (being vals["switches"] split by the | command) is the IR and codes[1] is the AllOne to shoot from (MAC Address)
 		//	orvibo.EmitRF(state bool, RF string, macAdd string)
 		orvibo.EmitRF(true, codes[0], codes[1], codes[2])
+		rfBlasts.Inc(codes[2])
+		packetsSent.Inc("emitrf")
+		logEvent("blastrf", codes[2], "labs", codes[0]+" on")
 		// c.list creates a list of AllOne IR codes and sends them back to sphere-ui / suits for displaying
 		return c.list()
 	case "blastrfoff": // Blasting IR codes
@@ -77,6 +132,9 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		// As inferred from the fmt.Println above, codes[0] (being vals["switches"] split by the | command) is the IR and codes[1] is the AllOne to shoot from (MAC Address)
 		//	orvibo.EmitRF(state bool, RF string, macAdd string)
 		orvibo.EmitRF(false, codes[0], codes[1], codes[2])
+		rfBlasts.Inc(codes[2])
+		packetsSent.Inc("emitrf")
+		logEvent("blastrf", codes[2], "labs", codes[0]+" off")
 		// c.list creates a list of AllOne IR codes and sends them back to sphere-ui / suits for displaying
 		return c.list()
 
@@ -88,22 +146,82 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		// Because ActionListOption can't return more than one lot of data and we need to let our code know
 		// WHAT code to blast, and what AllOne to shoot it from, we use a pipe to mash data together
 		var codes = strings.Split(vals["code"], "|")
-		fmt.Println("Blasting IR code " + codes[0] + " on AllOne: " + codes[1] + "..")
-		// As inferred from the fmt.Println above, codes[0] (being vals["code"] split by the | command) is the IR and codes[1] is the AllOne to shoot from (MAC Address)
-		orvibo.EmitIR(codes[0], codes[1])
+		// codes[0] (being vals["code"] split by the | command) is the IR and codes[1] is the AllOne to shoot from (MAC Address)
+		if ir := findIR(codes[0], codes[1]); ir != nil { // Saved codes can have repeats, so they need a little more work
+			if err := blastCode(*ir, "labs"); err != nil {
+				return c.error(err.Error())
+			}
+			return c.list()
+		}
+		blastIR(codes[0], codes[1], "labs", irCodeName(codes[0]))
 		// c.list creates a list of AllOne IR codes and sends them back to sphere-ui / suits for displaying
 		return c.list()
 	case "new": // If we've clicked the New IR button
 		// Returns a configuration screen with textboxes and stuff, to allow users to set up a new IR code
 		return c.new(driver.config)
+	case "newprotocol": // Make a code from a protocol, address and command instead of learning it
+		return c.newprotocol()
+	case "saveprotocol":
+		return c.saveprotocol(request)
+	case "repeats": // Repeat and long press options for saved codes
+		return c.repeats()
+	case "coderepeats":
+		return c.coderepeats(request)
+	case "saverepeats":
+		return c.saverepeats(request)
+	case "importexport": // All the ways of getting codes in and out
+		return c.importexport()
+	case "newpronto": // Paste in a Pronto hex code
+		return c.newpronto()
+	case "savepronto":
+		return c.savepronto(request)
+	case "exportpronto": // Show our codes as Pronto hex
+		return c.exportpronto()
+	case "lirc": // Import remotes from a lircd.conf file
+		return c.lirc()
+	case "previewlirc":
+		return c.previewlirc(request)
+	case "savelirc":
+		return c.savelirc(request)
+	case "library": // Browse the built in IR code library
+		var vals map[string]string
+		json.Unmarshal(request.Data, &vals)
+		return c.library(vals["search"])
+	case "librarytest":
+		return c.librarytest(request)
+	case "librarypower":
+		return c.librarypower(request)
+	case "librarynext":
+		return c.librarynext(request)
+	case "savelibrary":
+		return c.savelibrary(request)
+	case "broadlink": // Import codes from a Broadlink RM
+		return c.broadlink()
+	case "savebroadlink":
+		return c.savebroadlink(request)
+	case "exportbroadlink": // Show our codes as a Broadlink library
+		return c.exportbroadlink()
+	case "sharecodepack": // Share a group of codes as a code pack
+		return c.sharecodepack()
+	case "showcodepack":
+		return c.showcodepack(request)
+	case "codepack": // Import a code pack someone has shared
+		return c.codepack()
+	case "savecodepack":
+		return c.savecodepack(request)
 	case "newrf": // If we've clicked the New IR button
 		// Returns a configuration screen with textboxes and stuff, to allow users to set up a new IR code
 		return c.newrf(driver.config)
 	case "reset": // For debugging purposes. Clears out the stored codes
+		if driver.config.learningIR == true { // Reset halfway through learning? That session isn't going anywhere
+			learningSessions.Inc("cancelled")
+		}
+		snapshotOrWarn("reset") // There's no undo, so keep a copy. See backup.go
 		driver.config.Codes = nil
 		driver.config.learningIR = false
 		driver.config.learningIRName = ""
-		driver.SendEvent("config", driver.config) // Writes the changes back to config
+		driver.saveConfig() // Writes the changes back to config
+		logEvent("config", "", "labs", "reset all IR codes")
 		return c.list()
 	case "delete": // Delete a code. Very similar to the blastIR code above. Takes the reply, splits it by "|" and then passes that to driver.deleteIR
 		var vals map[string]string
@@ -112,6 +230,8 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
 		var codes = strings.Split(vals["code"], "|")
+		snapshotOrWarn("delete")
+		logEvent("config", codes[1], "labs", "deleted IR code "+irCodeName(codes[0]))
 		driver.deleteIR(driver.config, codes[0])
 
 		return c.list() // Take us back to the list of saved IR codes
@@ -130,6 +250,7 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 			Description: vals["description"],
 		})
 		driver.saveGroups(driver.config)
+		logEvent("config", "", "labs", "added group "+vals["name"])
 		return c.list()
 	case "save": // Very similar to savegroup, but saves an IR code instead
 		var vals map[string]string
@@ -138,6 +259,12 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
 		}
 
+		// If we were already learning and never got a code back, that session has been abandoned
+		if driver.config.learningIR == true {
+			learningSessions.Inc("abandoned")
+		}
+		learningSessions.Inc("started")
+
 		// Now we tell our driver we're being put into learning mode.
 		driver.config.learningIR = true
 		driver.config.learningIRName = vals["name"]
@@ -146,6 +273,8 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 		driver.config.learningIRGroup = vals["group"]
 		// Tell the driver to put vals["allone"] (the MAC Address of our AllOne) into learning mode. Give it the MAC Address "ALL" to put All AllOnes into learning mode
 		orvibo.EnterLearningMode(vals["allone"])
+		packetsSent.Inc("learn")
+		logEvent("config", vals["allone"], "labs", "started learning IR code "+vals["name"])
 
 		// The UI isn't event driven, meaning we can't tell the UI to pause until we get an IR code back. If we go back to c.list(), there won't be a code there (because we're
 		// still learning), so we shove this page in the middle that makes the user click OK when done. When they do, the code has already been learned and shows up in the UI
@@ -166,7 +295,101 @@ func (c *configService) Configure(request *model.ConfigurationRequest) (*suit.Co
 			AllOne:      vals["allone"],
 			Group:       vals["group"],
 		})
+		logEvent("config", vals["allone"], "labs", "added RF switch "+vals["name"])
 		return c.confirm("Learning RF switch", "To set up this switch, press 'Okay', then press and hold a button on your RF switch until it beeps. In the Labs page, tap to turn the new switch on or off. The code the AllOne emits will be 'written' to the wall switch")
+	case "backup": // Back up or restore our whole config
+		return c.backup()
+	case "showbackup":
+		return c.showbackup()
+	case "savesnapshot":
+		if _, err := snapshot("manual"); err != nil {
+			return c.error(fmt.Sprintf("Unable to save snapshot: %s", err))
+		}
+		return c.backup()
+	case "restorebackup", "restoresnapshot":
+		return c.restorebackup(request)
+	case "adoption": // Shows devices waiting for approval, plus our allow / deny lists
+		return c.adoption()
+	case "approve":
+		return c.decide(request, true)
+	case "deny":
+		return c.decide(request, false)
+	case "saveadoption":
+		return c.saveadoption(request)
+	case "static": // Shows our static devices (ones on other subnets)
+		return c.static()
+	case "savestatic":
+		return c.savestatic(request)
+	case "deletestatic":
+		return c.deletestatic(request)
+	case "settings": // Shows our driver settings (discovery intervals and such)
+		return c.settings()
+	case "savesettings":
+		return c.savesettings(request)
+	case "devicesettings": // Lists our devices so we can change the settings stored on them
+		return c.devicesettings()
+	case "editdevicesettings":
+		return c.editdevicesettings(request)
+	case "savedevicesettings", "resetpassword", "synctimezone":
+		return c.savedevicesettings(request, request.Action)
+	case "history": // Shows what's been happening
+		return c.history()
+	case "timers": // Shows the timers stored on our sockets
+		return c.timers()
+	case "edittimer": // New (or edited) timer
+		return c.edittimer(request)
+	case "savetimer":
+		return c.savetimer(request)
+	case "deletetimer":
+		return c.deletetimer(request)
+	case "savecountdown":
+		return c.savecountdown(request)
+	case "airconditioners": // Air conditioners we control through an AllOne
+		return c.airconditioners()
+	case "newaircon":
+		return c.newaircon()
+	case "saveaircon":
+		return c.saveaircon(request)
+	case "aircon":
+		return c.aircon(request)
+	case "setaircon":
+		return c.setaircon(request)
+	case "deleteaircon":
+		return c.deleteaircon(request)
+	case "powerstrips": // Lets us mark sockets as power strips and name their outlets
+		return c.powerstrips()
+	case "savepowerstrips":
+		return c.savepowerstrips(request)
+	case "energy": // Shows the energy usage of our sockets
+		return c.energy()
+	case "saveenergy": // We've hit "Save" on the energy screen. Save the wattages and cost
+		var vals map[string]string
+		err := json.Unmarshal(request.Data, &vals)
+		if err != nil {
+			return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+		}
+
+		for name, value := range vals {
+			if strings.HasPrefix(name, "watts_") { // Our wattage textboxes are named watts_<MAC address>
+				watts, err := strconv.ParseFloat(value, 64)
+				if err != nil || watts < 0 {
+					return c.error(fmt.Sprintf("Invalid wattage: %s", value))
+				}
+				setWatts(strings.TrimPrefix(name, "watts_"), watts)
+			}
+		}
+
+		if vals["cost"] != "" {
+			cost, err := strconv.ParseFloat(vals["cost"], 64)
+			if err != nil {
+				return c.error(fmt.Sprintf("Invalid cost: %s", vals["cost"]))
+			}
+			driver.config.CostPerKWh = cost
+		}
+
+		driver.saveConfig()
+		logEvent("config", "", "labs", "updated energy settings")
+		return c.energy()
 	case "": // Coming in from the main menu
 		return c.list()
 
@@ -264,7 +487,7 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 				// Add this code to the section
 				codes = append(codes, suit.ActionListOption{
 					Title:    code.Name,
-					Subtitle: code.Description,
+					Subtitle: irSubtitle(code),
 					Value:    code.Code + "|" + code.AllOne, // We need to add a pipe because we can't set Value: twice, so we mash two lots of data together, split up by a "|"
 				})
 
@@ -332,6 +555,24 @@ func (c *configService) list() (*suit.ConfigurationScreen, error) {
 				DisplayClass: "success",
 				DisplayIcon:  "asterisk",
 			},
+			suit.ReplyAction{
+				Label:        "New IR Code From Protocol",
+				Name:         "newprotocol",
+				DisplayClass: "success",
+				DisplayIcon:  "pencil",
+			},
+			suit.ReplyAction{
+				Label:        "Repeat & Hold",
+				Name:         "repeats", // Long presses and repeats for saved codes. See ircodes.go
+				DisplayClass: "info",
+				DisplayIcon:  "repeat",
+			},
+			suit.ReplyAction{
+				Label:        "Import / Export",
+				Name:         "importexport", // Pronto, LIRC, Broadlink and code packs. See ircodes.go
+				DisplayClass: "default",
+				DisplayIcon:  "transfer",
+			},
 			suit.ReplyAction{ // Reply action. Same as the rest
 				Label:        "New RF Code",
 				Name:         "newrf", // Back in c.Configuration, show the new code UI
@@ -376,7 +617,7 @@ func (c *configService) new(config *OrviboDriverConfig) (*suit.ConfigurationScre
 	}
 
 	// Loop through all Orvibo devices.
-	for _, allone := range driver.device {
+	for _, allone := range driver.devices() {
 		// If it's an AllOne
 		if allone.Device.DeviceType == orvibo.ALLONE {
 			// Add a Radio button with our AllOne's name and MAC Address
@@ -474,7 +715,7 @@ func (c *configService) newrf(config *OrviboDriverConfig) (*suit.ConfigurationSc
 	}
 
 	// Loop through all Orvibo devices.
-	for _, allone := range driver.device {
+	for _, allone := range driver.devices() {
 		// If it's an AllOne
 		if allone.Device.DeviceType == orvibo.ALLONE {
 			// Add a Radio button with our AllOne's name and MAC Address
@@ -613,6 +854,16 @@ func i(i int) *int {
 	return &i
 }
 
+// irCodeName looks up the name of a saved IR code, so our history says "TV On" instead of a wall of hex
+func irCodeName(code string) string {
+	for _, ircode := range driver.config.Codes {
+		if ircode.Code == code {
+			return ircode.Name
+		}
+	}
+	return code
+}
+
 func contains(s []string, e string) bool {
 	for _, a := range s {
 		if a == e {
@@ -5,6 +5,8 @@ import (
 	"log"
 	"regexp"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/Grayda/go-orvibo"
 	"github.com/ninjasphere/go-ninja/api"
@@ -18,7 +20,15 @@ type OrviboDevice struct {
 	info         *model.Device
 	sendEvent    func(event string, payload interface{}) error // For pasing info back to the API. Use this to send configs and such
 	onOffChannel *channels.OnOffChannel                        // There are other channels, but
+	powerChannel *channels.PowerChannel                        // Estimated power usage. The S20 can't measure this, so see energy.go
+	alarmChannel *keplerChannel                                // Kepler gas detectors only. See kepler.go
+	gasChannel   *keplerChannel
+	Outlets      []*OrviboOutlet // Power strips only. The strip's own on-off channel becomes the master switch. See powerstrip.go
+	outletLock   sync.Mutex      // Guards Outlets and each outlet's State
+	switchLock   sync.Mutex      // Held while outlets are being switched, so two changes can't undo each other
 	Device       *orvibo.Device
+	Online       bool      // Has this device talked to us recently? See liveness.go
+	LastSeen     time.Time // When we last heard from this device
 }
 
 // NewOrviboDevice is called when When go-orvibo finds a new Orvibo device. The results are then appended to an array
@@ -28,8 +38,10 @@ func NewOrviboDevice(driver ninja.Driver, id *orvibo.Device) *OrviboDevice {
 	name := id.Name
 
 	device := &OrviboDevice{
-		driver: driver,
-		Device: id,
+		driver:   driver,
+		Device:   id,
+		Online:   true, // We've only just heard from it, after all
+		LastSeen: time.Now(),
 		info: &model.Device{
 			NaturalID:     fmt.Sprintf("socket%s", id.MACAddress),
 			NaturalIDType: "socket",
@@ -46,6 +58,17 @@ func NewOrviboDevice(driver ninja.Driver, id *orvibo.Device) *OrviboDevice {
 	// Make a new on / off channel. Channels are what info can be passed through. For example, onoff is for things like
 	// lightswitches (and appear in the Sphere app as a power button with power usage graph), while BrightnessChannel is for things like lights or TV brightness etc.
 	device.onOffChannel = channels.NewOnOffChannel(device)
+	device.powerChannel = channels.NewPowerChannel(device)
+
+	// Keplers aren't sockets, so they get different channels and show up as a different kind of thing
+	if id.DeviceType == orvibo.KEPLER {
+		device.info.NaturalID = fmt.Sprintf("kepler%s", id.MACAddress)
+		device.info.NaturalIDType = "kepler"
+		(*device.info.Signatures)["ninja:productType"] = "Kepler"
+		(*device.info.Signatures)["ninja:thingType"] = "sensor"
+		device.alarmChannel = newKeplerChannel("alarm")
+		device.gasChannel = newKeplerChannel("gas")
+	}
 	return device
 }
 
@@ -59,22 +82,45 @@ func (d *OrviboDevice) GetDriver() ninja.Driver {
 	return d.driver
 }
 
-// SetOnOff does what it says on the tin: Turns our socket on or off. This function is called when you tap an icon on the LED matrix or turn it on / off in the Sphere app
+// SetOnOff does what it says on the tin: Turns our socket on or off. This function is called when you tap an icon on the LED matrix or turn it on / off in the Sphere app.
+// We wait for the socket to confirm before returning (see acknowledge.go). The "statechanged" handler in theloop tells the Sphere the new state
 func (d *OrviboDevice) SetOnOff(state bool) error {
 	fmt.Println("Setting state to", state)
-	orvibo.SetState(d.Device.MACAddress, state)
-	d.onOffChannel.SendState(state)
+	if outlets := d.outlets(); len(outlets) > 0 { // A power strip. Turn every outlet on or off
+		return d.setOutlets(allOutlets(len(outlets), state), "sphere")
+	}
+	expectState(d.Device.MACAddress, state, "sphere") // So our history knows it was us
+
+	err := setStateAndWait(d.Device.MACAddress, state)
+	if err != nil {
+		fmt.Println("Error:", err)
+		// Whatever the Sphere thinks happened, tell it what really happened
+		d.sendState(d.state())
+		return err
+	}
+
 	return nil
 }
 
-// ToggleOnOff does a imilar thing to SetOnOff, but is state independent. If it's on, turn it off, and the other way around
+// ToggleOnOff does a imilar thing to SetOnOff, but is state independent. If it's on, turn it off, and the other way around.
+// go-orvibo has ToggleState, but we'd have no way of knowing what to wait for, so we work out the new state ourselves
 func (d *OrviboDevice) ToggleOnOff() error {
 	fmt.Println("Toggling state")
-	// Asks go-orvibo to do this for us
-	orvibo.ToggleState(d.Device.MACAddress)
-	// Tells the Ninja Sphere what our current state is
-	d.onOffChannel.SendState(d.Device.State)
-	return nil
+	return d.SetOnOff(!d.state())
+}
+
+// state is what go-orvibo last heard the socket say. Its devices belong to theloop, so we ask theloop rather than reading it
+// ourselves. Don't call this from theloop
+func (d *OrviboDevice) state() bool {
+	var state bool
+	onLoop(func() { state = d.Device.State })
+	return state
+}
+
+// updateEnergy records a state change for our energy estimates, then tells the Sphere how many watts we're (probably) using
+func (d *OrviboDevice) updateEnergy(state bool) {
+	recordState(d.Device.MACAddress, state, time.Now())
+	d.powerChannel.SendState(currentWatts(d.Device.MACAddress))
 }
 
 // SetEventHandler is something I have no idea of. Looks like it's just handing a sendEvent off to the OrviboDevice. Necessary?
@@ -82,22 +128,158 @@ func (d *OrviboDevice) SetEventHandler(sendEvent func(event string, payload inte
 	d.sendEvent = sendEvent
 }
 
-// Regex that finds a-z (lowercase) and 0-9. Used when creating a safe name for our socket
-var reg, _ = regexp.Compile("[^a-z0-9]")
+// OrviboOutlet is one outlet on a power strip. Each one is its own device in the Sphere, so it can be switched and named on its own.
+// The Sphere calls SetOnOff on the device that owns a channel, which is why outlets can't just be extra channels on the strip
+type OrviboOutlet struct {
+	strip        *OrviboDevice
+	Number       int // Starting from 1, like the labels on the strip
+	State        bool
+	info         *model.Device
+	sendEvent    func(event string, payload interface{}) error
+	onOffChannel *channels.OnOffChannel
+}
+
+// NewOrviboOutlet makes outlet number (starting from 1) of a power strip
+func NewOrviboOutlet(strip *OrviboDevice, number int, name string) *OrviboOutlet {
+	outlet := &OrviboOutlet{
+		strip:  strip,
+		Number: number,
+		info: &model.Device{
+			NaturalID:     fmt.Sprintf("socket%s-%d", strip.Device.MACAddress, number),
+			NaturalIDType: "socket",
+			Name:          &name,
+			Signatures: &map[string]string{
+				"ninja:manufacturer": "Orvibo",
+				"ninja:productName":  "OrviboDevice",
+				"ninja:productType":  "Outlet",
+				"ninja:thingType":    "socket",
+			},
+		},
+	}
+
+	outlet.onOffChannel = channels.NewOnOffChannel(outlet)
+	return outlet
+}
+
+// GetDeviceInfo tells the Sphere about this outlet
+func (o *OrviboOutlet) GetDeviceInfo() *model.Device {
+	return o.info
+}
+
+// GetDriver returns our driver, same as the strip
+func (o *OrviboOutlet) GetDriver() ninja.Driver {
+	return o.strip.driver
+}
+
+// SetEventHandler is the same as OrviboDevice's
+func (o *OrviboOutlet) SetEventHandler(sendEvent func(event string, payload interface{}) error) {
+	o.sendEvent = sendEvent
+}
+
+// SetOnOff turns just this outlet on or off, leaving the others alone
+func (o *OrviboOutlet) SetOnOff(state bool) error {
+	fmt.Println("Setting outlet", o.Number, "of", o.strip.Device.MACAddress, "to", state)
+	return o.strip.setOutlet(o.Number, state, "sphere")
+}
+
+// ToggleOnOff flips just this outlet
+func (o *OrviboOutlet) ToggleOnOff() error {
+	return o.SetOnOff(!o.state())
+}
+
+// SetName renames an outlet. The strip only has room for one name, so outlet names are kept in our config instead
+func (o *OrviboOutlet) SetName(name *string) (*string, error) {
+	safe := strings.TrimSpace(*name)
+	if safe == "" {
+		return nil, fmt.Errorf("Outlets need a name")
+	}
 
-// SetName might not be used by us, but the Sphere might do this for us (though I doubt it?). If we rename a device in the Sphere app, make it into a name that won't cause crashes
+	setOutletName(o.strip.Device.MACAddress, o.Number, safe)
+	logEvent("config", o.strip.Device.MACAddress, "sphere", fmt.Sprintf("renamed outlet %d to %s", o.Number, safe))
+	o.info.Name = &safe
+	if o.sendEvent != nil {
+		o.sendEvent("renamed", safe)
+	}
+	return &safe, nil
+}
+
+// Regex that finds anything that isn't printable ASCII. Used when creating a safe name for our socket
+var reg, _ = regexp.Compile("[^ -~]")
+
+// SetName is called when we rename a device in the Sphere app. The name is written to the device itself (table 4, see tables.go)
+// so the Orvibo phone app sees it too, then read back to make sure it stuck
 func (d *OrviboDevice) SetName(name *string) (*string, error) {
 
 	log.Printf("Setting device name to %s", *name)
 
-	safe := reg.ReplaceAllString(strings.ToLower(*name), "")
-	if len(safe) > 16 {
-		safe = safe[0:16]
+	// Devices store up to 16 bytes of plain ASCII, padded with spaces, so anything else has to go
+	safe := strings.TrimSpace(reg.ReplaceAllString(*name, ""))
+	if len(safe) > settingsNameLength {
+		safe = strings.TrimSpace(safe[0:settingsNameLength])
+	}
+	if safe == "" {
+		return nil, fmt.Errorf("%s doesn't have anything we can use as a name", *name)
 	}
 
-	log.Printf("We can only set 5 lowercase alphanum. Name now: %s", safe)
-	d.Device.Name = safe
-	d.sendEvent("renamed", safe)
+	log.Printf("We can only set %d plain characters. Name now: %s", settingsNameLength, safe)
 
+	record, err := readSettings(d.Device)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read settings from %s: %s", d.Device.MACAddress, err)
+	}
+
+	setField(record, settingsNameOffset, settingsNameLength, safe)
+	if err = writeRecord(d.Device, tableSettings, 1, record); err != nil {
+		return nil, fmt.Errorf("Unable to rename %s: %s", d.Device.MACAddress, err)
+	}
+
+	// Read it back, to make sure it actually took
+	record, err = readSettings(d.Device)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to confirm the new name of %s: %s", d.Device.MACAddress, err)
+	}
+	if confirmed := getField(record, settingsNameOffset, settingsNameLength); confirmed != safe {
+		return nil, fmt.Errorf("%s is still called %s", d.Device.MACAddress, confirmed)
+	}
+
+	onLoop(func() { d.renamed(safe, "sphere") })
 	return &safe, nil
 }
+
+// renamed updates our idea of a device's name and lets everyone know. go-orvibo changes names too, so this runs on theloop
+func (d *OrviboDevice) renamed(name string, source string) {
+	logEvent("config", d.Device.MACAddress, source, fmt.Sprintf("renamed from %s to %s", d.Device.Name, name))
+	d.Device.Name = name
+	d.info.Name = &name
+	if d.sendEvent != nil {
+		d.sendEvent("renamed", name)
+	}
+}
+
+// syncNames reads the name out of each of our devices, in case it's been renamed in the Orvibo phone app. Reading takes a
+// while, so we do that here. go-orvibo changes Device.Name on theloop whenever a device answers a query, so checking whether
+// the name is new and renaming both happen there too
+func syncNames() {
+	for _, device := range driver.devices() {
+		if !device.isOnline() {
+			continue
+		}
+
+		record, err := readSettings(device.Device)
+		if err != nil {
+			fmt.Println("Unable to check the name of", device.Device.MACAddress, ":", err)
+			continue
+		}
+
+		name := getField(record, settingsNameOffset, settingsNameLength)
+		if name == "" {
+			continue
+		}
+		onLoop(func() {
+			if name != device.Device.Name {
+				fmt.Println(device.Device.MACAddress, "has been renamed to", name)
+				device.renamed(name, "external")
+			}
+		})
+	}
+}
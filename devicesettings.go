@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// Orvibo devices keep their own settings (timezone, remote access password, button lock) in table 4 (see tables.go).
+// Until now the only way to change them was the Orvibo phone app. This file gives each device a "Device Settings"
+// screen in the Labs, plus /api/devicesettings. Every change is read back afterwards to make sure it stuck
+
+// The password a device has when it comes out of the box
+const defaultDevicePassword = "888888"
+
+// OrviboSettings is what we let people change on a device
+type OrviboSettings struct {
+	MACAddress      string
+	Name            string
+	Password        string `json:",omitempty"` // The remote access password. Never sent out over HTTP
+	DefaultPassword bool   // Is the password still the factory one? This is all /api/devicesettings tells you about it
+	Timezone        int    // Whole hours from UTC. Half hour timezones get rounded down, sorry Adelaide
+	AutoDST         bool   // Whether the device handles daylight saving itself
+	ButtonLock      bool   // Whether the button on the device is locked
+}
+
+func init() {
+	mux.HandleFunc("/api/devicesettings", deviceSettingsAPI)
+}
+
+// readDeviceSettings reads a device's settings out of table 4
+func readDeviceSettings(device *orvibo.Device) (OrviboSettings, error) {
+	record, err := readSettings(device)
+	if err != nil {
+		return OrviboSettings{}, err
+	}
+	if len(record) <= settingsLockOffset {
+		return OrviboSettings{}, fmt.Errorf("Settings record from %s is too short", device.MACAddress)
+	}
+
+	return OrviboSettings{
+		MACAddress: device.MACAddress,
+		Name:       getField(record, settingsNameOffset, settingsNameLength),
+		Password:   getField(record, settingsPasswordOffset, settingsPasswordLength),
+		Timezone:   int(int8(record[settingsTimezoneOffset])),
+		AutoDST:    record[settingsAutoDSTOffset] == 1,
+		ButtonLock: record[settingsLockOffset] == 1,
+	}, nil
+}
+
+// writeDeviceSettings writes a device's password, timezone and button lock (but not its name. That's SetName's job),
+// then reads them back to check
+func writeDeviceSettings(device *orvibo.Device, settings OrviboSettings) error {
+	if settings.Password == "" || len(settings.Password) > settingsPasswordLength || reg.MatchString(settings.Password) {
+		return fmt.Errorf("The password needs to be 1 to %d plain characters", settingsPasswordLength)
+	}
+	if settings.Timezone < -12 || settings.Timezone > 14 {
+		return fmt.Errorf("%d isn't a timezone. Use hours from UTC, e.g. 10 or -5", settings.Timezone)
+	}
+
+	record, err := readSettings(device)
+	if err != nil {
+		return err
+	}
+	if len(record) <= settingsLockOffset {
+		return fmt.Errorf("Settings record from %s is too short", device.MACAddress)
+	}
+
+	setField(record, settingsPasswordOffset, settingsPasswordLength, settings.Password)
+	record[settingsTimezoneOffset] = byte(int8(settings.Timezone))
+	record[settingsAutoDSTOffset] = 0
+	if settings.AutoDST {
+		record[settingsAutoDSTOffset] = 1
+	}
+	record[settingsLockOffset] = 0
+	if settings.ButtonLock {
+		record[settingsLockOffset] = 1
+	}
+
+	if err = writeRecord(device, tableSettings, 1, record); err != nil {
+		return err
+	}
+
+	// Read it back, to make sure it actually took
+	confirmed, err := readDeviceSettings(device)
+	if err != nil {
+		return fmt.Errorf("Unable to confirm the new settings: %s", err)
+	}
+	if confirmed.Password != settings.Password || confirmed.Timezone != settings.Timezone || confirmed.AutoDST != settings.AutoDST || confirmed.ButtonLock != settings.ButtonLock {
+		return fmt.Errorf("%s didn't keep the new settings", device.MACAddress)
+	}
+	return nil
+}
+
+// hostTimezone works out our timezone in whole hours from UTC, so devices can be set to match us. This includes daylight
+// saving if it's on right now, so daylight saving on the device gets turned off when we sync
+func hostTimezone() int {
+	_, offset := time.Now().Zone()
+	if offset < 0 && offset%3600 != 0 {
+		return offset/3600 - 1 // Round down, not towards zero
+	}
+	return offset / 3600
+}
+
+// changeDeviceSettings applies the changes in vals (from the Labs or the API) to a device. "resetpassword" puts the password
+// back to the factory default and "synctimezone" sets the timezone to ours. Anything left out (or a blank password) stays as it is
+func changeDeviceSettings(device *orvibo.Device, vals map[string]string, source string) (OrviboSettings, error) {
+	settings, err := readDeviceSettings(device)
+	if err != nil {
+		return settings, err
+	}
+
+	var changes []string
+	if password := vals["password"]; password != "" && password != settings.Password { // Blank means leave it alone
+		settings.Password = password
+		changes = append(changes, "password changed")
+	}
+	if stringToBool(vals["resetpassword"]) {
+		settings.Password = defaultDevicePassword
+		changes = append(changes, "password reset")
+	}
+
+	if timezone, ok := vals["timezone"]; ok && timezone != strconv.Itoa(settings.Timezone) {
+		if settings.Timezone, err = strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(timezone), "+")); err != nil {
+			return settings, fmt.Errorf("%s isn't a timezone. Use hours from UTC, e.g. 10 or -5", timezone)
+		}
+		changes = append(changes, "timezone set to "+timezone)
+	}
+	if autodst, ok := vals["autodst"]; ok {
+		settings.AutoDST = stringToBool(autodst)
+	}
+	if stringToBool(vals["synctimezone"]) {
+		settings.Timezone = hostTimezone()
+		settings.AutoDST = false
+		changes = append(changes, fmt.Sprintf("timezone synced to %+d", settings.Timezone))
+	}
+
+	if lock, ok := vals["buttonlock"]; ok && stringToBool(lock) != settings.ButtonLock {
+		settings.ButtonLock = stringToBool(lock)
+		changes = append(changes, "button "+map[bool]string{true: "locked", false: "unlocked"}[settings.ButtonLock])
+	}
+
+	if err = writeDeviceSettings(device, settings); err != nil {
+		return settings, err
+	}
+
+	if len(changes) == 0 {
+		changes = append(changes, "settings saved")
+	}
+	logEvent("config", device.MACAddress, source, strings.Join(changes, ", "))
+	return settings, nil
+}
+
+// deviceSettingsAPI serves GET /api/devicesettings?mac=... (an OrviboSettings, without the password) and POST /api/devicesettings
+// with mac, plus any of password, timezone, autodst, buttonlock, resetpassword=true or synctimezone=true. POSTs need our token (see http.go)
+func deviceSettingsAPI(w http.ResponseWriter, r *http.Request) {
+	device := findDevice(driver, normaliseMAC(r.FormValue("mac")))
+	if device == nil {
+		http.Error(w, fmt.Sprintf("Can't find device %s", r.FormValue("mac")), http.StatusNotFound)
+		return
+	}
+
+	var settings OrviboSettings
+	var err error
+	if r.Method == "POST" {
+		r.ParseForm()
+		vals := make(map[string]string)
+		for name := range r.PostForm {
+			vals[name] = r.PostForm.Get(name)
+		}
+		settings, err = changeDeviceSettings(device.Device, vals, "api")
+	} else {
+		settings, err = readDeviceSettings(device.Device)
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	settings.DefaultPassword = settings.Password == defaultDevicePassword
+	settings.Password = "" // Anyone who can reach us can read this, and the password is what keeps strangers off the device
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(settings)
+}
+
+// Shows a list of our devices, so we can pick one to change the settings of
+func (c *configService) devicesettings() (*suit.ConfigurationScreen, error) {
+	var devices []suit.ActionListOption
+	for _, device := range driver.devices() {
+		devices = append(devices, suit.ActionListOption{
+			Title:    device.Device.Name,
+			Subtitle: fmt.Sprintf("%s (%s)", device.Device.MACAddress, deviceTypeNames[device.Device.DeviceType]),
+			Value:    device.Device.MACAddress,
+		})
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i].Title < devices[j].Title })
+
+	screen := suit.ConfigurationScreen{
+		Title: "Device Settings",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "These settings are stored on the devices themselves, and are the same ones you'd change in the Orvibo phone app",
+					},
+					suit.ActionList{
+						Name:    "mac",
+						Options: devices,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "editdevicesettings",
+							Label:       "Settings",
+							DisplayIcon: "cog",
+						},
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// editdevicesettings reads the settings from one device and shows them
+func (c *configService) editdevicesettings(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	device := findDevice(driver, vals["mac"])
+	if device == nil {
+		return c.error(fmt.Sprintf("Can't find device %s", vals["mac"]))
+	}
+
+	settings, err := readDeviceSettings(device.Device)
+	if err != nil {
+		return c.error(fmt.Sprintf("Unable to read settings from %s: %s", device.Device.Name, err))
+	}
+
+	return c.showdevicesettings(device, settings)
+}
+
+// passwordStatus says whether a device still has the factory password, without saying what the password is otherwise
+func passwordStatus(password string) string {
+	if password == defaultDevicePassword {
+		return "Still the factory " + defaultDevicePassword + ". Leave blank to keep it"
+	}
+	return "Set. Leave blank to keep it"
+}
+
+// showdevicesettings shows the settings screen for one device
+func (c *configService) showdevicesettings(device *OrviboDevice, settings OrviboSettings) (*suit.ConfigurationScreen, error) {
+	yesNo := func(title string, name string, value bool, yes string, no string) suit.RadioGroup {
+		return suit.RadioGroup{
+			Title: title,
+			Name:  name,
+			Value: strconv.FormatBool(value),
+			Options: []suit.RadioGroupOption{
+				suit.RadioGroupOption{
+					Title:       yes,
+					Value:       "true",
+					DisplayIcon: "ok",
+				},
+				suit.RadioGroupOption{
+					Title:       no,
+					Value:       "false",
+					DisplayIcon: "remove",
+				},
+			},
+		}
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Settings for " + device.Device.Name,
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.InputHidden{
+						Name:  "mac",
+						Value: device.Device.MACAddress,
+					},
+					suit.InputText{ // Never filled in, so it's not sitting there for anyone who walks past. See passwordStatus
+						Name:        "password",
+						Before:      "New remote access password",
+						Placeholder: passwordStatus(settings.Password),
+					},
+					suit.InputText{
+						Name:        "timezone",
+						Before:      "Timezone",
+						After:       fmt.Sprintf("hours from UTC (we're on %+d)", hostTimezone()),
+						Placeholder: "10",
+						Value:       strconv.Itoa(settings.Timezone),
+					},
+					yesNo("Daylight saving", "autodst", settings.AutoDST, "Automatic", "Off"),
+					yesNo("Button on the device", "buttonlock", settings.ButtonLock, "Locked", "Unlocked"),
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Back",
+				Name:  "devicesettings",
+			},
+			suit.ReplyAction{
+				Label:        "Reset Password",
+				Name:         "resetpassword",
+				DisplayClass: "warning",
+				DisplayIcon:  "refresh",
+			},
+			suit.ReplyAction{
+				Label:       "Use Our Timezone",
+				Name:        "synctimezone",
+				DisplayIcon: "time",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "savedevicesettings",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savedevicesettings is called by the Save, Reset Password and Use Our Timezone buttons. action tells us which
+func (c *configService) savedevicesettings(request *model.ConfigurationRequest, action string) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	device := findDevice(driver, vals["mac"])
+	if device == nil {
+		return c.error(fmt.Sprintf("Can't find device %s", vals["mac"]))
+	}
+
+	switch action {
+	case "resetpassword":
+		vals["resetpassword"] = "true"
+	case "synctimezone":
+		vals["synctimezone"] = "true"
+	}
+
+	settings, err := changeDeviceSettings(device.Device, vals, "labs")
+	if err != nil {
+		return c.error(fmt.Sprintf("Unable to save settings on %s: %s", device.Device.Name, err))
+	}
+
+	return c.showdevicesettings(device, settings)
+}
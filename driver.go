@@ -1,8 +1,9 @@
 package main
 
 import (
-	"fmt"  // For outputting stuff to the screen
-	"log"  // Similar thing, I suppose?
+	"fmt" // For outputting stuff to the screen
+	"log" // Similar thing, I suppose?
+	"sync"
 	"time" // Used as part of "setInterval" and for pausing code to allow for data to come back
 
 	"github.com/Grayda/go-orvibo"         // The magic part that lets us control sockets
@@ -25,9 +26,16 @@ type OrviboDriver struct {
 	support.DriverSupport
 	config *OrviboDriverConfig // This is how we save and load IR codes and such. Call this by using driver.config
 	conn   *ninja.Connection
-	device map[int]*OrviboDevice // A list of devices we've found. This is in addition to the list go-orvibo maintains
+	device map[int]*OrviboDevice // A list of devices we've found. This is in addition to the list go-orvibo maintains. Use getDevice and devices to read it
 }
 
+// Restoring a backup swaps out the whole of driver.config, so it takes this lock while it does. So does anything that reads
+// the whole config at once (e.g. making a backup, or saveConfig). If you need energyLock too, take this one first
+var configLock sync.RWMutex
+
+// driver.device is added to on theloop, but read from the Labs, our web server and our timers too, so it gets a lock
+var deviceLock sync.RWMutex
+
 // OrviboIRCode is a struct that holds info about saved IR codes. Used with config
 type OrviboIRCode struct {
 	ID          int    // The index of our code
@@ -36,6 +44,13 @@ type OrviboIRCode struct {
 	Code        string // The IR code itself
 	AllOne      string // Which AllOne to blast through (MACAddress)
 	Group       string // Which group does this code belong to?
+	Protocol    string // What kind of remote it came from (e.g. "NEC"), if we recognised it. See ircodes.go
+	Address     uint32 // Which device the code is for, in that protocol
+	Command     uint32 // Which button it is, in that protocol
+	Repeats     int    `json:",omitempty"` // How many extra times to send it, as if the button was held down. See irToSend
+	RepeatGap   int    `json:",omitempty"` // Milliseconds between repeats. 0 means whatever the protocol normally uses
+	HoldFor     int    `json:",omitempty"` // Milliseconds to hold the button down for (e.g. a long press to turn off a projector)
+	Frequency   int    `json:",omitempty"` // Carrier frequency in Hz, if the code came from somewhere that says (Pronto, LIRC). See pronto.go
 }
 
 type OrviboRFCode struct {
@@ -61,6 +76,27 @@ type OrviboDriverConfig struct {
 	Codes                 []OrviboIRCode      // Saved IR codes
 	CodeGroups            []OrviboIRCodeGroup // Logical groupings of IR codes
 	Switches              map[string]OrviboRFCode
+	HTTPAddress           string                       // Where we serve /metrics from (e.g. "127.0.0.1:8100")
+	HTTPToken             string                       // Needed to change anything over HTTP. Blank means nothing can be. See http.go
+	Energy                map[string]*OrviboEnergy     // On-time tracking for our sockets, keyed by MAC address. See energy.go
+	CostPerKWh            float64                      // How much a kWh of power costs. Used for our energy estimates
+	HistoryFile           string                       // Where our event history is written. See history.go
+	ReconcileInterval     int                          // How often (in seconds) we check our sockets' state hasn't drifted. 0 for the default, -1 to turn it off. See reconcile.go
+	ReconcileMaxInterval  int                          // Sockets that never drift get checked less often, up to this many seconds apart
+	DiscoverInterval      int                          // How often (in seconds) we look for new devices. See schedule.go
+	ResubscribeInterval   int                          // How often (in seconds) we renew our subscriptions and check who's still alive
+	AdaptiveScheduling    bool                         // Discover hard at startup and when devices go missing, and resubscribe based on how long subscriptions last
+	StaticDevices         []OrviboStaticDevice         // Devices we can't find by broadcast (e.g. on another subnet). See static.go
+	BroadcastAddresses    []string                     // Extra broadcast addresses to discover on (e.g. "192.168.2.255")
+	Interfaces            []string                     // Network interfaces (e.g. "eth0") or addresses to talk to devices on. Empty means all of them. See interfaces.go
+	AllowedMACs           []string                     // Devices we always adopt. See adoption.go
+	DeniedMACs            []string                     // Devices we never adopt, or even subscribe to
+	RequireApproval       bool                         // If true, new devices wait in the Labs until they're approved
+	PowerStrips           map[string]*OrviboPowerStrip // Sockets that are really power strips, keyed by MAC address. See powerstrip.go
+	BackupDirectory       string                       // Where snapshots are saved before anything destructive. See backup.go
+	LibraryDirectory      string                       // Extra IR code library files, on top of the built in ones. See library.go
+	AirConditioners       []*OrviboAirConditioner      // Air conditioners we control through an AllOne. See aircon.go
+	KeplerSupport         bool                         // Turns on Kepler gas detector support, which hasn't been tried on a real one. See kepler.go
 	learningIR            bool
 	learningIRName        string
 	learningIRDescription string
@@ -83,6 +119,12 @@ func defaultConfig() *OrviboDriverConfig {
 		Initialised: false,
 		Codes:       c,
 		CodeGroups:  cg,
+		HTTPAddress: defaultHTTPAddress,
+		HistoryFile: defaultHistoryFile,
+
+		DiscoverInterval:    defaultDiscoverInterval,
+		ResubscribeInterval: defaultResubscribeInterval,
+		AdaptiveScheduling:  true,
 	}
 }
 
@@ -123,19 +165,38 @@ func (d *OrviboDriver) Start(config *OrviboDriverConfig) error {
 
 	d.config.Switches = make(map[string]OrviboRFCode)
 
+	if d.config.HTTPAddress == ":8100" { // Older configs saved our old default, which let anyone on the network in
+		d.config.HTTPAddress = defaultHTTPAddress
+	}
+
+	if d.config.Energy == nil { // Older configs won't have any energy info
+		d.config.Energy = make(map[string]*OrviboEnergy)
+	}
+
+	decodeCodes(d.config.Codes) // Codes learned before we could decode them
+	d.exportAirConditioners()   // These don't need discovering, since they're really just an AllOne
+
 	// This tells the API that we're going to expose a UI, and to run GetActions() in configuration.go
 	d.Conn.MustExportService(&configService{d}, "$driver/"+info.ID+"/configure", &model.ServiceAnnouncement{
 		Schema: "/protocol/configuration",
 	})
 
+	// Bind to whichever network interfaces we've been told to use
+	if err := openInterfaces(d.config.Interfaces); err != nil {
+		log.Printf("Unable to bind to network interfaces, so using all of them: %s", err)
+	}
+
 	// If we've not started the driver
 	if started == false {
+		// Fire up our web server so Prometheus can scrape /metrics
+		startHTTP(d.config.HTTPAddress)
+
 		// Start a loop that handles everything this driver does (finding sockets, blasting IR etc.)
 		// We put it in its own loop to keep the code neat
 		theloop(d, config)
 	}
 
-	return d.SendEvent("config", config)
+	return d.saveConfig()
 }
 
 func theloop(d *OrviboDriver, config *OrviboDriverConfig) error {
@@ -146,80 +207,32 @@ func theloop(d *OrviboDriver, config *OrviboDriverConfig) error {
 		fmt.Println("Calling theloop")
 
 		// These are our SetIntervals that run. To cancel one, simply send "<- true" to it (e.g. autoDiscover <- true)
-		var autoDiscover, resubscribe chan bool
+		var autoDiscover, resubscribe, reconciler, names, keplers chan bool
 
 		ready, err := orvibo.Prepare() // You ready? Ask orvibo to start listening on sockets and such.
 		if ready == true {             // Yep! Let's do this!
-			autoDiscover = setInterval(orvibo.Discover, time.Minute)   // Every minute, try and find new sockets
-			resubscribe = setInterval(orvibo.Subscribe, time.Minute*3) // Every 3 minutes, resubscribe.
-			orvibo.Discover()                                          // Discover all sockets
+			// Only heartbeat and reconcileSockets touch orvibo.Devices, so only they need to run on theloop. See loop.go
+			autoDiscover = setAdaptiveInterval(discover, nextDiscoverDelay)                       // Every so often, try and find new sockets. See schedule.go
+			resubscribe = setAdaptiveInterval(func() { onLoop(heartbeat) }, nextResubscribeDelay) // Resubscribe, and check who's still out there. See liveness.go
+			reconciler = setAdaptiveInterval(func() { onLoop(reconcileSockets) }, reconcileTick)  // And make sure the Sphere has the right idea about our sockets. See reconcile.go
+			names = setInterval(syncNames, time.Minute*10)                                        // Every 10 minutes, check nobody's renamed anything in the Orvibo app
+			keplers = setInterval(pollKeplers, keplerPollInterval)                                // And ask our gas detectors for their readings. See kepler.go
+			discover()                                                                            // Discover all sockets
 
 			for { // Loop forever
 				select { // This lets us do non-blocking channel reads. If we have a message, process it. If not, check for UDP data and loop
 				case msg := <-orvibo.Events: // If there is an event waiting
-					switch msg.Name {
-					case "existingsocketfound": // Found an existing socket. Don't do anything, so just keep going
-						fallthrough
-					case "socketfound": // Socket has been found go-orvibo has taken care of storing the details in DeviceInfo, so do that.
-						fmt.Println("Socket found! MAC address is", msg.DeviceInfo.MACAddress)
-						orvibo.Subscribe() // Subscribe to any unsubscribed sockets
-						orvibo.Query()     // And query any unqueried sockets
-					case "existingallonefound":
-						fallthrough
-					case "allonefound":
-						orvibo.Subscribe()
-						orvibo.Query()
-					case "subscribed": // We've asked to subscribe to a device and we've had confirmation
-						if msg.DeviceInfo.Subscribed == false { // If we've not subscribed before
-
-							fmt.Println("Subscription successful!")
-							orvibo.Devices[msg.DeviceInfo.MACAddress].Subscribed = true
-							orvibo.Query() // Ask the device for its name
-							fmt.Println("Query called")
-
-						}
-						orvibo.Query()
-					case "queried": // We've asked for a name and we've got the info back
-						fmt.Println("Query event called")
-						if msg.DeviceInfo.Queried == false {
-
-							d.device[msg.DeviceInfo.ID] = NewOrviboDevice(d, msg.DeviceInfo) // Now we add this to d.device[].Device because we can now control it
-							d.device[msg.DeviceInfo.ID].Device.Name = msg.DeviceInfo.Name
-
-							if msg.DeviceInfo.DeviceType == orvibo.SOCKET { // If it's a socket,
-								_ = d.Conn.ExportDevice(driver.device[msg.DeviceInfo.ID])                                                           // Let the Sphere know about it
-								_ = d.Conn.ExportChannel(driver.device[msg.DeviceInfo.ID], driver.device[msg.DeviceInfo.ID].onOffChannel, "on-off") // Let the Sphere know we've got an on-off channel ready
-								d.device[msg.DeviceInfo.ID].Device.State = msg.DeviceInfo.State                                                     // Set the state for internal reference
-								d.device[msg.DeviceInfo.ID].onOffChannel.SendState(msg.DeviceInfo.State)                                            // And tell the Sphere what the initial state is. Easy!
-								// Now when you go into the Sphere app, there will be a thing ready to add ("Promoted" is true, I think, which makes it show up in the Add Things menu)
-							}
-							orvibo.Devices[msg.DeviceInfo.MACAddress].Queried = true // We've queried it before
-
-						} else {
-							fmt.Println("Already queried")
-						}
-
-					case "ircode": // We're in learning mode and an IR code has come back
-						if driver.config.learningIR == true {
-							ir := OrviboIRCode{
-								Name:        driver.config.learningIRName,
-								Code:        msg.DeviceInfo.LastIRMessage,
-								Description: driver.config.learningIRDescription,
-								AllOne:      driver.config.learningIRDevice,
-								Group:       driver.config.learningIRGroup,
-							}
-							driver.saveIR(driver.config, ir)
-						}
-					case "statechanged": // Something has changed our status (e.g. we've pressed the button on a socket)
-						fmt.Println("State changed to:", msg.DeviceInfo.State)
-						if msg.DeviceInfo.Queried == true { // If we've queried
-							d.device[msg.DeviceInfo.ID].Device.State = msg.DeviceInfo.State          // Save the state
-							d.device[msg.DeviceInfo.ID].onOffChannel.SendState(msg.DeviceInfo.State) // And let the Sphere know about it
-						}
-					case "quit": // We're done. Of course the driver has no quit function (yet?)
+					if msg.Name == "quit" { // We're done. Of course the driver has no quit function (yet?)
 						autoDiscover <- true
 						resubscribe <- true
+						reconciler <- true
+						names <- true
+						keplers <- true
+						break
 					}
+					handleEvent(d, msg.Name, msg.DeviceInfo)
+				case task := <-loopTasks: // Something that needs to touch orvibo.Devices. See loop.go
+					task()
 				default: // If there are no messages to parse, check for new UDP messages
 					orvibo.CheckForMessages()
 				}
@@ -234,6 +247,126 @@ func theloop(d *OrviboDriver, config *OrviboDriverConfig) error {
 	return nil
 }
 
+// handleEvent deals with an event from go-orvibo (or from one of our own sockets, see packets.go). It runs on theloop
+func handleEvent(d *OrviboDriver, name string, info *orvibo.Device) {
+	handled := time.Now() // For our receive loop latency metric
+	packetsReceived.Inc(name)
+	if info != nil && isDenied(info.MACAddress) { // No events, metrics or subscribing for denied devices. See adoption.go
+		receiveLoopLatency.Observe(time.Since(handled))
+		return
+	}
+	if info != nil { // Any message from a device means it's still alive
+		markSeen(d, info)
+	}
+	switch name {
+	case "existingsocketfound": // Found an existing socket. Don't do anything, so just keep going
+		fallthrough
+	case "socketfound": // Socket has been found go-orvibo has taken care of storing the details in DeviceInfo, so do that.
+		fmt.Println("Socket found! MAC address is", info.MACAddress)
+		if name == "socketfound" {
+			devicesDiscovered.Inc(deviceTypeNames[orvibo.SOCKET])
+			logEvent("found", info.MACAddress, "driver", "socket")
+		}
+		subscribe() // Subscribe to any unsubscribed sockets
+		query()     // And query any unqueried sockets
+	case "existingallonefound":
+		fallthrough
+	case "allonefound":
+		if name == "allonefound" {
+			devicesDiscovered.Inc(deviceTypeNames[orvibo.ALLONE])
+			logEvent("found", info.MACAddress, "driver", "allone")
+		}
+		subscribe()
+		query()
+	case "existingkeplerfound":
+		fallthrough
+	case "keplerfound":
+		if !keplerSupport() { // See kepler.go
+			fmt.Println("Found a Kepler at", info.MACAddress, "but Kepler support is off. Set KeplerSupport in the config to try it")
+			break
+		}
+		if name == "keplerfound" {
+			devicesDiscovered.Inc(deviceTypeNames[orvibo.KEPLER])
+			logEvent("found", info.MACAddress, "driver", "kepler")
+		}
+		subscribe()
+		query()
+	case "subscribed": // We've asked to subscribe to a device and we've had confirmation
+		if info.Subscribed == false { // If we've not subscribed before
+
+			fmt.Println("Subscription successful!")
+			orvibo.Devices[info.MACAddress].Subscribed = true
+			query() // Ask the device for its name
+			fmt.Println("Query called")
+
+		}
+		reconcile(d, info.MACAddress, info.State) // Subscribing tells us the socket's state. If we asked for it, check it against ours
+		noteSubscribed(info.MACAddress)           // And remember when, so we know how long subscriptions last
+		query()
+	case "queried": // We've asked for a name and we've got the info back
+		fmt.Println("Query event called")
+		if info.Queried == false {
+			if orvibo.Devices[info.MACAddress] != nil {
+				orvibo.Devices[info.MACAddress].Queried = true // We've queried it before, whatever we decide to do with it
+			}
+
+			if !attributeDevice(info) { // On an interface we're not using? Leave it alone
+				fmt.Println("Ignoring", info.MACAddress, "as it's not on one of our interfaces")
+				break
+			}
+			if info.DeviceType == orvibo.KEPLER && !keplerSupport() { // See kepler.go
+				fmt.Println("Ignoring Kepler", info.MACAddress, "as Kepler support is off")
+				break
+			}
+
+			switch adoption(info.MACAddress) { // Are we allowed to adopt this one? See adoption.go
+			case adoptAllowed:
+				d.adopt(info)
+			case adoptPending: // Someone needs to approve it in the Labs first
+				addPending(info)
+			case adoptDenied:
+				ignoreDenied()
+			}
+
+		} else {
+			fmt.Println("Already queried")
+		}
+
+	case "ircode": // We're in learning mode and an IR code has come back
+		if driver.config.learningIR == true {
+			ir := OrviboIRCode{
+				Name:        driver.config.learningIRName,
+				Code:        info.LastIRMessage,
+				Description: driver.config.learningIRDescription,
+				AllOne:      driver.config.learningIRDevice,
+				Group:       driver.config.learningIRGroup,
+			}
+			driver.saveIR(driver.config, ir)
+			learningSessions.Inc("learned")
+			logEvent("learn", ir.AllOne, "labs", ir.Name+" ("+describeIR(driver.config.Codes[len(driver.config.Codes)-1])+")")
+		}
+	case "statechanged": // Something has changed our status (e.g. we've pressed the button on a socket)
+		fmt.Println("State changed to:", info.State)
+		if info.DeviceType == orvibo.KEPLER { // For a Kepler, "state" means the gas alarm
+			if device, ok := d.getDevice(info.ID); ok {
+				device.keplerAlarm(info.State, "external")
+			}
+			break
+		}
+		stateChanges.Inc(info.MACAddress)
+		notifyState(info.MACAddress, info.State) // If SetOnOff is waiting for this, let it know
+		logEvent("state", info.MACAddress, stateSource(info.MACAddress, info.State), onOff(info.State))
+		if device, ok := d.getDevice(info.ID); ok && len(device.outlets()) > 0 { // A power strip. Find out which outlets changed
+			go device.refreshOutlets()
+		} else if ok && info.Queried == true { // If we've queried (and adopted it)
+			device.Device.State = info.State // Save the state
+			device.sendState(info.State)     // And let the Sphere know about it
+			device.updateEnergy(info.State)  // And note the time, for our energy estimates
+		}
+	}
+	receiveLoopLatency.Observe(time.Since(handled))
+}
+
 // saveIR does what it says on the tin. Takes a hex IR code and stores it in our config
 func (d *OrviboDriver) saveIR(config *OrviboDriverConfig, ir OrviboIRCode) error {
 
@@ -242,20 +375,21 @@ func (d *OrviboDriver) saveIR(config *OrviboDriverConfig, ir OrviboIRCode) error
 	d.config.learningIRDevice = ""
 	d.config.learningIRDescription = ""
 
+	decodeIR(&ir)
 	d.config.Codes = append(d.config.Codes, ir)
 
-	return d.SendEvent("config", d.config)
+	return d.saveConfig()
 
 }
 
 func (d *OrviboDriver) saveRF(config *OrviboDriverConfig, rf OrviboRFCode) error {
 	d.config.Switches[rf.ID] = rf
-	return d.SendEvent("config", d.config)
+	return d.saveConfig()
 }
 
 // Created a new group? Save it. See how stupidly simple saving stuff to the config is? MUCH better than the Ninja Block days!
 func (d *OrviboDriver) saveGroups(config *OrviboDriverConfig) error {
-	return d.SendEvent("config", d.config)
+	return d.saveConfig()
 }
 
 // Again, does what it says on the tin.
@@ -277,7 +411,7 @@ func (d *OrviboDriver) deleteIR(config *OrviboDriverConfig, code string) error {
 
 	d.config.Codes = codelist
 	fmt.Println("Saving options")
-	return d.SendEvent("config", d.config)
+	return d.saveConfig()
 }
 
 // Stop does nothing. Though if it did, we could pass "quit" to theloop and clean up timers and such. The only way drivers are stopped now, are by force (reboot, Ctrl+C now)
@@ -286,6 +420,14 @@ func (d *OrviboDriver) Stop() error {
 
 }
 
+// onOff turns a state into something a human can read. Used in our history
+func onOff(state bool) string {
+	if state {
+		return "on"
+	}
+	return "off"
+}
+
 func stringToBool(i string) bool {
 	if i == "true" {
 		return true
@@ -310,3 +452,35 @@ func setInterval(what func(), delay time.Duration) chan bool {
 
 	return stop
 }
+
+// getDevice looks up one of our devices by go-orvibo's ID
+func (d *OrviboDriver) getDevice(id int) (*OrviboDevice, bool) {
+	deviceLock.RLock()
+	defer deviceLock.RUnlock()
+
+	device, ok := d.device[id]
+	return device, ok
+}
+
+// devices returns a copy of our list of devices, so it can be looped over without holding the lock
+func (d *OrviboDriver) devices() []*OrviboDevice {
+	deviceLock.RLock()
+	defer deviceLock.RUnlock()
+
+	var devices []*OrviboDevice
+	for _, device := range d.device {
+		devices = append(devices, device)
+	}
+	return devices
+}
+
+// saveConfig sends our config to the Sphere, which saves it for next time. Sending it means reading all of it, including
+// the energy totals that theloop and SetOnOff keep changing, so it holds both configLock and energyLock while it does
+func (d *OrviboDriver) saveConfig() error {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	energyLock.Lock()
+	defer energyLock.Unlock()
+
+	return d.SendEvent("config", d.config)
+}
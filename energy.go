@@ -0,0 +1,277 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// The S20 doesn't do power metering, but if we know roughly how many watts the thing plugged into it uses, and how long
+// it's been on for, we can make a decent guess at how much power it's using. That's what this file does.
+
+// OrviboEnergy holds the on-time tracking for a single socket. Saved in our config, keyed by MAC address
+type OrviboEnergy struct {
+	Watts     float64            // Nominal wattage of whatever's plugged into the socket. Set through the Labs
+	OnSeconds float64            // Total time this socket has been on, ever
+	Days      map[string]float64 // Seconds on per day ("2006-01-02"). Only the last energyDays days are kept
+	On        bool               // The last state we recorded
+	Since     time.Time          // When we last recorded a state change (or tallied up the on-time)
+	reported  bool               // Has the socket told us its state since the driver started? Not saved, so it starts off false
+}
+
+// How many days of history we keep per socket. A fortnight gives us this week and last week
+const energyDays = 14
+
+// The layout of our Days keys
+const dayLayout = "2006-01-02"
+
+// The energy map is written from theloop and SetOnOff and read from the UI and the HTTP server, so it gets a lock. Don't
+// call saveConfig while holding it, as saveConfig takes it too
+var energyLock sync.Mutex
+
+func init() {
+	mux.HandleFunc("/api/energy", energyAPI)
+}
+
+// recordState notes that a socket has been turned on or off. Any on-time since the last change is added to the socket's total.
+// This gets called from both SetOnOff and "statechanged", so it doesn't do anything if the state hasn't actually changed
+func recordState(mac string, on bool, when time.Time) {
+	if changeState(mac, on, when) {
+		driver.saveConfig() // Persist our totals
+	}
+}
+
+// changeState is the part of recordState that needs energyLock. It tells us whether anything changed.
+// If a socket was on when the driver stopped, we've no idea how long it stayed on for, so the first time it tells us its
+// state after we start, we start counting again from then. The time the driver was down (and any on-time between the last
+// change and the driver stopping) isn't counted, which is better than counting all of it
+func changeState(mac string, on bool, when time.Time) bool {
+	energyLock.Lock()
+	defer energyLock.Unlock()
+
+	e, ok := driver.config.Energy[mac]
+	switch {
+	case !ok:
+		e = &OrviboEnergy{Days: make(map[string]float64)}
+		driver.config.Energy[mac] = e
+	case !e.reported: // The first we've heard since we started, so there's nothing we can tally
+	case e.On == on:
+		return false
+	case e.On:
+		tally(e, e.Since, when)
+	}
+
+	e.On = on
+	e.Since = when
+	e.reported = true
+	return true
+}
+
+// running tells us whether a socket has been on since e.Since. Until it's told us its state, we don't know (see changeState)
+func (e *OrviboEnergy) running() bool {
+	return e.On && e.reported
+}
+
+// tally adds the time between from and to onto a socket's totals, splitting it across days where needed
+func tally(e *OrviboEnergy, from time.Time, to time.Time) {
+	if e.Days == nil {
+		e.Days = make(map[string]float64)
+	}
+
+	for from.Before(to) {
+		// Where does the current day end?
+		y, m, d := from.Date()
+		midnight := time.Date(y, m, d+1, 0, 0, 0, 0, from.Location())
+		end := to
+		if midnight.Before(to) {
+			end = midnight
+		}
+
+		seconds := end.Sub(from).Seconds()
+		e.Days[from.Format(dayLayout)] += seconds
+		e.OnSeconds += seconds
+		from = end
+	}
+
+	// Throw away anything older than energyDays so the config doesn't grow forever
+	oldest := to.AddDate(0, 0, -energyDays).Format(dayLayout)
+	for day := range e.Days {
+		if day < oldest {
+			delete(e.Days, day)
+		}
+	}
+}
+
+// onSeconds works out how long a socket has been on in the last "days" days (1 = today), including any time it's been on since the last change
+func onSeconds(e *OrviboEnergy, days int, now time.Time) float64 {
+	var total float64
+	for i := 0; i < days; i++ {
+		total += e.Days[now.AddDate(0, 0, -i).Format(dayLayout)]
+	}
+
+	if e.running() {
+		// Tally a copy, so we can count the open stretch without touching the saved totals
+		current := &OrviboEnergy{Days: make(map[string]float64)}
+		tally(current, e.Since, now)
+		for i := 0; i < days; i++ {
+			total += current.Days[now.AddDate(0, 0, -i).Format(dayLayout)]
+		}
+	}
+
+	return total
+}
+
+// kWh turns seconds on and a wattage into kilowatt hours
+func kWh(seconds float64, watts float64) float64 {
+	return watts * seconds / 3600 / 1000
+}
+
+// currentWatts is what we report on a socket's power channel: its nominal wattage if it's on, otherwise nothing
+func currentWatts(mac string) float64 {
+	energyLock.Lock()
+	defer energyLock.Unlock()
+
+	if e, ok := driver.config.Energy[mac]; ok && e.running() {
+		return e.Watts
+	}
+	return 0
+}
+
+// EnergyReport is what we send back through the UI and the REST API for each socket
+type EnergyReport struct {
+	MACAddress string
+	Name       string
+	Watts      float64
+	On         bool
+	OnSeconds  float64 // All time
+	TodayKWh   float64
+	TodayCost  float64
+	WeekKWh    float64 // The last seven days, including today
+	WeekCost   float64
+}
+
+// energyReports builds an EnergyReport for every socket we know about, sorted by name
+func energyReports() []EnergyReport {
+	energyLock.Lock()
+	defer energyLock.Unlock()
+
+	now := time.Now()
+	var reports []EnergyReport
+	for _, device := range driver.devices() {
+		if device.Device.DeviceType != orvibo.SOCKET {
+			continue
+		}
+
+		report := EnergyReport{
+			MACAddress: device.Device.MACAddress,
+			Name:       device.Device.Name,
+		}
+
+		if e, ok := driver.config.Energy[device.Device.MACAddress]; ok {
+			report.Watts = e.Watts
+			report.On = e.running()
+			report.OnSeconds = e.OnSeconds
+			if e.running() {
+				report.OnSeconds += now.Sub(e.Since).Seconds()
+			}
+			report.TodayKWh = kWh(onSeconds(e, 1, now), e.Watts)
+			report.WeekKWh = kWh(onSeconds(e, 7, now), e.Watts)
+			report.TodayCost = report.TodayKWh * driver.config.CostPerKWh
+			report.WeekCost = report.WeekKWh * driver.config.CostPerKWh
+		}
+
+		reports = append(reports, report)
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Name < reports[j].Name })
+	return reports
+}
+
+// setWatts sets the nominal wattage for a socket
+func setWatts(mac string, watts float64) {
+	energyLock.Lock()
+	defer energyLock.Unlock()
+
+	e, ok := driver.config.Energy[mac]
+	if !ok {
+		e = &OrviboEnergy{Days: make(map[string]float64), Since: time.Now()}
+		driver.config.Energy[mac] = e
+	}
+	e.Watts = watts
+}
+
+// energyAPI serves GET /api/energy (a list of EnergyReports) and POST /api/energy?mac=...&watts=... to set a socket's wattage
+func energyAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		watts, err := strconv.ParseFloat(r.FormValue("watts"), 64)
+		if err != nil || watts < 0 {
+			http.Error(w, fmt.Sprintf("Invalid wattage: %s", r.FormValue("watts")), http.StatusBadRequest)
+			return
+		}
+		setWatts(r.FormValue("mac"), watts)
+		driver.saveConfig()
+		logEvent("config", r.FormValue("mac"), "api", fmt.Sprintf("set wattage to %v", watts))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(energyReports())
+}
+
+// Shows how much power each socket has used, and lets us set how many watts each one draws
+func (c *configService) energy() (*suit.ConfigurationScreen, error) {
+	var contents []suit.Typed
+
+	contents = append(contents, suit.StaticText{
+		Title: "About this screen",
+		Value: "The S20 can't measure power, so enter roughly how many watts the thing plugged into each socket uses, and we'll estimate the rest from how long it's been on",
+	})
+
+	for _, report := range energyReports() {
+		contents = append(contents, suit.InputText{
+			Name:        "watts_" + report.MACAddress,
+			Before:      report.Name,
+			After:       "watts",
+			Placeholder: "60",
+			Value:       strconv.FormatFloat(report.Watts, 'f', -1, 64),
+		}, suit.StaticText{
+			Title: "Usage",
+			Value: fmt.Sprintf("Today: %.2f kWh ($%.2f). Last 7 days: %.2f kWh ($%.2f)", report.TodayKWh, report.TodayCost, report.WeekKWh, report.WeekCost),
+		})
+	}
+
+	contents = append(contents, suit.InputText{
+		Name:        "cost",
+		Before:      "Cost per kWh",
+		Placeholder: "0.25",
+		Value:       strconv.FormatFloat(driver.config.CostPerKWh, 'f', -1, 64),
+	})
+
+	screen := suit.ConfigurationScreen{
+		Title: "Socket Energy Usage",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveenergy",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
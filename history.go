@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// This file keeps a history of everything that happens (state changes, blasts, config changes etc.) so we can work out
+// why a socket turned on at 3am. Events are written to disk one JSON object per line. When the file gets too big,
+// it's renamed to history.log.1 and we start again, so we never use more than about twice historyMaxBytes on disk.
+// We never read the whole file into memory either, because the Sphere only gives us 10MB to play with
+
+// HistoryEvent is a single line in our history file
+type HistoryEvent struct {
+	Time       time.Time
+	Kind       string // What happened: "state", "blastir", "blastrf", "learn", "config", "found", "online", "offline", "drift", "pending", "alarm"
+	MACAddress string `json:",omitempty"` // Which device it happened to, if any
+	Source     string // Who did it: "sphere", "labs", "api", "external" (the button on the socket, or another phone app) or "driver"
+	Detail     string `json:",omitempty"`
+}
+
+// Where we keep our history if the config doesn't say otherwise. Like a relative HistoryFile, it's next to the driver's
+// binary, not wherever the driver was started from
+const defaultHistoryFile = "history.log"
+
+// When the history file gets this big, we rotate it
+const historyMaxBytes = 256 * 1024
+
+// If a socket changes state within this long of us asking it to, we'll assume it was us
+const attributionWindow = 10 * time.Second
+
+// pendingState remembers who asked a socket to change state, so we know who to blame when "statechanged" comes back
+type pendingState struct {
+	state  bool
+	source string
+	when   time.Time
+}
+
+var pendingStates = make(map[string]pendingState)
+
+// Everything in here can be called from theloop, the UI and the HTTP server, so we use a lock
+var historyLock sync.Mutex
+
+func init() {
+	mux.HandleFunc("/api/history", historyAPI)
+}
+
+// historyFile works out where our history is being saved
+func historyFile() string {
+	filename := defaultHistoryFile
+	if driver != nil && driver.config != nil && driver.config.HistoryFile != "" {
+		filename = driver.config.HistoryFile
+	}
+	return besideBinary(filename)
+}
+
+// logEvent writes something to our history. Errors are printed and ignored, because failing to log shouldn't stop a socket from turning on
+func logEvent(kind string, mac string, source string, detail string) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	filename := historyFile()
+
+	// Too big? Move it out of the way. Anything in the old .1 file is lost
+	if info, err := os.Stat(filename); err == nil && info.Size() > historyMaxBytes {
+		os.Rename(filename, filename+".1")
+	}
+
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		fmt.Println("Unable to write to history:", err)
+		return
+	}
+	defer file.Close()
+
+	line, _ := json.Marshal(HistoryEvent{
+		Time:       time.Now(),
+		Kind:       kind,
+		MACAddress: mac,
+		Source:     source,
+		Detail:     detail,
+	})
+
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		fmt.Println("Unable to write to history:", err)
+	}
+}
+
+// expectState is called just before we ask a socket to change state, so that when "statechanged" arrives we know who asked for it
+func expectState(mac string, state bool, source string) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	pendingStates[mac] = pendingState{state: state, source: source, when: time.Now()}
+}
+
+// stateSource works out who changed a socket's state. If we didn't ask for it recently, it was the button or another app
+func stateSource(mac string, state bool) string {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	pending, ok := pendingStates[mac]
+	delete(pendingStates, mac)
+	if ok && pending.state == state && time.Since(pending.when) < attributionWindow {
+		return pending.source
+	}
+	return "external"
+}
+
+// readHistory returns the newest "limit" events, newest first. If mac or kind aren't blank, only matching events are returned.
+// We read the old file and then the current one, keeping only the last "limit" matches as we go, so memory use stays small
+func readHistory(filename string, limit int, mac string, kind string) ([]HistoryEvent, error) {
+	historyLock.Lock()
+	defer historyLock.Unlock()
+
+	ring := make([]HistoryEvent, 0, limit)
+	next := 0 // Where the next event goes once the ring is full
+
+	for _, name := range []string{filename + ".1", filename} {
+		file, err := os.Open(name)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event HistoryEvent
+			if json.Unmarshal(scanner.Bytes(), &event) != nil {
+				continue // Half written line, probably. Skip it
+			}
+			if (mac != "" && event.MACAddress != mac) || (kind != "" && event.Kind != kind) {
+				continue
+			}
+
+			if len(ring) < limit {
+				ring = append(ring, event)
+			} else if limit > 0 {
+				ring[next] = event
+				next = (next + 1) % limit
+			}
+		}
+		file.Close()
+	}
+
+	// Unwind the ring, newest first
+	events := make([]HistoryEvent, 0, len(ring))
+	for i := len(ring) - 1; i >= 0; i-- {
+		events = append(events, ring[(next+i)%len(ring)])
+	}
+
+	return events, nil
+}
+
+// historyAPI serves GET /api/history?limit=50&mac=...&kind=...
+func historyAPI(w http.ResponseWriter, r *http.Request) {
+	limit, err := strconv.Atoi(r.FormValue("limit"))
+	if err != nil || limit <= 0 {
+		limit = 50
+	}
+
+	events, err := readHistory(historyFile(), limit, r.FormValue("mac"), r.FormValue("kind"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(events)
+}
+
+// formatEvent makes a HistoryEvent readable by humans. Used by the UI and the CLI
+func formatEvent(event HistoryEvent) string {
+	line := fmt.Sprintf("%s %-8s %-8s", event.Time.Format("2006-01-02 15:04:05"), event.Kind, event.Source)
+	if event.MACAddress != "" {
+		line += " " + event.MACAddress
+	}
+	if event.Detail != "" {
+		line += " " + event.Detail
+	}
+	return line
+}
+
+// Shows the most recent events in the Labs
+func (c *configService) history() (*suit.ConfigurationScreen, error) {
+	events, err := readHistory(historyFile(), 50, "", "")
+	if err != nil {
+		return c.error(fmt.Sprintf("Unable to read history: %s", err))
+	}
+
+	var contents []suit.Typed
+	for _, event := range events {
+		contents = append(contents, suit.StaticText{
+			Title: event.Time.Format("2006-01-02 15:04:05"),
+			Value: formatEvent(event),
+		})
+	}
+
+	if len(contents) == 0 {
+		contents = append(contents, suit.StaticText{
+			Title: "Nothing yet",
+			Value: "Nothing has happened yet. Turn a socket on or blast a code and check back",
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Event History",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Refresh",
+				Name:         "history",
+				DisplayClass: "default",
+				DisplayIcon:  "refresh",
+			},
+		},
+	}
+
+	return &screen, nil
+}
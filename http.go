@@ -0,0 +1,68 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// The Sphere's REST API only knows about things and channels, so anything else we want to expose over HTTP (like our metrics)
+// gets served from our own little web server. The address is set in OrviboDriverConfig.HTTPAddress.
+// By default we only listen on 127.0.0.1, so nothing else on the network can reach us. Anything that changes something
+// (a POST) also needs the token from OrviboDriverConfig.HTTPToken, sent as "Authorization: Bearer <token>". If there's no
+// token set, nothing can be changed over HTTP at all
+
+// The address we listen on if the config doesn't say otherwise
+const defaultHTTPAddress = "127.0.0.1:8100"
+
+// The biggest request body we'll read. The driver only gets 10MB of memory (see package.json), and the biggest things anyone
+// sends us (backups and LIRC files) are nowhere near this
+const maxRequestSize = 2 << 20
+
+// Where the command line finds the driver's web server if it isn't told otherwise
+const defaultDriverURL = "http://" + defaultHTTPAddress
+
+// Our handlers. Other files add to this in their init() functions
+var mux = http.NewServeMux()
+
+func init() {
+	mux.HandleFunc("/metrics", writeMetrics)
+}
+
+// startHTTP fires up our web server in the background. If it dies (e.g. the port is taken) we just log it and carry on. Sockets are more important than graphs
+func startHTTP(address string) {
+	if address == "" {
+		address = defaultHTTPAddress
+	}
+
+	go func() {
+		fmt.Println("Starting HTTP server on", address)
+		err := http.ListenAndServe(address, requireToken(mux))
+		fmt.Println("HTTP server stopped:", err)
+	}()
+}
+
+// requireToken turns away anything other than a GET unless it has our token, and stops anyone sending us more than maxRequestSize
+func requireToken(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" && r.Method != "HEAD" && !authorised(r) {
+			unauthorised(w)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxRequestSize)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// unauthorised tells someone they need our token
+func unauthorised(w http.ResponseWriter) {
+	http.Error(w, "This needs the driver's HTTPToken, sent as \"Authorization: Bearer <token>\"", http.StatusUnauthorized)
+}
+
+// authorised checks a request has our token. If we haven't got a token, nobody's authorised
+func authorised(r *http.Request) bool {
+	token := driver.config.HTTPToken
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// If the Sphere (or whatever we're running on) has more than one network interface, e.g. Ethernet and WiFi, we might want
+// to choose which one(s) we talk to Orvibo devices on. Interfaces can be set by name ("eth0") or by address ("192.168.1.10").
+// For each one, we open a UDP socket bound to that interface's address, and discover on that interface's broadcast address.
+// Devices answer that socket, so we listen on it and hand the answers to theloop (see listen in packets.go). go-orvibo's own
+// socket already listens on every interface, and anything it sends straight to a device is routed out of the interface that
+// device is on. Every device we find is attributed to the interface whose subnet it's on, and packets we send to it go out that way.
+// Devices that turn up on an interface we haven't chosen are ignored. Leave Interfaces empty to use everything, like before.
+//
+// To try this out without a second network card, add a loopback alias (sudo ip addr add 127.0.0.2/8 dev lo) and set Interfaces to "127.0.0.2"
+
+// boundInterface is an interface we've opened a socket on
+type boundInterface struct {
+	Name    string     // e.g. "eth0"
+	Address net.IP     // The address we're bound to
+	Network *net.IPNet // The subnet it's on. Used to work out which devices belong to this interface
+	conn    *net.UDPConn
+}
+
+var boundInterfaces []*boundInterface
+var deviceInterfaces = make(map[string]string) // MAC address => the name of the interface it was seen on
+var interfacesLock sync.Mutex
+
+// openInterfaces opens a socket on each of the interfaces given, then swaps them in for the ones we've already got open. It's
+// all or nothing: if any of them can't be opened, the ones that could are closed again and we carry on with what we had.
+// Being bound to only some of them would be worse than none, as devices on the rest would be ignored (see attributeDevice)
+func openInterfaces(specs []string) error {
+	var opened []*boundInterface
+	fail := func(err error) error {
+		for _, bound := range opened {
+			bound.conn.Close()
+		}
+		return err
+	}
+
+	for _, spec := range specs {
+		bound, err := findInterface(strings.TrimSpace(spec))
+		if err != nil {
+			return fail(err)
+		}
+
+		bound.conn, err = net.ListenUDP("udp4", &net.UDPAddr{IP: bound.Address})
+		if err != nil {
+			return fail(fmt.Errorf("Unable to bind to %s (%s): %s", bound.Name, bound.Address, err))
+		}
+		opened = append(opened, bound)
+	}
+
+	interfacesLock.Lock()
+	old := boundInterfaces
+	boundInterfaces = opened
+	interfacesLock.Unlock()
+
+	for _, bound := range old {
+		bound.conn.Close()
+	}
+	for _, bound := range opened {
+		fmt.Println("Bound to interface", bound.Name, "with address", bound.Address)
+		go listen(bound.conn)
+	}
+	return nil
+}
+
+// findInterface turns an interface name or address into a boundInterface (without the socket)
+func findInterface(spec string) (*boundInterface, error) {
+	ip := net.ParseIP(spec)
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, iface := range interfaces {
+		if ip == nil && iface.Name != spec {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+
+		for _, addr := range addrs {
+			network, ok := addr.(*net.IPNet)
+			if !ok || network.IP.To4() == nil { // Orvibo devices are IPv4 only
+				continue
+			}
+			if ip == nil || network.IP.Equal(ip) {
+				return &boundInterface{Name: iface.Name, Address: network.IP, Network: network}, nil
+			}
+		}
+	}
+
+	return nil, fmt.Errorf("No IPv4 interface found matching %s", spec)
+}
+
+// broadcastAddress works out the broadcast address of a subnet (e.g. 192.168.1.255 for 192.168.1.0/24)
+func broadcastAddress(network *net.IPNet) net.IP {
+	ip := network.IP.To4()
+	mask := network.Mask
+	if len(mask) == net.IPv6len {
+		mask = mask[12:]
+	}
+
+	broadcast := make(net.IP, net.IPv4len)
+	for i := range ip {
+		broadcast[i] = ip[i] | ^mask[i]
+	}
+	return broadcast
+}
+
+// interfaceFor picks which of our bound interfaces to use when talking to ip. If it's not on any of our subnets
+// (e.g. it's behind a router) we use the first one. Returns nil if we haven't bound to anything
+func interfaceFor(ip net.IP) *boundInterface {
+	interfacesLock.Lock()
+	defer interfacesLock.Unlock()
+
+	for _, bound := range boundInterfaces {
+		if bound.Network.Contains(ip) {
+			return bound
+		}
+	}
+	if len(boundInterfaces) > 0 {
+		return boundInterfaces[0]
+	}
+	return nil
+}
+
+// discoverInterfaces broadcasts a discovery packet on each of our bound interfaces
+func discoverInterfaces() {
+	interfacesLock.Lock()
+	var addresses []string
+	for _, bound := range boundInterfaces {
+		addresses = append(addresses, broadcastAddress(bound.Network).String())
+	}
+	interfacesLock.Unlock()
+
+	for _, address := range addresses {
+		if err := discoverAt(address, ""); err != nil {
+			fmt.Println("Unable to discover on", address, ":", err)
+		}
+	}
+}
+
+// attributeDevice works out which interface a device was seen on. Returns false if it's on a local subnet we haven't chosen,
+// in which case we leave it alone
+func attributeDevice(info *orvibo.Device) bool {
+	if info.IP == nil {
+		return true
+	}
+
+	interfacesLock.Lock()
+	bound := len(boundInterfaces) > 0
+	interfacesLock.Unlock()
+
+	if !bound { // We're using everything
+		return true
+	}
+
+	if chosen := interfaceFor(info.IP.IP); chosen != nil && chosen.Network.Contains(info.IP.IP) {
+		interfacesLock.Lock()
+		deviceInterfaces[info.MACAddress] = chosen.Name
+		interfacesLock.Unlock()
+		return true
+	}
+
+	// Not on one of our subnets. If it's on the subnet of another local interface, it's not ours to talk to
+	for _, network := range localNetworks() {
+		if network.Contains(info.IP.IP) {
+			return false
+		}
+	}
+
+	// Somewhere over a router, then. It'll be going out our first interface
+	interfacesLock.Lock()
+	if len(boundInterfaces) > 0 {
+		deviceInterfaces[info.MACAddress] = boundInterfaces[0].Name
+	}
+	interfacesLock.Unlock()
+	return true
+}
+
+// localNetworks lists the subnets of every interface we've got, whether we're bound to it or not. It's a variable so the
+// tests can pretend to have some
+var localNetworks = func() []*net.IPNet {
+	var networks []*net.IPNet
+	interfaces, _ := net.Interfaces()
+	for _, iface := range interfaces {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			if network, ok := addr.(*net.IPNet); ok {
+				networks = append(networks, network)
+			}
+		}
+	}
+	return networks
+}
+
+// deviceInterface returns the name of the interface a device was seen on, or "" if we're not bound to any
+func deviceInterface(mac string) string {
+	interfacesLock.Lock()
+	defer interfacesLock.Unlock()
+
+	return deviceInterfaces[mac]
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+func mustNetwork(t *testing.T, cidr string) *net.IPNet {
+	ip, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	network.IP = ip // Like an interface's address, rather than the start of the subnet
+	return network
+}
+
+func TestBroadcastAddress(t *testing.T) {
+	for _, test := range []struct {
+		network string
+		want    string
+	}{
+		{"192.168.1.10/24", "192.168.1.255"},
+		{"10.1.2.3/16", "10.1.255.255"},
+		{"172.16.5.9/30", "172.16.5.11"},
+		{"192.168.1.10/32", "192.168.1.10"},
+	} {
+		if got := broadcastAddress(mustNetwork(t, test.network)); !got.Equal(net.ParseIP(test.want)) {
+			t.Errorf("%s: got %s, want %s", test.network, got, test.want)
+		}
+	}
+
+	// Some systems give IPv4 addresses with a 16 byte mask
+	long := &net.IPNet{IP: net.ParseIP("192.168.1.10"), Mask: net.CIDRMask(96+24, 128)}
+	if got := broadcastAddress(long); !got.Equal(net.ParseIP("192.168.1.255")) {
+		t.Errorf("16 byte mask: got %s, want 192.168.1.255", got)
+	}
+}
+
+// Pretend we've got eth0 (which we're using) and wlan0 (which we're not)
+func fakeInterfaces(t *testing.T) func() {
+	eth0, wlan0 := mustNetwork(t, "192.168.1.10/24"), mustNetwork(t, "10.0.0.2/24")
+	oldBound, oldNetworks := boundInterfaces, localNetworks
+	boundInterfaces = []*boundInterface{{Name: "eth0", Address: eth0.IP, Network: eth0}}
+	localNetworks = func() []*net.IPNet { return []*net.IPNet{eth0, wlan0} }
+	deviceInterfaces = make(map[string]string)
+
+	return func() {
+		boundInterfaces, localNetworks = oldBound, oldNetworks
+		deviceInterfaces = make(map[string]string)
+	}
+}
+
+func TestAttributeDevice(t *testing.T) {
+	defer fakeInterfaces(t)()
+
+	for i, test := range []struct {
+		name  string
+		ip    string
+		ours  bool
+		iface string
+	}{
+		{"on our subnet", "192.168.1.50", true, "eth0"},
+		{"on the subnet we're not using", "10.0.0.7", false, ""},
+		{"over a router", "172.20.0.5", true, "eth0"},
+	} {
+		mac := fmt.Sprintf("accf230000%02d", i)
+		info := &orvibo.Device{MACAddress: mac, IP: &net.UDPAddr{IP: net.ParseIP(test.ip), Port: orviboPort}}
+		if got := attributeDevice(info); got != test.ours {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.ours)
+		}
+		if got := deviceInterface(mac); got != test.iface {
+			t.Errorf("%s: attributed to %q, want %q", test.name, got, test.iface)
+		}
+	}
+
+	if !attributeDevice(&orvibo.Device{MACAddress: "accf23000000"}) {
+		t.Errorf("A device without an address should be kept")
+	}
+}
+
+// With no interfaces chosen, everything is ours
+func TestAttributeDeviceUnbound(t *testing.T) {
+	defer fakeInterfaces(t)()
+	boundInterfaces = nil
+
+	info := &orvibo.Device{MACAddress: "accf23123456", IP: &net.UDPAddr{IP: net.ParseIP("10.0.0.7"), Port: orviboPort}}
+	if !attributeDevice(info) {
+		t.Errorf("Got false, want true")
+	}
+}
+
+// If one of the interfaces can't be opened, none of them should be, and what we had before should be kept
+func TestOpenInterfacesAllOrNothing(t *testing.T) {
+	defer fakeInterfaces(t)()
+	before := boundInterfaces
+
+	if err := openInterfaces([]string{"127.0.0.1", "no-such-interface"}); err == nil {
+		t.Fatalf("no-such-interface should have failed")
+	}
+	if len(boundInterfaces) != 1 || boundInterfaces[0] != before[0] {
+		t.Errorf("Got %v bound, want what we had before", boundInterfaces)
+	}
+}
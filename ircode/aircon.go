@@ -0,0 +1,206 @@
+package ircode
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Air conditioner remotes don't have "temperature up" buttons like a TV's volume. The remote keeps track of what the AC
+// should be doing, and every press sends all of it (mode, temperature, fan and so on). Learning buttons from one of these
+// only gets you whatever it happened to be set to at the time, so instead we keep the state ourselves and build the whole
+// frame for it here.
+//
+// Only Coolix is supported so far. To add a protocol, add it to ACProtocols and acTemperatures, then teach EncodeAC (and
+// DecodeAC, if you can) about it
+
+// ACState is everything an air conditioner remote sends
+type ACState struct {
+	Power       bool
+	Mode        string // One of ACModes
+	Temperature int    // Degrees C
+	Fan         string // One of ACFanSpeeds
+	Swing       bool
+}
+
+// ACProtocols is every air conditioner protocol we can build frames for
+var ACProtocols = []string{"Coolix"}
+
+// ACModes and ACFanSpeeds are what ACState's Mode and Fan can be
+var (
+	ACModes     = []string{"cool", "heat", "dry", "fan", "auto"}
+	ACFanSpeeds = []string{"auto", "low", "medium", "high"}
+)
+
+// acTemperatures is the lowest and highest temperature each protocol can be set to
+var acTemperatures = map[string][2]int{
+	"Coolix": {17, 30},
+}
+
+// ACTemperatureRange is the lowest and highest temperature an air conditioner using protocol can be set to
+func ACTemperatureRange(protocol string) (int, int, error) {
+	limits, ok := acTemperatures[protocol]
+	if !ok {
+		return 0, 0, fmt.Errorf("We don't know how to control %s air conditioners. Try one of %s", protocol, strings.Join(ACProtocols, ", "))
+	}
+	return limits[0], limits[1], nil
+}
+
+// DefaultACState is what a new air conditioner starts as: off, but set to cool to 24 with the fan on auto when it's turned on
+func DefaultACState() ACState {
+	return ACState{Mode: "cool", Temperature: 24, Fan: "auto"}
+}
+
+// Check makes sure a state is one protocol can send
+func (state ACState) Check(protocol string) error {
+	low, high, err := ACTemperatureRange(protocol)
+	if err != nil {
+		return err
+	}
+	if state.Temperature < low || state.Temperature > high {
+		return fmt.Errorf("%s air conditioners can be set between %d and %d degrees", protocol, low, high)
+	}
+	if !contains(ACModes, state.Mode) {
+		return fmt.Errorf("%s isn't a mode. Try one of %s", state.Mode, strings.Join(ACModes, ", "))
+	}
+	if !contains(ACFanSpeeds, state.Fan) {
+		return fmt.Errorf("%s isn't a fan speed. Try one of %s", state.Fan, strings.Join(ACFanSpeeds, ", "))
+	}
+	return nil
+}
+
+// String describes a state, e.g. "cool 24, fan auto, swing off"
+func (state ACState) String() string {
+	if !state.Power {
+		return "off"
+	}
+	swing := "off"
+	if state.Swing {
+		swing = "on"
+	}
+	if state.Mode == "fan" {
+		return fmt.Sprintf("fan only, fan %s, swing %s", state.Fan, swing)
+	}
+	return fmt.Sprintf("%s %d, fan %s, swing %s", state.Mode, state.Temperature, state.Fan, swing)
+}
+
+// EncodeAC builds the timings that take an air conditioner from previous to state. Usually that's one frame with the whole
+// state in it, but some things (like swing on Coolix) are buttons that toggle, which get sent afterwards if they've changed.
+// Toggles can't be sent while it's off, so they're left alone until it's turned on again
+func EncodeAC(protocol string, state ACState, previous ACState) (Timings, error) {
+	if err := state.Check(protocol); err != nil {
+		return nil, err
+	}
+
+	switch protocol {
+	case "Coolix":
+		var commands []uint32
+		if !state.Power {
+			commands = append(commands, coolixOff)
+		} else {
+			commands = append(commands, coolixState(state))
+			if state.Swing != previous.Swing {
+				commands = append(commands, coolixSwing)
+			}
+		}
+
+		var timings Timings
+		for _, command := range commands {
+			frame, err := Encode(Code{Protocol: "Coolix", Command: command}, 0)
+			if err != nil {
+				return nil, err
+			}
+			if len(timings) > 0 {
+				timings = append(timings, maxTiming)
+			}
+			timings = append(timings, frame...)
+		}
+		return timings, nil
+	}
+	return nil, fmt.Errorf("We don't know how to control %s air conditioners. Try one of %s", protocol, strings.Join(ACProtocols, ", "))
+}
+
+// DecodeAC works out what state a code (e.g. one learned from the remote) sets an air conditioner to. Swing can't be
+// worked out, since it's a separate button, so it's always false
+func DecodeAC(code Code) (ACState, error) {
+	switch code.Protocol {
+	case "Coolix":
+		return decodeCoolixState(code.Command)
+	}
+	return ACState{}, fmt.Errorf("%s isn't an air conditioner protocol we know", code.Protocol)
+}
+
+// Coolix is a 24 bit number. Most codes hold the whole state:
+//
+//	1011 0010  fff1 1111  tttt mm00
+//
+// where f is the fan speed, t is the temperature (see coolixTemperatures) and m is the mode. Fan only mode is dry mode with
+// a temperature of 1110. Dry and auto modes always have the fan on 000. A few codes are buttons rather than states (off,
+// swing, and some starting with b5 for things like turbo)
+const (
+	coolixOff     = 0xb27be0
+	coolixSwing   = 0xb26be0
+	coolixPrefix  = 0xb2
+	coolixSensor  = 0x1f // "No temperature from the remote", which is all we can say
+	coolixFanOnly = 0xe
+)
+
+// coolixTemperatures is what gets sent for 17 to 30 degrees. They're not in order
+var coolixTemperatures = []uint32{0x0, 0x1, 0x3, 0x2, 0x6, 0x7, 0x5, 0x4, 0xc, 0xd, 0x9, 0x8, 0xa, 0xb}
+
+var coolixModes = map[string]uint32{"cool": 0, "dry": 1, "auto": 2, "heat": 3, "fan": 1}
+
+var coolixFans = map[string]uint32{"auto": 5, "low": 4, "medium": 2, "high": 1}
+
+func coolixState(state ACState) uint32 {
+	temperature := coolixTemperatures[state.Temperature-17]
+	if state.Mode == "fan" {
+		temperature = coolixFanOnly
+	}
+	fan := coolixFans[state.Fan]
+	if state.Mode == "dry" || state.Mode == "auto" {
+		fan = 0
+	}
+	return coolixPrefix<<16 | fan<<13 | coolixSensor<<8 | temperature<<4 | coolixModes[state.Mode]<<2
+}
+
+func decodeCoolixState(command uint32) (ACState, error) {
+	if command == coolixOff {
+		return ACState{Power: false, Mode: "cool", Temperature: 24, Fan: "auto"}, nil
+	}
+	if command>>16 != coolixPrefix || command == coolixSwing || command&3 != 0 {
+		return ACState{}, fmt.Errorf("0x%06X is a Coolix button, not a state", command)
+	}
+
+	state := ACState{Power: true, Fan: "auto"}
+	temperature, mode, fan := command>>4&0xf, command>>2&3, command>>13&7
+	for name, value := range coolixModes {
+		if value == mode && name != "fan" {
+			state.Mode = name
+		}
+	}
+	if mode == coolixModes["dry"] && temperature == coolixFanOnly {
+		state.Mode = "fan"
+	}
+	for name, value := range coolixFans {
+		if value == fan {
+			state.Fan = name
+		}
+	}
+
+	state.Temperature = 24 // Fan only mode doesn't send one
+	for i, value := range coolixTemperatures {
+		if value == temperature {
+			state.Temperature = 17 + i
+		}
+	}
+	return state, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package ircode
+
+import (
+	"testing"
+)
+
+// What a real Coolix remote sends, and the state each one sets. The first lot are the codes in library/aircon.txt. The fan
+// speeds (and fan only) are the codes other people have published from Midea remotes, e.g. in IRremoteESP8266's Coolix notes.
+// None of these came from our own encoder, so if a mode, fan or temperature bit is wrong, this is where it shows up
+var coolixCaptures = []struct {
+	command uint32
+	state   ACState
+}{
+	{0xb2bf40, ACState{Power: true, Mode: "cool", Temperature: 24, Fan: "auto"}},
+	{0xb27be0, ACState{Power: false, Mode: "cool", Temperature: 24, Fan: "auto"}},
+	{0xb2bf20, ACState{Power: true, Mode: "cool", Temperature: 20, Fan: "auto"}},
+	{0xb2bf4c, ACState{Power: true, Mode: "heat", Temperature: 24, Fan: "auto"}},
+	{0xb21fc8, ACState{Power: true, Mode: "auto", Temperature: 25, Fan: "auto"}},
+	{0xb21f44, ACState{Power: true, Mode: "dry", Temperature: 24, Fan: "auto"}},
+	{0xb29f40, ACState{Power: true, Mode: "cool", Temperature: 24, Fan: "low"}},
+	{0xb25f40, ACState{Power: true, Mode: "cool", Temperature: 24, Fan: "medium"}},
+	{0xb23f40, ACState{Power: true, Mode: "cool", Temperature: 24, Fan: "high"}},
+	{0xb2bfe4, ACState{Power: true, Mode: "fan", Temperature: 24, Fan: "auto"}},
+	{0xb23fe4, ACState{Power: true, Mode: "fan", Temperature: 24, Fan: "high"}},
+}
+
+func TestEncodeACCoolix(t *testing.T) {
+	for _, capture := range coolixCaptures {
+		timings, err := EncodeAC("Coolix", capture.state, capture.state)
+		if err != nil {
+			t.Errorf("%s: %s", capture.state, err)
+			continue
+		}
+		code, err := Decode(timings)
+		if err != nil {
+			t.Errorf("%s: Decode failed: %s", capture.state, err)
+			continue
+		}
+		if code != (Code{Protocol: "Coolix", Command: capture.command}) {
+			t.Errorf("%s: sent %s, the remote sends 0x%06X", capture.state, code, capture.command)
+		}
+	}
+}
+
+func TestDecodeACCoolix(t *testing.T) {
+	for _, capture := range coolixCaptures {
+		state, err := DecodeAC(Code{Protocol: "Coolix", Command: capture.command})
+		if err != nil {
+			t.Errorf("0x%06X: %s", capture.command, err)
+			continue
+		}
+		if state != capture.state {
+			t.Errorf("0x%06X: got %s, want %s", capture.command, state, capture.state)
+		}
+	}
+
+	if _, err := DecodeAC(Code{Protocol: "Coolix", Command: coolixSwing}); err == nil {
+		t.Errorf("The swing button shouldn't decode as a state")
+	}
+}
+
+// Every state we can send should come back as the same state
+func TestCoolixStates(t *testing.T) {
+	for _, mode := range ACModes {
+		for _, fan := range ACFanSpeeds {
+			for temperature := 17; temperature <= 30; temperature++ {
+				state := ACState{Power: true, Mode: mode, Temperature: temperature, Fan: fan}
+				got, err := decodeCoolixState(coolixState(state))
+				if err != nil {
+					t.Errorf("%s: %s", state, err)
+					continue
+				}
+
+				// Dry and auto don't send a fan speed, and fan only doesn't send a temperature
+				want := state
+				if mode == "dry" || mode == "auto" {
+					want.Fan = "auto"
+				}
+				if mode == "fan" {
+					want.Temperature = 24
+				}
+				if got != want {
+					t.Errorf("%s came back as %s", want, got)
+				}
+			}
+		}
+	}
+}
+
+// Swing is a toggle, so it's sent as its own frame after the state, and only when it changes
+func TestEncodeACSwing(t *testing.T) {
+	off := DefaultACState()
+	off.Power = true
+	on := off
+	on.Swing = true
+
+	frame := 2 + 48*2 + 1
+	for _, test := range []struct {
+		state    ACState
+		previous ACState
+		frames   int
+	}{
+		{on, off, 2},
+		{off, on, 2},
+		{on, on, 1},
+	} {
+		timings, err := EncodeAC("Coolix", test.state, test.previous)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Each command is sent twice by Encode, with a gap in between. Commands are separated by maxTiming
+		if want := test.frames*(2*frame+1) + test.frames - 1; len(timings) != want {
+			t.Errorf("%s after %s: got %d timings, want %d (%d commands)", test.state, test.previous, len(timings), want, test.frames)
+		}
+		if test.frames == 2 {
+			code, err := Decode(timings[2*frame+2:])
+			if err != nil || code.Command != coolixSwing {
+				t.Errorf("%s after %s: second command was %s (%v), want swing", test.state, test.previous, code, err)
+			}
+		}
+	}
+}
+
+func TestACCheck(t *testing.T) {
+	for _, state := range []ACState{
+		{Power: true, Mode: "cool", Temperature: 16, Fan: "auto"},
+		{Power: true, Mode: "cool", Temperature: 31, Fan: "auto"},
+		{Power: true, Mode: "freeze", Temperature: 24, Fan: "auto"},
+		{Power: true, Mode: "cool", Temperature: 24, Fan: "hurricane"},
+	} {
+		if err := state.Check("Coolix"); err == nil {
+			t.Errorf("%+v should have failed", state)
+		}
+	}
+	if err := DefaultACState().Check("Daikin"); err == nil {
+		t.Errorf("Daikin isn't supported, so Check should have failed")
+	}
+}
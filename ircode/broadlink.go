@@ -0,0 +1,145 @@
+package ircode
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Broadlink's RM blasters (and everything built on them, like Home Assistant and SmartIR) pass codes around as base64. Once
+// decoded, an IR code looks like this:
+//
+//	26 <repeats> <length (2 bytes, little endian)> <timings> 0d 05 <zeroes, up to a multiple of 16 bytes>
+//
+// 26 means IR (b2 and d7 are 433MHz and 315MHz RF, which the AllOne does differently). Repeats is how many extra times to
+// send it. Each timing is one byte, counted in ticks of 269/8192ms (about 32.84us, the same tick python-broadlink uses), or a
+// 0 followed by two bytes (big endian) if it doesn't fit. The 0d 05 at the end is the final space, which is really just a long gap
+
+// Broadlink packet types
+const (
+	broadlinkIR    = 0x26
+	broadlinkRF433 = 0xb2
+	broadlinkRF315 = 0xd7
+)
+
+// broadlinkTrailer is the gap Broadlink codes end with, in ticks
+const broadlinkTrailer = 0x0d05
+
+// broadlinkTicks and broadlinkMicroseconds convert between Broadlink's ticks and microseconds, rounding to the nearest
+func broadlinkTicks(microseconds int) int {
+	return (microseconds*8192 + 134500) / 269000
+}
+
+func broadlinkMicroseconds(ticks int) int {
+	return (ticks*269000 + 4096) / 8192
+}
+
+// ParseBroadlink turns a Broadlink code (base64, or hex) into timings. It also returns how many extra times the code should
+// be sent
+func ParseBroadlink(code string) (Timings, int, error) {
+	code = strings.TrimSpace(code)
+	data, err := hex.DecodeString(code)
+	if err != nil {
+		if data, err = base64.StdEncoding.DecodeString(code); err != nil {
+			return nil, 0, fmt.Errorf("Not a base64 or hex Broadlink code")
+		}
+	}
+
+	if len(data) < 4 {
+		return nil, 0, fmt.Errorf("Too short to be a Broadlink code")
+	}
+	switch data[0] {
+	case broadlinkIR:
+	case broadlinkRF433, broadlinkRF315:
+		return nil, 0, fmt.Errorf("This is a Broadlink RF code. Only IR codes can be converted")
+	default:
+		return nil, 0, fmt.Errorf("Not a Broadlink IR code")
+	}
+	repeats := int(data[1])
+	length := int(data[2]) | int(data[3])<<8
+	if len(data) < 4+length {
+		return nil, 0, fmt.Errorf("This Broadlink code has been cut short")
+	}
+
+	var timings Timings
+	body := data[4 : 4+length]
+	for i := 0; i < len(body); i++ {
+		ticks := int(body[i])
+		if ticks == 0 {
+			if i+2 >= len(body) {
+				break // Just padding
+			}
+			ticks = int(body[i+1])<<8 | int(body[i+2])
+			i += 2
+		}
+		timings = append(timings, broadlinkMicroseconds(ticks))
+	}
+
+	if len(timings)%2 == 0 && len(timings) > 0 { // The trailer (or whatever the last space is) is just silence
+		timings = timings[:len(timings)-1]
+	}
+	if len(timings) == 0 {
+		return nil, 0, fmt.Errorf("This Broadlink code doesn't have any timings")
+	}
+	return timings, repeats, nil
+}
+
+// FormatBroadlink turns timings into a base64 Broadlink code, to be sent repeats extra times
+func FormatBroadlink(timings Timings, repeats int) (string, error) {
+	if len(timings) == 0 {
+		return "", fmt.Errorf("There's nothing in this code")
+	}
+	if repeats < 0 || repeats > 0xff {
+		return "", fmt.Errorf("Broadlink codes can only be repeated up to 255 times")
+	}
+
+	var body []byte
+	for _, timing := range timings {
+		ticks := broadlinkTicks(timing)
+		if ticks < 1 {
+			ticks = 1
+		}
+		if ticks < 0x100 {
+			body = append(body, byte(ticks))
+		} else {
+			if ticks > 0xffff {
+				ticks = 0xffff
+			}
+			body = append(body, 0, byte(ticks>>8), byte(ticks))
+		}
+	}
+	if len(timings)%2 != 0 {
+		body = append(body, 0, broadlinkTrailer>>8, broadlinkTrailer&0xff)
+	}
+
+	data := append([]byte{broadlinkIR, byte(repeats), byte(len(body)), byte(len(body) >> 8)}, body...)
+	for len(data)%16 != 0 {
+		data = append(data, 0)
+	}
+	return base64.StdEncoding.EncodeToString(data), nil
+}
+
+// BroadlinkToAllOne turns a Broadlink code into an AllOne code. The AllOne doesn't have its own repeat count, so any repeats
+// are sent as extra copies of the code
+func BroadlinkToAllOne(code string) (string, error) {
+	timings, repeats, err := ParseBroadlink(code)
+	if err != nil {
+		return "", err
+	}
+	frame := append(Timings(nil), timings...)
+	for i := 0; i < repeats; i++ {
+		timings = append(timings, maxTiming)
+		timings = append(timings, frame...)
+	}
+	return FormatAllOne(timings)
+}
+
+// AllOneToBroadlink turns an AllOne code into a base64 Broadlink code
+func AllOneToBroadlink(code string) (string, error) {
+	timings, err := ParseAllOne(code)
+	if err != nil {
+		return "", err
+	}
+	return FormatBroadlink(timings, 0)
+}
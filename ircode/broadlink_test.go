@@ -0,0 +1,92 @@
+package ircode
+
+import (
+	"testing"
+)
+
+// A button from an NEC (extended address) remote, as a Broadlink RM exports it. At 32.84us a tick, the header is 0x0129
+// ticks (9.75ms) and each bit's pulse is 0x14 ticks (657us)
+const broadlinkNEC = "JgBQAAABKZIUEhQRFBEUNxQRFBEUERQRFDcUNxQRFDcUNxQ3FDcUNxQRFBEUERQ3FBEUERQRFBEUNxQ3FDcUERQ3FDcUNxQ3FAAFGQABKUoUAA0FAAAAAAAAAAAAAAAA"
+
+func TestBroadlinkTicks(t *testing.T) {
+	for _, test := range []struct {
+		ticks        int
+		microseconds int
+	}{
+		{1, 33},
+		{0x14, 657},
+		{0x37, 1806},
+		{0x0129, 9753},
+		{0x0d05, 109445},
+	} {
+		if got := broadlinkMicroseconds(test.ticks); got != test.microseconds {
+			t.Errorf("%d ticks came out as %dus, want %dus", test.ticks, got, test.microseconds)
+		}
+		if got := broadlinkTicks(test.microseconds); got != test.ticks {
+			t.Errorf("%dus came out as %d ticks, want %d", test.microseconds, got, test.ticks)
+		}
+	}
+}
+
+func TestParseBroadlink(t *testing.T) {
+	timings, repeats, err := ParseBroadlink(broadlinkNEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repeats != 0 {
+		t.Errorf("Got %d repeats, want 0", repeats)
+	}
+	if timings[0] != 9753 || timings[1] != 4794 {
+		t.Errorf("Header came out as %dus / %dus, want 9753us / 4794us", timings[0], timings[1])
+	}
+
+	code, err := Decode(timings)
+	if err != nil {
+		t.Fatalf("Decode failed: %s", err)
+	}
+	if code != (Code{Protocol: "NECext", Address: 0xfb08, Command: 0x08}) {
+		t.Errorf("Got %s, want NECext 0xFB08 / 0x08", code)
+	}
+}
+
+// Converting to the AllOne and back should give exactly the ticks the Broadlink sent
+func TestBroadlinkAllOne(t *testing.T) {
+	hex, err := BroadlinkToAllOne(broadlinkNEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	back, err := AllOneToBroadlink(hex)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, _, _ := ParseBroadlink(broadlinkNEC)
+	got, _, err := ParseBroadlink(back)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(want) {
+		t.Fatalf("Got %d timings back, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("Timing %d came back as %dus, want %dus", i, got[i], want[i])
+		}
+	}
+}
+
+func TestFormatBroadlinkRepeats(t *testing.T) {
+	timings, _, err := ParseBroadlink(broadlinkNEC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := FormatBroadlink(timings, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, repeats, err := ParseBroadlink(code); err != nil || repeats != 3 {
+		t.Errorf("Got %d repeats (%v), want 3", repeats, err)
+	}
+	if _, err := FormatBroadlink(timings, 256); err == nil {
+		t.Errorf("256 repeats should have failed")
+	}
+}
@@ -0,0 +1,372 @@
+// Package ircode makes sense of the IR codes the AllOne learns. An AllOne code is just a blob of hex, so this package turns
+// it into a list of pulse and space timings, then tries to recognise which remote control protocol made them. That way, two
+// learned codes can be compared by what button they are, rather than by whether the hex happens to match.
+package ircode
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// Timings is an IR signal, as a list of durations in microseconds. They alternate between pulse (IR on) and space (IR off),
+// starting with a pulse
+type Timings []int
+
+// Code is an IR code we've recognised
+type Code struct {
+	Protocol string // e.g. "NEC", "Sony12" or "RC5"
+	Address  uint32 // Which device the code is for. How many bits this is depends on the protocol
+	Command  uint32 // Which button was pressed
+}
+
+// ErrUnknown is returned when an IR signal doesn't match any protocol we know
+var ErrUnknown = errors.New("Not a protocol we know")
+
+// ErrRepeat is returned when an IR signal is just a "the button is still held down" frame, which happens if the button was
+// held down while the AllOne was learning
+var ErrRepeat = errors.New("Only a repeat frame was learned. Try a shorter press")
+
+// An AllOne code (what go-orvibo gives us after learning, and what EmitIR takes) is a hex string. As far as anyone has worked
+// out, it's a two byte (little endian) length, followed by that many bytes of timings. Each timing is two bytes, little
+// endian, in microseconds. Some captures have a few bytes of header in front, so ParseAllOne looks for the length rather
+// than assuming where it is
+
+// How far into a capture we'll look for the length
+const maxHeader = 32
+
+// ParseAllOne turns an AllOne code into timings
+func ParseAllOne(code string) (Timings, error) {
+	data, err := hex.DecodeString(code)
+	if err != nil {
+		return nil, fmt.Errorf("Not a hex code: %s", err)
+	}
+
+	for offset := 0; offset <= maxHeader && offset+2 <= len(data); offset++ {
+		length := int(data[offset]) | int(data[offset+1])<<8
+		if length == 0 || length%2 != 0 || offset+2+length != len(data) {
+			continue
+		}
+
+		var timings Timings
+		for i := offset + 2; i+1 < len(data); i += 2 {
+			timings = append(timings, int(data[i])|int(data[i+1])<<8)
+		}
+		return timings, nil
+	}
+
+	return nil, fmt.Errorf("Couldn't find the timings in this code")
+}
+
+// DecodeAllOne is ParseAllOne and Decode in one go
+func DecodeAllOne(code string) (Code, error) {
+	timings, err := ParseAllOne(code)
+	if err != nil {
+		return Code{}, err
+	}
+	return Decode(timings)
+}
+
+// Decode works out which protocol some timings are, and what address and command they carry
+func Decode(timings Timings) (Code, error) {
+	if len(timings) < 2 {
+		return Code{}, ErrUnknown
+	}
+
+	if near(timings[0], necHeaderPulse) && near(timings[1], necRepeatSpace) && len(timings) <= 4 {
+		return Code{}, ErrRepeat
+	}
+
+	for _, decoder := range []func(Timings) (Code, bool){decodeNEC, decodeCoolix, decodeSamsung, decodeKaseikyo, decodeSony, decodeRC6, decodeRC5} {
+		if code, ok := decoder(timings); ok {
+			return code, nil
+		}
+	}
+	return Code{}, ErrUnknown
+}
+
+// String describes a code, e.g. "NEC 0x04 / 0x08"
+func (c Code) String() string {
+	return fmt.Sprintf("%s 0x%02X / 0x%02X", c.Protocol, c.Address, c.Command)
+}
+
+// Timings for each protocol, in microseconds. Most of these come from the SB-Projects IR pages
+const (
+	necHeaderPulse    = 9000
+	necHeaderSpace    = 4500
+	necRepeatSpace    = 2250
+	necBitPulse       = 560
+	necZeroSpace      = 560
+	necOneSpace       = 1690
+	samsungHeader     = 4500
+	kaseikyoUnit      = 432
+	kaseikyoHeader    = 8 * kaseikyoUnit
+	sonyHeaderPulse   = 2400
+	sonyUnit          = 600
+	rc5Unit           = 889
+	rc6Unit           = 444
+	rc6HeaderPulse    = 6 * rc6Unit
+	rc6HeaderSpace    = 2 * rc6Unit
+	panasonicVendor   = 0x2002
+	coolixHeaderPulse = 4692
+	coolixHeaderSpace = 4416
+	coolixBitPulse    = 552
+	coolixOneSpace    = 1656
+	coolixGap         = 5244
+	gapAfterSignal    = 5000 // Any space this long means the signal (or a repeat of it) is over
+	minimumTolerance  = 150  // Cheap remotes (and the AllOne) aren't exact, so allow this much either way, or 30%, whichever is more
+)
+
+// near checks a timing is close enough to what we expected
+func near(timing int, want int) bool {
+	tolerance := want * 30 / 100
+	if tolerance < minimumTolerance {
+		tolerance = minimumTolerance
+	}
+	return timing >= want-tolerance && timing <= want+tolerance
+}
+
+// pulseDistance reads bits that are all the same pulse, with a short space for 0 and a long space for 1 (NEC, Samsung,
+// Kaseikyo). Bits are sent least significant first
+func pulseDistance(timings Timings, start int, bits int, pulse int, zero int, one int) ([]byte, bool) {
+	if len(timings) < start+bits*2+1 { // Every bit, plus the stop pulse
+		return nil, false
+	}
+
+	data := make([]byte, (bits+7)/8)
+	for i := 0; i < bits; i++ {
+		if !near(timings[start+i*2], pulse) {
+			return nil, false
+		}
+		space := timings[start+i*2+1]
+		switch {
+		case near(space, one):
+			data[i/8] |= 1 << uint(i%8)
+		case near(space, zero):
+		default:
+			return nil, false
+		}
+	}
+	return data, true
+}
+
+// NEC: 9ms pulse, 4.5ms space, then address, inverted address, command, inverted command. NEC extended uses the inverted
+// address as 8 more bits of address
+func decodeNEC(timings Timings) (Code, bool) {
+	if !near(timings[0], necHeaderPulse) || !near(timings[1], necHeaderSpace) {
+		return Code{}, false
+	}
+	data, ok := pulseDistance(timings, 2, 32, necBitPulse, necZeroSpace, necOneSpace)
+	if !ok || data[2]^data[3] != 0xff {
+		return Code{}, false
+	}
+
+	if data[0]^data[1] == 0xff {
+		return Code{Protocol: "NEC", Address: uint32(data[0]), Command: uint32(data[2])}, true
+	}
+	return Code{Protocol: "NECext", Address: uint32(data[0]) | uint32(data[1])<<8, Command: uint32(data[2])}, true
+}
+
+// Samsung: Like NEC, but with a 4.5ms pulse in the header. The address is usually the same byte twice (e.g. 0x0707)
+func decodeSamsung(timings Timings) (Code, bool) {
+	if !near(timings[0], samsungHeader) || !near(timings[1], samsungHeader) {
+		return Code{}, false
+	}
+	data, ok := pulseDistance(timings, 2, 32, necBitPulse, necZeroSpace, necOneSpace)
+	if !ok || data[2]^data[3] != 0xff {
+		return Code{}, false
+	}
+	return Code{Protocol: "Samsung", Address: uint32(data[0]) | uint32(data[1])<<8, Command: uint32(data[2])}, true
+}
+
+// Coolix (Midea, and plenty of air conditioners built by them and sold under other names): a header much like Samsung's,
+// then 3 bytes, each followed by its inverse, most significant bit first. There's no address, so the whole 24 bits go in
+// Command. This has to be tried before Samsung, which would otherwise take the first 32 bits for itself
+func decodeCoolix(timings Timings) (Code, bool) {
+	if !near(timings[0], coolixHeaderPulse) || !near(timings[1], coolixHeaderSpace) {
+		return Code{}, false
+	}
+	data, ok := pulseDistance(timings, 2, 48, coolixBitPulse, coolixBitPulse, coolixOneSpace)
+	if !ok {
+		return Code{}, false
+	}
+
+	var command uint32
+	for i := 0; i < 6; i += 2 {
+		if data[i]^data[i+1] != 0xff {
+			return Code{}, false
+		}
+		command = command<<8 | uint32(bits.Reverse8(data[i]))
+	}
+	return Code{Protocol: "Coolix", Command: command}, true
+}
+
+// Kaseikyo (and Panasonic, which is Kaseikyo with Panasonic's vendor ID): 48 bits. A 16 bit vendor ID, 4 bits of vendor
+// parity, 12 bits of address, 8 bits of command, then 8 bits of parity. The vendor goes in the top 16 bits of Address
+func decodeKaseikyo(timings Timings) (Code, bool) {
+	if !near(timings[0], kaseikyoHeader) || !near(timings[1], kaseikyoHeader/2) {
+		return Code{}, false
+	}
+	data, ok := pulseDistance(timings, 2, 48, kaseikyoUnit, kaseikyoUnit, 3*kaseikyoUnit)
+	if !ok || data[5] != data[2]^data[3]^data[4] || data[2]&0x0f != kaseikyoVendorParity(data[0], data[1]) {
+		return Code{}, false
+	}
+
+	vendor := uint32(data[0]) | uint32(data[1])<<8
+	address := uint32(data[2])>>4 | uint32(data[3])<<4
+	protocol := "Kaseikyo"
+	if vendor == panasonicVendor {
+		protocol = "Panasonic"
+	}
+	return Code{Protocol: protocol, Address: vendor<<16 | address, Command: uint32(data[4])}, true
+}
+
+// kaseikyoVendorParity is the four bits of parity that follow the vendor ID
+func kaseikyoVendorParity(low byte, high byte) byte {
+	parity := low ^ high
+	return (parity ^ parity>>4) & 0x0f
+}
+
+// Sony SIRC: 2.4ms pulse, then bits that are a 1.2ms (1) or 0.6ms (0) pulse, each followed by a 0.6ms space. 7 bits of
+// command, then 5, 8 or 13 bits of address, for 12, 15 or 20 bits all up
+func decodeSony(timings Timings) (Code, bool) {
+	if !near(timings[0], sonyHeaderPulse) || !near(timings[1], sonyUnit) {
+		return Code{}, false
+	}
+
+	var value uint32
+	bits := 0
+	for i := 2; i < len(timings); i += 2 {
+		switch {
+		case near(timings[i], 2*sonyUnit):
+			value |= 1 << uint(bits)
+		case near(timings[i], sonyUnit):
+		default:
+			return Code{}, false
+		}
+		bits++
+		if i+1 >= len(timings) || timings[i+1] > gapAfterSignal { // Sony remotes send everything three times. We only need the first
+			break
+		}
+		if !near(timings[i+1], sonyUnit) {
+			return Code{}, false
+		}
+	}
+
+	if bits != 12 && bits != 15 && bits != 20 {
+		return Code{}, false
+	}
+	return Code{Protocol: fmt.Sprintf("Sony%d", bits), Address: value >> 7, Command: value & 0x7f}, true
+}
+
+// halfBits turns timings into a list of levels (1 for pulse, 0 for space), one per unit. Used for the Manchester coded
+// protocols (RC5 and RC6), where every bit is half pulse and half space. Stops at the end of the signal
+func halfBits(timings Timings, unit int, maxUnits int) ([]int, bool) {
+	var levels []int
+	for i, timing := range timings {
+		level := 1 - i%2
+		if level == 0 && timing > gapAfterSignal {
+			break
+		}
+		units := (timing + unit/2) / unit
+		if units < 1 || units > maxUnits || !near(timing, units*unit) {
+			return nil, false
+		}
+		for ; units > 0; units-- {
+			levels = append(levels, level)
+		}
+	}
+	return levels, true
+}
+
+// manchester reads one bit from a pair of levels. ones is the pair that means 1
+func manchester(levels []int, at int, ones [2]int) (uint32, bool) {
+	if at+1 >= len(levels) || levels[at] == levels[at+1] {
+		return 0, false
+	}
+	if levels[at] == ones[0] && levels[at+1] == ones[1] {
+		return 1, true
+	}
+	return 0, true
+}
+
+// RC5 (Philips): 14 Manchester coded bits, 889us per half. A 1 is space then pulse. Two start bits (the second one is the
+// inverse of the command's 7th bit), a toggle bit, 5 bits of address and 6 bits of command, most significant first. We leave
+// the toggle bit out, so pressing the same button twice gives the same code
+func decodeRC5(timings Timings) (Code, bool) {
+	levels, ok := halfBits(timings, rc5Unit, 2)
+	if !ok {
+		return Code{}, false
+	}
+	levels = append([]int{0}, levels...) // The first half of the first start bit is a space, which we can't see
+	if len(levels) == 27 {
+		levels = append(levels, 0) // Neither can we see the space at the end, if the last bit is a 1
+	}
+	if len(levels) != 28 {
+		return Code{}, false
+	}
+
+	var value uint32
+	for bit := 0; bit < 14; bit++ {
+		b, ok := manchester(levels, bit*2, [2]int{0, 1})
+		if !ok {
+			return Code{}, false
+		}
+		value = value<<1 | b
+	}
+	if value>>13 != 1 {
+		return Code{}, false
+	}
+
+	command := value & 0x3f
+	if value>>12&1 == 0 { // RC5X. The second start bit is the command's 7th bit, inverted
+		command |= 0x40
+	}
+	return Code{Protocol: "RC5", Address: value >> 6 & 0x1f, Command: command}, true
+}
+
+// RC6 (mode 0): a 2.66ms pulse and 889us space, then Manchester coded bits 444us per half, where a 1 is pulse then space. A
+// start bit, 3 bits of mode, a double length toggle bit, then 8 bits of address and 8 bits of command, most significant first
+func decodeRC6(timings Timings) (Code, bool) {
+	if !near(timings[0], rc6HeaderPulse) || !near(timings[1], rc6HeaderSpace) {
+		return Code{}, false
+	}
+	levels, ok := halfBits(timings[2:], rc6Unit, 3) // The toggle bit is twice as long, so it can run into its neighbours
+	if !ok {
+		return Code{}, false
+	}
+
+	const length = 2 + 3*2 + 4 + 16*2 // Start bit, mode, toggle, address and command
+	if len(levels) == length-1 {
+		levels = append(levels, 0) // The space at the end, if the last bit is a 1
+	}
+	if len(levels) != length {
+		return Code{}, false
+	}
+
+	if start, ok := manchester(levels, 0, [2]int{1, 0}); !ok || start != 1 {
+		return Code{}, false
+	}
+	var mode uint32
+	for bit := 0; bit < 3; bit++ {
+		b, ok := manchester(levels, 2+bit*2, [2]int{1, 0})
+		if !ok {
+			return Code{}, false
+		}
+		mode = mode<<1 | b
+	}
+	if mode != 0 || levels[8] != levels[9] || levels[10] != levels[11] || levels[9] == levels[10] { // Toggle is 2 units each way
+		return Code{}, false
+	}
+
+	var value uint32
+	for bit := 0; bit < 16; bit++ {
+		b, ok := manchester(levels, 12+bit*2, [2]int{1, 0})
+		if !ok {
+			return Code{}, false
+		}
+		value = value<<1 | b
+	}
+	return Code{Protocol: "RC6", Address: value >> 8, Command: value & 0xff}, true
+}
@@ -0,0 +1,281 @@
+package ircode
+
+import (
+	"encoding/hex"
+	"fmt"
+	"math/bits"
+	"strings"
+)
+
+// This is the other half of decode.go. Give it a protocol, address and command (say, from a code list on the internet) and it
+// builds the timings a remote would send, which the AllOne can then blast without ever having learned the code
+
+// Protocols is every protocol we can encode, in the order we show them
+var Protocols = []string{"NEC", "NECext", "Samsung", "Sony12", "Sony15", "Sony20", "RC5", "RC6", "Panasonic", "Kaseikyo", "Coolix"}
+
+// How long to wait between repeats of a frame. Most protocols send a frame every so often, rather than leaving a fixed gap
+const (
+	necFramePeriod  = 108000
+	sonyFramePeriod = 45000
+	rc5FramePeriod  = 113778
+	rc6FramePeriod  = 106000
+	kaseikyoGap     = 65000  // Really 74ms, but that won't fit (see maxTiming)
+	maxTiming       = 0xffff // Timings are 2 bytes in an AllOne code, so this is as long as one can be
+)
+
+// The packet that tells an AllOne to blast a code has a two byte length, which has to cover the magic word, the command, the
+// MAC address and its padding and the few bytes go-orvibo adds (a sequence number and the code's length), as well as the code.
+// That's 26 bytes or so on top of the code, and we leave a little more to be safe. Each timing takes two bytes, and so does
+// the code's own length
+const (
+	allOnePacketOverhead = 32
+	maxAllOneTimings     = (0xffff - allOnePacketOverhead - 2) / 2
+)
+
+// Encode builds the timings for a code. repeats is how many extra times to send it, as if the button was held down. NEC sends
+// short repeat frames for this. Everything else sends the whole frame again. Sony remotes always send at least three frames,
+// so we do too
+func Encode(code Code, repeats int) (Timings, error) {
+	if repeats < 0 {
+		return nil, fmt.Errorf("Can't repeat a code %d times", repeats)
+	}
+	if repeats > maxAllOneTimings/2 { // Every repeat is at least a space and a pulse, so there's no point building that many
+		return nil, fmt.Errorf("%d repeats won't fit in an AllOne code", repeats)
+	}
+
+	switch code.Protocol {
+	case "NEC", "NECext":
+		return encodeNEC(code, repeats)
+	case "Samsung":
+		if code.Address > 0xffff || code.Command > 0xff {
+			return nil, fmt.Errorf("Samsung codes have a 16 bit address and an 8 bit command")
+		}
+		data := []byte{byte(code.Address), byte(code.Address >> 8), byte(code.Command), ^byte(code.Command)}
+		frame := pulseDistanceFrame(samsungHeader, samsungHeader, data, 32, necBitPulse, necZeroSpace, necOneSpace)
+		return repeatFrame(frame, repeats, necFramePeriod), nil
+	case "Sony12", "Sony15", "Sony20":
+		return encodeSony(code, repeats)
+	case "RC5":
+		return encodeRC5(code, repeats)
+	case "RC6":
+		return encodeRC6(code, repeats)
+	case "Panasonic", "Kaseikyo":
+		return encodeKaseikyo(code, repeats)
+	case "Coolix":
+		return encodeCoolix(code, repeats)
+	}
+	return nil, fmt.Errorf("We don't know how to make %s codes. Try one of %s", code.Protocol, strings.Join(Protocols, ", "))
+}
+
+// EncodeAllOne builds a code and turns it into something the AllOne can blast
+func EncodeAllOne(code Code, repeats int) (string, error) {
+	timings, err := Encode(code, repeats)
+	if err != nil {
+		return "", err
+	}
+	return FormatAllOne(timings)
+}
+
+// FormatAllOne turns timings into an AllOne code. This is the opposite of ParseAllOne, minus any header (the AllOne doesn't
+// seem to need one when blasting)
+func FormatAllOne(timings Timings) (string, error) {
+	if len(timings) > maxAllOneTimings {
+		return "", fmt.Errorf("This code is too long for the AllOne (%d pulses and spaces, and it can take %d)", len(timings), maxAllOneTimings)
+	}
+	data := make([]byte, 2, 2+len(timings)*2)
+	length := len(timings) * 2
+	data[0], data[1] = byte(length), byte(length>>8)
+
+	for _, timing := range timings {
+		if timing <= 0 || timing > maxTiming {
+			return "", fmt.Errorf("The AllOne can't send a %dus pulse or space", timing)
+		}
+		data = append(data, byte(timing), byte(timing>>8))
+	}
+	return hex.EncodeToString(data), nil
+}
+
+// pulseDistanceFrame is the opposite of pulseDistance. A header, the bits (least significant first), then a stop pulse
+func pulseDistanceFrame(headerPulse int, headerSpace int, data []byte, bits int, pulse int, zero int, one int) Timings {
+	frame := Timings{headerPulse, headerSpace}
+	for i := 0; i < bits; i++ {
+		if data[i/8]&(1<<uint(i%8)) != 0 {
+			frame = append(frame, pulse, one)
+		} else {
+			frame = append(frame, pulse, zero)
+		}
+	}
+	return append(frame, pulse)
+}
+
+// repeatFrame sends a frame, then repeats more copies of it, one every period microseconds
+func repeatFrame(frame Timings, repeats int, period int) Timings {
+	timings := append(Timings(nil), frame...)
+	for i := 0; i < repeats; i++ {
+		timings = append(timings, gap(frame, period))
+		timings = append(timings, frame...)
+	}
+	return timings
+}
+
+// gap works out the space after a frame, so the next one starts period microseconds after this one did
+func gap(frame Timings, period int) int {
+	length := Duration(frame)
+	if period-length < gapAfterSignal*2 {
+		return gapAfterSignal * 2
+	}
+	if period-length > maxTiming {
+		return maxTiming
+	}
+	return period - length
+}
+
+func encodeNEC(code Code, repeats int) (Timings, error) {
+	var data []byte
+	if code.Protocol == "NEC" {
+		if code.Address > 0xff || code.Command > 0xff {
+			return nil, fmt.Errorf("NEC codes have an 8 bit address and command. Try NECext for a 16 bit address")
+		}
+		data = []byte{byte(code.Address), ^byte(code.Address), byte(code.Command), ^byte(code.Command)}
+	} else {
+		if code.Address > 0xffff || code.Command > 0xff {
+			return nil, fmt.Errorf("NECext codes have a 16 bit address and an 8 bit command")
+		}
+		data = []byte{byte(code.Address), byte(code.Address >> 8), byte(code.Command), ^byte(code.Command)}
+	}
+
+	frame := pulseDistanceFrame(necHeaderPulse, necHeaderSpace, data, 32, necBitPulse, necZeroSpace, necOneSpace)
+	timings := append(Timings(nil), frame...)
+	previous := frame
+	repeat := Timings{necHeaderPulse, necRepeatSpace, necBitPulse} // "Still holding the button down"
+	for i := 0; i < repeats; i++ {
+		timings = append(timings, gap(previous, necFramePeriod))
+		timings = append(timings, repeat...)
+		previous = repeat
+	}
+	return timings, nil
+}
+
+func encodeSony(code Code, repeats int) (Timings, error) {
+	bits := map[string]int{"Sony12": 12, "Sony15": 15, "Sony20": 20}[code.Protocol]
+	if code.Command > 0x7f || code.Address >= 1<<uint(bits-7) {
+		return nil, fmt.Errorf("%s codes have a 7 bit command and a %d bit address", code.Protocol, bits-7)
+	}
+
+	value := code.Command | code.Address<<7
+	frame := Timings{sonyHeaderPulse}
+	for i := 0; i < bits; i++ {
+		frame = append(frame, sonyUnit)
+		if value&(1<<uint(i)) != 0 {
+			frame = append(frame, 2*sonyUnit)
+		} else {
+			frame = append(frame, sonyUnit)
+		}
+	}
+
+	if repeats < 2 {
+		repeats = 2
+	}
+	return repeatFrame(frame, repeats, sonyFramePeriod), nil
+}
+
+// manchesterFrame turns levels (see halfBits) into timings. Leading spaces are dropped, because you can't send nothing.
+// Trailing spaces are dropped too, because the gap after the frame takes care of them
+func manchesterFrame(levels []int, unit int) Timings {
+	var frame Timings
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		if levels[i] == 1 || len(frame) > 0 {
+			frame = append(frame, (j-i)*unit)
+		}
+		i = j
+	}
+	if len(frame)%2 == 0 && len(frame) > 0 {
+		frame = frame[:len(frame)-1]
+	}
+	return frame
+}
+
+// manchesterBits adds bits (most significant first) to levels. ones is the pair of levels that means 1
+func manchesterBits(levels []int, value uint32, bits int, ones [2]int) []int {
+	for i := bits - 1; i >= 0; i-- {
+		if value&(1<<uint(i)) != 0 {
+			levels = append(levels, ones[0], ones[1])
+		} else {
+			levels = append(levels, ones[1], ones[0])
+		}
+	}
+	return levels
+}
+
+// RC5's toggle bit is always 0 here. Devices use it to tell a new press from a held button, and every blast is a new press
+func encodeRC5(code Code, repeats int) (Timings, error) {
+	if code.Address > 0x1f || code.Command > 0x7f {
+		return nil, fmt.Errorf("RC5 codes have a 5 bit address and a 7 bit command")
+	}
+
+	value := uint32(1)<<13 | (^code.Command>>6&1)<<12 | code.Address<<6 | code.Command&0x3f
+	frame := manchesterFrame(manchesterBits(nil, value, 14, [2]int{0, 1}), rc5Unit)
+	return repeatFrame(frame, repeats, rc5FramePeriod), nil
+}
+
+func encodeRC6(code Code, repeats int) (Timings, error) {
+	if code.Address > 0xff || code.Command > 0xff {
+		return nil, fmt.Errorf("RC6 codes have an 8 bit address and command")
+	}
+
+	levels := manchesterBits(nil, 1, 1, [2]int{1, 0})   // Start bit
+	levels = manchesterBits(levels, 0, 3, [2]int{1, 0}) // Mode 0
+	levels = append(levels, 0, 0, 1, 1)                 // Toggle bit (0), which is twice as long as the others
+	levels = manchesterBits(levels, code.Address<<8|code.Command, 16, [2]int{1, 0})
+
+	frame := append(Timings{rc6HeaderPulse, rc6HeaderSpace}, manchesterFrame(levels, rc6Unit)...)
+	return repeatFrame(frame, repeats, rc6FramePeriod), nil
+}
+
+// Panasonic codes can leave the vendor out of the address, since it's always the same
+func encodeKaseikyo(code Code, repeats int) (Timings, error) {
+	vendor := code.Address >> 16
+	if vendor == 0 && code.Protocol == "Panasonic" {
+		vendor = panasonicVendor
+	}
+	address := code.Address & 0xffff
+	if address > 0xfff || code.Command > 0xff {
+		return nil, fmt.Errorf("%s codes have a 12 bit address (plus the vendor in the top 16 bits) and an 8 bit command", code.Protocol)
+	}
+
+	data := []byte{byte(vendor), byte(vendor >> 8), 0, byte(address >> 4), byte(code.Command), 0}
+	data[2] = kaseikyoVendorParity(data[0], data[1]) | byte(address&0x0f)<<4
+	data[5] = data[2] ^ data[3] ^ data[4]
+
+	frame := pulseDistanceFrame(kaseikyoHeader, kaseikyoHeader/2, data, 48, kaseikyoUnit, kaseikyoUnit, 3*kaseikyoUnit)
+	timings := append(Timings(nil), frame...)
+	for i := 0; i < repeats; i++ {
+		timings = append(timings, kaseikyoGap)
+		timings = append(timings, frame...)
+	}
+	return timings, nil
+}
+
+// Coolix remotes always send the frame twice, so repeats is how many copies to send on top of those two
+func encodeCoolix(code Code, repeats int) (Timings, error) {
+	if code.Address != 0 || code.Command > 0xffffff {
+		return nil, fmt.Errorf("Coolix codes don't have an address, and have a 24 bit command")
+	}
+
+	var data []byte
+	for _, b := range []byte{byte(code.Command >> 16), byte(code.Command >> 8), byte(code.Command)} {
+		data = append(data, bits.Reverse8(b), bits.Reverse8(^b)) // pulseDistanceFrame sends the least significant bit first
+	}
+
+	frame := pulseDistanceFrame(coolixHeaderPulse, coolixHeaderSpace, data, 48, coolixBitPulse, coolixBitPulse, coolixOneSpace)
+	timings := append(Timings(nil), frame...)
+	for i := 0; i <= repeats; i++ {
+		timings = append(timings, coolixGap)
+		timings = append(timings, frame...)
+	}
+	return timings, nil
+}
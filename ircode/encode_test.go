@@ -0,0 +1,168 @@
+package ircode
+
+import (
+	"testing"
+)
+
+// Everything we can encode, we should be able to decode again and get the same button back
+var roundTrips = []struct {
+	name string
+	code Code
+	want Code // What Decode should say. Usually the same as code
+}{
+	{"NEC", Code{Protocol: "NEC", Address: 0x04, Command: 0x08}, Code{}},
+	{"NEC top bits", Code{Protocol: "NEC", Address: 0xff, Command: 0x80}, Code{}},
+	{"NECext", Code{Protocol: "NECext", Address: 0x1234, Command: 0x12}, Code{}},
+	{"NECext that's really NEC", Code{Protocol: "NECext", Address: 0x7f80, Command: 0x12}, Code{Protocol: "NEC", Address: 0x80, Command: 0x12}},
+	{"Samsung", Code{Protocol: "Samsung", Address: 0x0707, Command: 0x02}, Code{}},
+	{"Sony12", Code{Protocol: "Sony12", Address: 0x01, Command: 0x15}, Code{}},
+	{"Sony15", Code{Protocol: "Sony15", Address: 0x97, Command: 0x1a}, Code{}},
+	{"Sony20", Code{Protocol: "Sony20", Address: 0x1a0b, Command: 0x39}, Code{}},
+	{"RC5", Code{Protocol: "RC5", Address: 0x00, Command: 0x0c}, Code{}},
+	{"RC5 extended command", Code{Protocol: "RC5", Address: 0x14, Command: 0x4c}, Code{}},
+	{"RC6", Code{Protocol: "RC6", Address: 0x00, Command: 0x0c}, Code{}},
+	{"RC6 all ones", Code{Protocol: "RC6", Address: 0xff, Command: 0xff}, Code{}},
+	{"Panasonic", Code{Protocol: "Panasonic", Address: 0x2002<<16 | 0x100, Command: 0x3d}, Code{}},
+	{"Coolix", Code{Protocol: "Coolix", Command: 0xb2bf40}, Code{}},
+	{"Coolix off", Code{Protocol: "Coolix", Command: 0xb27be0}, Code{}},
+}
+
+func TestEncodeDecode(t *testing.T) {
+	for _, test := range roundTrips {
+		want := test.want
+		if want == (Code{}) {
+			want = test.code
+		}
+
+		for _, repeats := range []int{0, 1, 3} {
+			timings, err := Encode(test.code, repeats)
+			if err != nil {
+				t.Errorf("%s, %d repeats: Encode failed: %s", test.name, repeats, err)
+				continue
+			}
+			got, err := Decode(timings)
+			if err != nil {
+				t.Errorf("%s, %d repeats: Decode failed: %s", test.name, repeats, err)
+				continue
+			}
+			if got != want {
+				t.Errorf("%s, %d repeats: got %s, want %s", test.name, repeats, got, want)
+			}
+		}
+	}
+}
+
+func TestEncodeAllOneDecodeAllOne(t *testing.T) {
+	for _, test := range roundTrips {
+		want := test.want
+		if want == (Code{}) {
+			want = test.code
+		}
+
+		hex, err := EncodeAllOne(test.code, 1)
+		if err != nil {
+			t.Errorf("%s: EncodeAllOne failed: %s", test.name, err)
+			continue
+		}
+		got, err := DecodeAllOne(hex)
+		if err != nil {
+			t.Errorf("%s: DecodeAllOne failed: %s", test.name, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("%s: got %s, want %s", test.name, got, want)
+		}
+	}
+}
+
+// Holding the button down on an NEC remote sends short repeat frames rather than the whole code. Those should be there, and
+// shouldn't confuse the decoder. A code that's only a repeat frame should say so
+func TestEncodeNECHold(t *testing.T) {
+	timings, err := Encode(Code{Protocol: "NEC", Address: 0x04, Command: 0x08}, 2)
+	if err != nil {
+		t.Fatalf("Encode failed: %s", err)
+	}
+	if want := 67 + 2*4; len(timings) != want {
+		t.Errorf("Got %d timings, want %d (one frame and two repeat frames)", len(timings), want)
+	}
+
+	if _, err := Decode(Timings{necHeaderPulse, necRepeatSpace, necBitPulse}); err != ErrRepeat {
+		t.Errorf("A repeat frame decoded as %v, want ErrRepeat", err)
+	}
+}
+
+// Coolix remotes send every frame twice, and holding the button adds more copies on top
+func TestEncodeCoolixHold(t *testing.T) {
+	frame := 2 + 48*2 + 1
+	for _, repeats := range []int{0, 2} {
+		timings, err := Encode(Code{Protocol: "Coolix", Command: 0xb2bf40}, repeats)
+		if err != nil {
+			t.Fatalf("Encode failed: %s", err)
+		}
+		frames := 2 + repeats
+		if want := frames*frame + frames - 1; len(timings) != want {
+			t.Errorf("%d repeats: got %d timings, want %d (%d frames)", repeats, len(timings), want, frames)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	for _, code := range []Code{
+		{Protocol: "NEC", Address: 0x100},
+		{Protocol: "Samsung", Command: 0x100},
+		{Protocol: "Sony12", Address: 0x20},
+		{Protocol: "RC5", Address: 0x20},
+		{Protocol: "RC6", Command: 0x100},
+		{Protocol: "Coolix", Address: 1},
+		{Protocol: "Morse"},
+	} {
+		if _, err := Encode(code, 0); err == nil {
+			t.Errorf("Encoding %s should have failed", code)
+		}
+	}
+	if _, err := Encode(Code{Protocol: "NEC"}, -1); err == nil {
+		t.Errorf("Encoding with -1 repeats should have failed")
+	}
+	// This should fail straight away, not after building a million frames
+	for _, protocol := range []string{"NEC", "Sony12", "RC5", "Coolix"} {
+		if _, err := Encode(Code{Protocol: protocol}, 1000000); err == nil {
+			t.Errorf("%s with 1000000 repeats should have failed", protocol)
+		}
+	}
+}
+
+// Codes shaped like what the AllOne hands back in LastIRMessage, rather than what Encode makes: a couple of bytes in front
+// of the length, every pulse stretched and every space squashed by about 70us (which is what IR receivers do), a bit of
+// jitter on top, and the long gap after the button is let go. I haven't got a real capture to put here. These started as
+// Encode's timings and were skewed by hand, so if someone has a real LastIRMessage for any of these buttons, swap it in
+var captures = []struct {
+	name    string
+	capture string
+	want    Code
+}{
+	// LG TV power, with one NEC repeat frame because the button was held a little
+	{"NEC", "000090007d2357117602e9018602d901750256066202d6018602fd016802ee018602ec018402e1018002480678024e066b02df018602" +
+		"4b067b0250066502460673025a06760267066602e1017202e9017902ee016c0248067a02de018402f6017102e5018402fa01760245067c" +
+		"024706700266067602f2017b025406750255068a025d066f0248067002fd9b77238a087c0283af",
+		Code{Protocol: "NEC", Address: 0x04, Command: 0x08}},
+	// Philips TV power
+	{"RC5", "00003000c30342033f073603cf032103cd033603c7033a03b7033003bd032a03d2032e03c803ba06bb03200332073103be037aaf",
+		Code{Protocol: "RC5", Address: 0x00, Command: 0x0c}},
+	// Philips TV power, on a newer remote
+	{"RC6", "000054009c0a1e03f6012703f70165010b02680103021e03c1038301140263010602690106027401ff017c01fb01680105027c01f501" +
+		"6b0108028901fc017301f601670113027601b2038a01fc011e03ff0188010b0272af",
+		Code{Protocol: "RC6", Address: 0x00, Command: 0x0c}},
+}
+
+func TestDecodeAllOneCaptures(t *testing.T) {
+	for _, test := range captures {
+		code, err := DecodeAllOne(test.capture)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if code != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, code, test.want)
+		}
+	}
+}
@@ -0,0 +1,316 @@
+package ircode
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// LIRC (the Linux IR daemon) describes remotes in lircd.conf files. A remote is either raw (every button is a list of
+// timings, like what the AllOne learns) or protocol defined (the remote says how bits are sent, and every button is a
+// number). Both look something like this:
+//
+//	begin remote
+//	  name  LG_TV
+//	  bits  16
+//	  flags SPACE_ENC|CONST_LENGTH
+//	  header 9000 4500
+//	  one 560 1690
+//	  zero 560 560
+//	  ptrail 560
+//	  pre_data_bits 16
+//	  pre_data 0x20DF
+//	  begin codes
+//	    KEY_POWER 0x10EF
+//	  end codes
+//	end remote
+//
+// We understand SPACE_ENC remotes (NEC, Samsung, Sony and friends), RC5 and RC6 (Manchester coded, or SHIFT_ENC as LIRC calls
+// it), and raw remotes. Anything else is reported, rather than guessed at
+
+// LIRCRemote is one remote from a LIRC config file
+type LIRCRemote struct {
+	Name      string
+	Frequency int // In Hz. 0 if the file doesn't say
+	Buttons   []LIRCButton
+	Errors    []string // Buttons we couldn't convert, and why
+}
+
+// LIRCButton is one button on a LIRC remote
+type LIRCButton struct {
+	Name    string
+	Timings Timings
+	Code    string // The timings as an AllOne code
+}
+
+// lircRemote is everything a remote says about itself, while we're reading it
+type lircRemote struct {
+	name      string
+	flags     map[string]bool
+	bits      int
+	frequency int
+	values    map[string][]uint64 // header, one, zero, ptrail, plead, pre, post, foot, pre_data, pre_data_bits, etc.
+	codes     [][2]string         // Button name, code
+	raw       []LIRCButton
+}
+
+// ParseLIRC reads every remote in a LIRC config file. Remotes we can't make any sense of are still returned, with their
+// errors, so whoever's importing them can see what went wrong
+func ParseLIRC(reader io.Reader) ([]LIRCRemote, error) {
+	var remotes []LIRCRemote
+	var remote *lircRemote
+	section := "" // "codes" or "raw_codes", if we're in one
+	var button *LIRCButton
+
+	lines := bufio.NewScanner(reader)
+	lines.Buffer(make([]byte, 64*1024), 1024*1024) // Raw codes can be long
+	number := 0
+	for lines.Scan() {
+		number++
+		line := lines.Text()
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		keyword := strings.ToLower(fields[0])
+
+		switch {
+		case keyword == "begin" && len(fields) > 1 && fields[1] == "remote":
+			remote = &lircRemote{flags: make(map[string]bool), values: make(map[string][]uint64)}
+		case remote == nil:
+			return remotes, fmt.Errorf("Line %d: %s is outside of a remote", number, fields[0])
+		case keyword == "end" && len(fields) > 1 && fields[1] == "remote":
+			remotes = append(remotes, remote.convert())
+			remote = nil
+		case keyword == "begin" && len(fields) > 1:
+			section = fields[1]
+		case keyword == "end" && len(fields) > 1:
+			if button != nil {
+				remote.raw = append(remote.raw, *button)
+				button = nil
+			}
+			section = ""
+		case section == "codes":
+			if len(fields) > 1 {
+				remote.codes = append(remote.codes, [2]string{fields[0], fields[1]}) // Some buttons send more than one code. We only send the first
+			}
+		case section == "raw_codes" && keyword == "name":
+			if button != nil {
+				remote.raw = append(remote.raw, *button)
+			}
+			button = &LIRCButton{Name: strings.Join(fields[1:], " ")}
+		case section == "raw_codes":
+			if button == nil {
+				return remotes, fmt.Errorf("Line %d: timings before a button name", number)
+			}
+			for _, field := range fields {
+				timing, err := strconv.Atoi(field)
+				if err != nil {
+					return remotes, fmt.Errorf("Line %d: %s isn't a timing", number, field)
+				}
+				button.Timings = append(button.Timings, timing)
+			}
+		case keyword == "name":
+			remote.name = strings.Join(fields[1:], " ")
+		case keyword == "flags" && len(fields) > 1:
+			for _, flag := range strings.Split(fields[1], "|") {
+				remote.flags[strings.ToUpper(flag)] = true
+			}
+		case keyword == "bits" && len(fields) > 1:
+			remote.bits, _ = strconv.Atoi(fields[1])
+		case keyword == "frequency" && len(fields) > 1:
+			remote.frequency, _ = strconv.Atoi(fields[1])
+		default:
+			for _, field := range fields[1:] {
+				value, err := strconv.ParseUint(field, 0, 64)
+				if err != nil {
+					break // Not a number, so not something we use
+				}
+				remote.values[keyword] = append(remote.values[keyword], value)
+			}
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return remotes, err
+	}
+	if remote != nil {
+		return remotes, fmt.Errorf("The file ended in the middle of remote %s", remote.name)
+	}
+	return remotes, nil
+}
+
+// convert turns the remote's buttons into timings
+func (r *lircRemote) convert() LIRCRemote {
+	remote := LIRCRemote{Name: r.name, Frequency: r.frequency}
+	if remote.Name == "" {
+		remote.Name = "LIRC remote"
+	}
+
+	if r.flags["RAW_CODES"] || len(r.raw) > 0 {
+		for _, button := range r.raw {
+			if len(button.Timings) == 0 {
+				remote.Errors = append(remote.Errors, button.Name+": no timings")
+				continue
+			}
+			if len(button.Timings)%2 == 0 { // Ends in a space, which is just silence
+				button.Timings = button.Timings[:len(button.Timings)-1]
+			}
+			remote.add(button)
+		}
+		return remote
+	}
+
+	for _, code := range r.codes {
+		value, err := strconv.ParseUint(code[1], 0, 64)
+		if err != nil {
+			remote.Errors = append(remote.Errors, fmt.Sprintf("%s: %s isn't a code", code[0], code[1]))
+			continue
+		}
+		timings, err := r.encode(value)
+		if err != nil {
+			remote.Errors = append(remote.Errors, fmt.Sprintf("%s: %s", code[0], err))
+			continue
+		}
+		remote.add(LIRCButton{Name: code[0], Timings: timings})
+	}
+	return remote
+}
+
+// add adds a button, if it'll fit in an AllOne code. If not, it's an error, so it's not shown as something we'll import
+func (r *LIRCRemote) add(button LIRCButton) {
+	code, err := FormatAllOne(button.Timings)
+	if err != nil {
+		r.Errors = append(r.Errors, fmt.Sprintf("%s: %s", button.Name, err))
+		return
+	}
+	button.Code = code
+	r.Buttons = append(r.Buttons, button)
+}
+
+// lircSignal builds up timings, joining pulses (or spaces) that end up next to each other, which happens a lot with
+// Manchester coding
+type lircSignal struct {
+	timings Timings
+}
+
+func (s *lircSignal) add(pulse bool, duration int) {
+	if duration <= 0 {
+		return
+	}
+	if len(s.timings) == 0 && !pulse {
+		return // Nothing to see before the first pulse
+	}
+	if (len(s.timings)%2 == 1) == pulse { // Same as the last one, so make it longer
+		s.timings[len(s.timings)-1] += duration
+		return
+	}
+	s.timings = append(s.timings, duration)
+}
+
+// pair adds a pulse and space (or space and pulse) from one of the remote's settings, e.g. "header 9000 4500"
+func (s *lircSignal) pair(values []uint64, pulseFirst bool) {
+	if len(values) < 2 {
+		return
+	}
+	s.add(pulseFirst, int(values[0]))
+	s.add(!pulseFirst, int(values[1]))
+}
+
+// encode works out the timings for a code on a protocol defined remote. This follows the order LIRC sends things in
+func (r *lircRemote) encode(code uint64) (Timings, error) {
+	var encoding string
+	switch {
+	case r.flags["RC5"], r.flags["SHIFT_ENC"]:
+		encoding = "RC5"
+	case r.flags["RC6"]:
+		encoding = "RC6"
+	case r.flags["SPACE_ENC"], len(r.flags) == 0 || r.flags["CONST_LENGTH"] && len(r.flags) == 1:
+		encoding = "SPACE_ENC"
+	default:
+		var flags []string
+		for flag := range r.flags {
+			flags = append(flags, flag)
+		}
+		return nil, fmt.Errorf("We don't know how to send %s remotes", strings.Join(flags, "|"))
+	}
+	if len(r.values["one"]) < 2 || len(r.values["zero"]) < 2 || r.bits <= 0 || r.bits > 64 {
+		return nil, fmt.Errorf("This remote doesn't say how to send its bits")
+	}
+	for _, name := range []string{"pre_data_bits", "post_data_bits"} { // These go in a uint64 too
+		if r.value(name) > 64 {
+			return nil, fmt.Errorf("%s is %d, and it can't be more than 64", name, r.value(name))
+		}
+	}
+
+	var signal lircSignal
+	signal.pair(r.values["header"], true)
+	if plead := r.value("plead"); plead > 0 {
+		signal.add(true, int(plead))
+	}
+
+	bit := 0 // Which bit of the whole frame we're up to, for RC6's double length toggle bit
+	sendBits := func(value uint64, bits int) {
+		for i := 0; i < bits; i++ {
+			shift := uint(bits - 1 - i) // Most significant first, unless the remote says otherwise
+			if r.flags["REVERSE"] {
+				shift = uint(i)
+			}
+			one := value&(1<<shift) != 0
+			double := uint64(1)
+			if encoding == "RC6" && r.value("rc6_mask")&(1<<uint(r.totalBits()-1-bit)) != 0 {
+				double = 2
+			}
+			timing := r.values["zero"]
+			if one {
+				timing = r.values["one"]
+			}
+			timing = []uint64{timing[0] * double, timing[1] * double}
+
+			switch encoding {
+			case "SPACE_ENC":
+				signal.pair(timing, true)
+			case "RC5": // 1 is a space, then a pulse
+				signal.pair(timing, !one)
+			case "RC6": // 1 is a pulse, then a space
+				signal.pair(timing, one)
+			}
+			bit++
+		}
+	}
+
+	sendBits(r.value("pre_data"), int(r.value("pre_data_bits")))
+	signal.pair(r.values["pre"], true)
+	sendBits(code, r.bits)
+	signal.pair(r.values["post"], true)
+	sendBits(r.value("post_data"), int(r.value("post_data_bits")))
+	if ptrail := r.value("ptrail"); ptrail > 0 {
+		signal.add(true, int(ptrail))
+	}
+
+	timings := signal.timings
+	if len(timings)%2 == 0 && len(timings) > 0 { // Ends in a space, which is just silence
+		timings = timings[:len(timings)-1]
+	}
+	if len(timings) == 0 {
+		return nil, fmt.Errorf("Nothing to send")
+	}
+	return timings, nil
+}
+
+// value is the first number given for a setting, or 0 if it wasn't given
+func (r *lircRemote) value(name string) uint64 {
+	if len(r.values[name]) == 0 {
+		return 0
+	}
+	return r.values[name][0]
+}
+
+// totalBits is how many bits are in a whole frame. LIRC's rc6_mask counts from the end of the frame
+func (r *lircRemote) totalBits() int {
+	return int(r.value("pre_data_bits")) + r.bits + int(r.value("post_data_bits"))
+}
@@ -0,0 +1,152 @@
+package ircode
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// The LG remote from the top of lirc.go, as a SPACE_ENC (NEC) remote. KEY_POWER is the same button as lgPower in pronto_test.go
+const lircLG = `
+# An LG TV remote
+begin remote
+  name  LG_TV
+  bits  16
+  flags SPACE_ENC|CONST_LENGTH
+  eps            30
+  aeps          100
+  header 9000 4500
+  one 560 1690
+  zero 560 560
+  ptrail 560
+  pre_data_bits 16
+  pre_data 0x20DF
+  gap 108000
+  frequency 38000
+  begin codes
+    KEY_POWER   0x10EF
+    KEY_MUTE    0x906F
+  end codes
+end remote
+`
+
+// A Philips RC5 remote, the way LIRC usually describes one. plead is the first half of the first start bit
+const lircRC5 = `
+begin remote
+  name  Philips_TV
+  bits  13
+  flags RC5|CONST_LENGTH
+  one   889 889
+  zero  889 889
+  plead 889
+  gap   113792
+  begin codes
+    KEY_POWER 0x100C
+  end codes
+end remote
+`
+
+// lircRaw makes a raw remote, the way irrecord writes one when it can't work out the protocol
+func lircRaw(buttons map[string]Timings) string {
+	text := "begin remote\n  name raw_remote\n  flags RAW_CODES\n  eps 30\n  begin raw_codes\n"
+	for name, timings := range buttons {
+		text += "    name " + name + "\n"
+		for i, timing := range timings {
+			text += fmt.Sprintf(" %7d", timing)
+			if i%6 == 5 {
+				text += "\n"
+			}
+		}
+		text += "\n"
+	}
+	return text + "  end raw_codes\nend remote\n"
+}
+
+func TestParseLIRC(t *testing.T) {
+	power, err := Encode(Code{Protocol: "NEC", Address: 0x04, Command: 0x08}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name      string
+		text      string
+		remote    string
+		frequency int
+		buttons   map[string]Code
+	}{
+		{"NEC", lircLG, "LG_TV", 38000, map[string]Code{
+			"KEY_POWER": {Protocol: "NEC", Address: 0x04, Command: 0x08},
+			"KEY_MUTE":  {Protocol: "NEC", Address: 0x04, Command: 0x09},
+		}},
+		{"RC5", lircRC5, "Philips_TV", 0, map[string]Code{
+			"KEY_POWER": {Protocol: "RC5", Address: 0x00, Command: 0x0c},
+		}},
+		{"raw", lircRaw(map[string]Timings{"KEY_POWER": append(power, 40000)}), "raw_remote", 0, map[string]Code{
+			"KEY_POWER": {Protocol: "NEC", Address: 0x04, Command: 0x08},
+		}},
+	} {
+		remotes, err := ParseLIRC(strings.NewReader(test.text))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(remotes) != 1 {
+			t.Errorf("%s: got %d remotes, want 1", test.name, len(remotes))
+			continue
+		}
+		remote := remotes[0]
+		if remote.Name != test.remote || remote.Frequency != test.frequency || len(remote.Errors) > 0 {
+			t.Errorf("%s: got %s at %dHz (%v), want %s at %dHz", test.name, remote.Name, remote.Frequency, remote.Errors, test.remote, test.frequency)
+		}
+		if len(remote.Buttons) != len(test.buttons) {
+			t.Errorf("%s: got %d buttons, want %d", test.name, len(remote.Buttons), len(test.buttons))
+		}
+
+		for _, button := range remote.Buttons {
+			code, err := DecodeAllOne(button.Code)
+			if err != nil {
+				t.Errorf("%s %s: Decode failed: %s", test.name, button.Name, err)
+				continue
+			}
+			if code != test.buttons[button.Name] {
+				t.Errorf("%s %s: got %s, want %s", test.name, button.Name, code, test.buttons[button.Name])
+			}
+		}
+	}
+}
+
+// Buttons that can't be sent should be in Errors, not Buttons, so nobody's told they'll be imported
+func TestParseLIRCErrors(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		text string
+	}{
+		{"huge pre_data_bits", strings.Replace(lircLG, "pre_data_bits 16", "pre_data_bits 4000000000", 1)},
+		{"huge post_data_bits", strings.Replace(lircLG, "pre_data_bits 16", "post_data_bits 65", 1)},
+		{"no bits", strings.Replace(lircLG, "bits  16", "bits  0", 1)},
+		{"unknown flags", strings.Replace(lircLG, "SPACE_ENC|CONST_LENGTH", "RCMM", 1)},
+		{"timing too long", lircRaw(map[string]Timings{"KEY_POWER": {9000, 70000, 560}})},
+		{"code too long", lircRaw(map[string]Timings{"KEY_POWER": make(Timings, maxAllOneTimings+1)})},
+	} {
+		remotes, err := ParseLIRC(strings.NewReader(test.text))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if len(remotes) != 1 || len(remotes[0].Buttons) != 0 || len(remotes[0].Errors) == 0 {
+			t.Errorf("%s: got %d buttons and errors %v, want no buttons and an error for each", test.name, len(remotes[0].Buttons), remotes[0].Errors)
+		}
+	}
+
+	for _, text := range []string{
+		"name outside_a_remote",
+		"begin remote\n  name unfinished\n",
+		"begin remote\n  begin raw_codes\n  9000 4500\n",
+		"begin remote\n  begin raw_codes\n  name KEY_POWER\n  9000 lots\n",
+	} {
+		if _, err := ParseLIRC(strings.NewReader(text)); err == nil {
+			t.Errorf("%q should have failed", text)
+		}
+	}
+}
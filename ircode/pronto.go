@@ -0,0 +1,122 @@
+package ircode
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Pronto hex is what most IR code databases (and a lot of universal remotes) use. It's a list of 4 digit hex words:
+//
+//	0000 <frequency> <once pairs> <repeat pairs> <pulse> <space> <pulse> <space> ...
+//
+// The first word is the format (0000 means raw timings, which is the only kind we understand). The frequency word is the
+// length of one carrier cycle in units of 0.241246us. Next is how many pulse / space pairs are sent once, then how many are
+// sent over and over while the button is held. The timings themselves are counted in carrier cycles.
+//
+// The AllOne doesn't say what carrier it uses, so whoever exports a code has to say which frequency to mark it with. Codes
+// that came from Pronto or LIRC know theirs. Learned ones don't, so they get DefaultFrequency. When importing, we take the
+// "once" part of the code, or the repeat part if there's nothing to send once
+
+// DefaultFrequency is the carrier frequency (in Hz) nearly everything uses. It's our best guess for codes the AllOne learned
+const DefaultFrequency = 38000
+
+// One unit of the Pronto frequency word, in microseconds
+const prontoClock = 0.241246
+
+// How long a space we put at the end of exported codes, because Pronto codes have to end with a space. Anything after the
+// last pulse is silence anyway
+const prontoTrailingSpace = 40000
+
+// ParsePronto turns a Pronto hex code into timings. It also returns the carrier frequency, in Hz
+func ParsePronto(pronto string) (Timings, int, error) {
+	words := strings.Fields(pronto)
+	if len(words) < 4 {
+		return nil, 0, fmt.Errorf("Too short to be a Pronto code")
+	}
+
+	var values []int
+	for _, word := range words {
+		value, err := strconv.ParseUint(word, 16, 16)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s isn't a Pronto hex word", word)
+		}
+		values = append(values, int(value))
+	}
+
+	if values[0] != 0 {
+		return nil, 0, fmt.Errorf("Only raw (0000) Pronto codes are supported, not %04X", values[0])
+	}
+	if values[1] == 0 {
+		return nil, 0, fmt.Errorf("This Pronto code doesn't have a frequency")
+	}
+	once, repeat := values[2], values[3]
+	if len(values) != 4+(once+repeat)*2 {
+		return nil, 0, fmt.Errorf("This Pronto code should have %d timings, but has %d", (once+repeat)*2, len(values)-4)
+	}
+
+	period := float64(values[1]) * prontoClock // How long one carrier cycle is, in microseconds
+	burst := values[4 : 4+once*2]
+	if once == 0 {
+		burst = values[4:]
+	}
+	if len(burst) == 0 {
+		return nil, 0, fmt.Errorf("This Pronto code doesn't have any timings")
+	}
+
+	var timings Timings
+	for _, cycles := range burst {
+		timings = append(timings, int(float64(cycles)*period+0.5))
+	}
+	return timings[:len(timings)-1], int(1000000/period + 0.5), nil // The last space is just silence, so it can go
+}
+
+// FormatPronto turns timings into a Pronto hex code, with the given carrier frequency (in Hz). Everything goes in the "once" part
+func FormatPronto(timings Timings, frequency int) (string, error) {
+	if len(timings) == 0 {
+		return "", fmt.Errorf("There's nothing in this code")
+	}
+	if frequency <= 0 {
+		return "", fmt.Errorf("A Pronto code needs a carrier frequency, not %dHz", frequency)
+	}
+
+	timings = append(Timings(nil), timings...)
+	if len(timings)%2 != 0 {
+		timings = append(timings, prontoTrailingSpace)
+	}
+
+	word := int(1000000/(float64(frequency)*prontoClock) + 0.5)
+	period := float64(word) * prontoClock
+	words := []string{"0000", fmt.Sprintf("%04X", word), fmt.Sprintf("%04X", len(timings)/2), "0000"}
+	for _, timing := range timings {
+		cycles := int(float64(timing)/period + 0.5)
+		if cycles < 1 {
+			cycles = 1
+		}
+		if cycles > 0xffff {
+			cycles = 0xffff
+		}
+		words = append(words, fmt.Sprintf("%04X", cycles))
+	}
+	return strings.Join(words, " "), nil
+}
+
+// ProntoToAllOne turns a Pronto code into an AllOne code. It also returns the carrier frequency (in Hz), so it can be kept
+// for when the code is exported again
+func ProntoToAllOne(pronto string) (string, int, error) {
+	timings, frequency, err := ParsePronto(pronto)
+	if err != nil {
+		return "", 0, err
+	}
+	hex, err := FormatAllOne(timings)
+	return hex, frequency, err
+}
+
+// AllOneToPronto turns an AllOne code into a Pronto code, marked with the given carrier frequency (in Hz)
+func AllOneToPronto(code string, frequency int) (string, error) {
+	timings, err := ParseAllOne(code)
+	if err != nil {
+		return "", err
+	}
+	return FormatPronto(timings, frequency)
+}
@@ -0,0 +1,122 @@
+package ircode
+
+import (
+	"testing"
+)
+
+// Codes in the form the code databases (e.g. Remote Central) publish them
+const (
+	// LG TV power, NEC 0x20DF10EF. Sent once, then the NEC "still held down" frame as the repeat part. 006D is 38kHz
+	lgPower = "0000 006D 0022 0002 0157 00AB 0015 0016 0015 0016 0015 0040 0015 0016 0015 0016 0015 0016 0015 0016 0015 0016 " +
+		"0015 0040 0015 0040 0015 0016 0015 0040 0015 0040 0015 0040 0015 0040 0015 0040 0015 0016 0015 0016 0015 0016 0015 0040 " +
+		"0015 0016 0015 0016 0015 0016 0015 0016 0015 0040 0015 0040 0015 0040 0015 0016 0015 0040 0015 0040 0015 0040 0015 0040 " +
+		"0015 05ED 0157 0055 0015 0E47"
+
+	// Sony TV power, which is all repeat part (Sony remotes send the frame over and over). 0067 is 40kHz
+	sonyPower = "0000 0067 0000 000D 0060 0018 0030 0018 0018 0018 0030 0018 0018 0018 0030 0018 0018 0018 0018 0018 0030 0018 " +
+		"0018 0018 0018 0018 0018 0018 0018 03F6"
+)
+
+func TestParsePronto(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		pronto    string
+		frequency int
+		code      Code
+	}{
+		{"LG power", lgPower, 38029, Code{Protocol: "NEC", Address: 0x04, Command: 0x08}},
+		{"Sony power", sonyPower, 40244, Code{Protocol: "Sony12", Address: 0x01, Command: 0x15}},
+	} {
+		timings, frequency, err := ParsePronto(test.pronto)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if frequency != test.frequency {
+			t.Errorf("%s: got %dHz, want %dHz", test.name, frequency, test.frequency)
+		}
+		code, err := Decode(timings)
+		if err != nil {
+			t.Errorf("%s: Decode failed: %s", test.name, err)
+			continue
+		}
+		if code != test.code {
+			t.Errorf("%s: got %s, want %s", test.name, code, test.code)
+		}
+	}
+}
+
+// Only the "once" part of the LG code should be used. The repeat frame would just be an extra press
+func TestParseProntoOnce(t *testing.T) {
+	timings, _, err := ParsePronto(lgPower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(timings) != 0x22*2-1 {
+		t.Errorf("Got %d timings, want %d", len(timings), 0x22*2-1)
+	}
+}
+
+// Exporting a code and importing it again should keep both the button and the frequency we asked for
+func TestFormatPronto(t *testing.T) {
+	timings, _, err := ParsePronto(sonyPower)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, frequency := range []int{36000, 38000, 40000, 56000} {
+		pronto, err := FormatPronto(timings, frequency)
+		if err != nil {
+			t.Errorf("%dHz: %s", frequency, err)
+			continue
+		}
+		again, got, err := ParsePronto(pronto)
+		if err != nil {
+			t.Errorf("%dHz: couldn't read back %s: %s", frequency, pronto, err)
+			continue
+		}
+		if got < frequency*99/100 || got > frequency*101/100 {
+			t.Errorf("%dHz: came back as %dHz", frequency, got)
+		}
+		if code, err := Decode(again); err != nil || code != (Code{Protocol: "Sony12", Address: 0x01, Command: 0x15}) {
+			t.Errorf("%dHz: came back as %s (%v)", frequency, code, err)
+		}
+	}
+
+	if _, err := FormatPronto(timings, 0); err == nil {
+		t.Errorf("FormatPronto should want a frequency")
+	}
+}
+
+func TestProntoAllOne(t *testing.T) {
+	hex, frequency, err := ProntoToAllOne(sonyPower)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if frequency != 40244 {
+		t.Errorf("Got %dHz, want 40244Hz", frequency)
+	}
+	pronto, err := AllOneToPronto(hex, frequency)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pronto[:10] != "0000 0067 " {
+		t.Errorf("Exported as %s, want the 0067 (40kHz) frequency word back", pronto)
+	}
+}
+
+func TestParseProntoErrors(t *testing.T) {
+	for _, pronto := range []string{
+		"",
+		"0000 006D",
+		"0100 006D 0001 0000 0010 0010", // Not raw
+		"0000 0000 0001 0000 0010 0010", // No frequency
+		"0000 006D 0002 0000 0010 0010", // Too few timings
+		"0000 006D 0001 0000 0010 XXXX", // Not hex
+		"0000 006D 0000 0000",           // Nothing to send
+	} {
+		if _, _, err := ParsePronto(pronto); err == nil {
+			t.Errorf("%q should have failed", pronto)
+		}
+	}
+}
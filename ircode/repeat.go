@@ -0,0 +1,98 @@
+package ircode
+
+import "fmt"
+
+// Some buttons need holding down: volume keeps going up while it's held, and some projectors only turn off after a long
+// press. A remote does that by sending the code again and again, and Repeat does the same to a code we've already got
+// (learned, imported or made). Learned codes often have a few of the remote's own repeats on the end already, so we only keep
+// the first frame and repeat that. NEC remotes send a short "still held" frame instead of the whole code, so we do too.
+// Everything else sends the whole frame again, once per frame period, like Encode does
+
+// How often each protocol sends a frame while the button is held, in microseconds
+var repeatPeriods = map[string]int{
+	"NEC":     necFramePeriod,
+	"NECext":  necFramePeriod,
+	"Samsung": necFramePeriod,
+	"Sony12":  sonyFramePeriod,
+	"Sony15":  sonyFramePeriod,
+	"Sony20":  sonyFramePeriod,
+	"RC5":     rc5FramePeriod,
+	"RC6":     rc6FramePeriod,
+}
+
+// Protocols that leave a fixed gap between frames, rather than sending one every so often. Anything we don't recognise
+// gets defaultRepeatGap
+var repeatGaps = map[string]int{
+	"Panasonic": kaseikyoGap,
+	"Kaseikyo":  kaseikyoGap,
+	"Coolix":    coolixGap,
+}
+
+const defaultRepeatGap = 40000
+
+// firstFrame cuts a code down to its first frame, i.e. everything before the first long space
+func firstFrame(timings Timings) Timings {
+	for i := 1; i < len(timings); i += 2 { // Pulses and spaces take turns, so every second timing is a space
+		if timings[i] > gapAfterSignal {
+			return timings[:i]
+		}
+	}
+	return timings
+}
+
+// Repeat sends the first frame of a code repeats extra times, or as many times as it takes to hold the button down for hold microseconds,
+// whichever is more. spacing is the gap between repeats in microseconds, or 0 for whatever protocol normally uses. protocol
+// can be blank if we don't know what the code is. It's an error if the result won't fit in an AllOne packet
+func Repeat(timings Timings, protocol string, repeats int, spacing int, hold int) (Timings, error) {
+	if repeats < 0 || spacing < 0 || hold < 0 {
+		return nil, fmt.Errorf("Repeats, gaps and holds can't be negative")
+	}
+	if spacing != 0 && (spacing < gapAfterSignal || spacing > maxTiming) {
+		return nil, fmt.Errorf("The gap between repeats has to be between %dms and %dms", gapAfterSignal/1000, maxTiming/1000)
+	}
+
+	frame := append(Timings(nil), firstFrame(timings)...)
+	if len(frame)%2 == 0 && len(frame) > 0 { // A trailing space is just the end of the code, and we're about to add our own
+		frame = frame[:len(frame)-1]
+	}
+	if len(frame) == 0 {
+		return nil, fmt.Errorf("There's nothing in this code")
+	}
+
+	repeat := frame
+	if protocol == "NEC" || protocol == "NECext" {
+		repeat = Timings{necHeaderPulse, necRepeatSpace, necBitPulse}
+	}
+	space := func(previous Timings) int {
+		switch {
+		case spacing != 0:
+			return spacing
+		case repeatPeriods[protocol] != 0:
+			return gap(previous, repeatPeriods[protocol])
+		case repeatGaps[protocol] != 0:
+			return repeatGaps[protocol]
+		}
+		return defaultRepeatGap
+	}
+
+	result := append(Timings(nil), frame...)
+	previous := frame
+	for i := 0; i < repeats || Duration(result) < hold; i++ {
+		if len(result)+1+len(repeat) > maxAllOneTimings {
+			return nil, fmt.Errorf("That's more than %d repeats, which won't fit in an AllOne code", i)
+		}
+		result = append(result, space(previous))
+		result = append(result, repeat...)
+		previous = repeat
+	}
+	return result, nil
+}
+
+// Duration is how long some timings take to send, in microseconds
+func Duration(timings Timings) int {
+	total := 0
+	for _, timing := range timings {
+		total += timing
+	}
+	return total
+}
@@ -0,0 +1,112 @@
+package ircode
+
+import (
+	"testing"
+)
+
+// A learned code usually has some of the remote's own repeats on the end. Only the first frame should be repeated
+func TestRepeatFirstFrame(t *testing.T) {
+	nec := Code{Protocol: "NEC", Address: 0x04, Command: 0x08}
+	learned, err := Encode(nec, 2) // As if the button was held a little while it was learned
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, repeats := range []int{0, 1, 3} {
+		timings, err := Repeat(learned, "NEC", repeats, 0, 0)
+		if err != nil {
+			t.Errorf("%d repeats: %s", repeats, err)
+			continue
+		}
+		if want := 67 + repeats*4; len(timings) != want {
+			t.Errorf("%d repeats: got %d timings, want %d (one frame and %d repeat frames)", repeats, len(timings), want, repeats)
+		}
+		if code, err := Decode(timings); err != nil || code != nec {
+			t.Errorf("%d repeats: came out as %s (%v)", repeats, code, err)
+		}
+	}
+
+	// Anything that isn't NEC gets the whole frame again
+	sony := Code{Protocol: "Sony12", Address: 0x01, Command: 0x15}
+	learned, err = Encode(sony, 0) // Three frames, like a real Sony remote
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame := len(firstFrame(learned))
+	if frame != 2+12*2-1 {
+		t.Fatalf("Sony frame is %d timings, want %d", frame, 2+12*2-1)
+	}
+	timings, err := Repeat(learned, "Sony12", 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := 2*frame + 1; len(timings) != want {
+		t.Errorf("Got %d timings, want %d (two frames)", len(timings), want)
+	}
+}
+
+func TestRepeatHold(t *testing.T) {
+	timings, err := Encode(Code{Protocol: "Samsung", Address: 0x0707, Command: 0x02}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hold := range []int{0, 500000, 2000000} {
+		held, err := Repeat(timings, "Samsung", 0, 0, hold)
+		if err != nil {
+			t.Errorf("%dms: %s", hold/1000, err)
+			continue
+		}
+		if Duration(held) < hold {
+			t.Errorf("%dms: only held for %dms", hold/1000, Duration(held)/1000)
+		}
+		if Duration(held) > hold+necFramePeriod*2 {
+			t.Errorf("%dms: held for %dms, which is more than it needs", hold/1000, Duration(held)/1000)
+		}
+		if _, err := FormatAllOne(held); err != nil {
+			t.Errorf("%dms: %s", hold/1000, err)
+		}
+	}
+}
+
+// Repeats are limited by how much fits in an AllOne packet, not by a count
+func TestRepeatTooLong(t *testing.T) {
+	frame := firstFrame(Timings{necHeaderPulse, necHeaderSpace, necBitPulse})
+	fits := (maxAllOneTimings - len(frame)) / (len(frame) + 1)
+
+	timings, err := Repeat(frame, "", fits, 0, 0)
+	if err != nil {
+		t.Fatalf("%d repeats should fit: %s", fits, err)
+	}
+	if _, err := FormatAllOne(timings); err != nil {
+		t.Errorf("%d repeats: %s", fits, err)
+	}
+	if _, err := Repeat(frame, "", fits+1, 0, 0); err == nil {
+		t.Errorf("%d repeats shouldn't fit", fits+1)
+	}
+	if _, err := FormatAllOne(make(Timings, maxAllOneTimings+1)); err == nil {
+		t.Errorf("FormatAllOne should have refused %d timings", maxAllOneTimings+1)
+	}
+}
+
+func TestRepeatErrors(t *testing.T) {
+	frame := Timings{necHeaderPulse, necHeaderSpace, necBitPulse}
+	for _, test := range []struct {
+		name    string
+		timings Timings
+		repeats int
+		spacing int
+		hold    int
+	}{
+		{"negative repeats", frame, -1, 0, 0},
+		{"negative gap", frame, 1, -1, 0},
+		{"negative hold", frame, 0, 0, -1},
+		{"gap too short", frame, 1, gapAfterSignal - 1, 0},
+		{"gap too long", frame, 1, maxTiming + 1, 0},
+		{"nothing to send", nil, 1, 0, 0},
+	} {
+		if _, err := Repeat(test.timings, "", test.repeats, test.spacing, test.hold); err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
@@ -0,0 +1,551 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/Grayda/go-orvibo"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// The AllOne hands us learned codes as a blob of hex, which doesn't tell you much. The ircode package picks the timings out
+// of that hex and works out which remote control protocol made them, so we can show "NEC 0x04 / 0x08" next to a code and
+// spot when two codes are really the same button. Codes we don't recognise still work fine, we just can't say what they are
+
+// decodeIR works out what protocol a code is, and fills in Protocol, Address and Command. If we can't tell, they're left blank
+func decodeIR(ir *OrviboIRCode) {
+	code, err := ircode.DecodeAllOne(ir.Code)
+	if err != nil {
+		ir.Protocol, ir.Address, ir.Command = "", 0, 0
+		return
+	}
+	ir.Protocol, ir.Address, ir.Command = code.Protocol, code.Address, code.Command
+}
+
+// decodeCodes decodes any saved codes that haven't been decoded yet (e.g. ones learned with an older version of the driver)
+func decodeCodes(codes []OrviboIRCode) {
+	for i := range codes {
+		if codes[i].Protocol == "" {
+			decodeIR(&codes[i])
+		}
+	}
+}
+
+// describeIR describes what's in a code, e.g. "NEC 0x04 / 0x08". Codes we didn't recognise say why, which helps when
+// working out whether the AllOne learned it properly
+func describeIR(ir OrviboIRCode) string {
+	if ir.Protocol != "" {
+		return ircode.Code{Protocol: ir.Protocol, Address: ir.Address, Command: ir.Command}.String()
+	}
+
+	timings, err := ircode.ParseAllOne(ir.Code)
+	if err != nil {
+		return "unrecognised code"
+	}
+	if _, err = ircode.Decode(timings); err == ircode.ErrRepeat {
+		return "repeat frame only"
+	}
+	return fmt.Sprintf("unrecognised, %d timings", len(timings))
+}
+
+// sameButton finds another saved code that's the same protocol, address and command as this one, if there is one
+func sameButton(ir OrviboIRCode) *OrviboIRCode {
+	if ir.Protocol == "" {
+		return nil
+	}
+	for i, other := range driver.config.Codes {
+		if other.Code != ir.Code && other.Protocol == ir.Protocol && other.Address == ir.Address && other.Command == ir.Command {
+			return &driver.config.Codes[i]
+		}
+	}
+	return nil
+}
+
+// irSubtitle is what we show under a code's name on the "Saved IR / RF Codes" screen
+func irSubtitle(ir OrviboIRCode) string {
+	subtitle := describeIR(ir)
+	if other := sameButton(ir); other != nil {
+		subtitle += ", same button as " + other.Name
+	}
+	if repeats := describeRepeats(ir); repeats != "" {
+		subtitle += ", " + repeats
+	}
+	if ir.Description != "" {
+		subtitle = ir.Description + " (" + subtitle + ")"
+	}
+	return subtitle
+}
+
+// addIR saves a code that didn't come from learning (e.g. one we built from a protocol, or imported)
+func (d *OrviboDriver) addIR(ir OrviboIRCode) error {
+	if ir.Protocol == "" {
+		decodeIR(&ir)
+	}
+	d.config.Codes = append(d.config.Codes, ir)
+	return d.saveConfig()
+}
+
+// blastIR sends a code from an AllOne (or "ALL" of them), and counts and logs it. name is what the history calls it
+func blastIR(code string, allone string, source string, name string) {
+	fmt.Println("Blasting IR code " + code + " on AllOne: " + allone + "..")
+	orvibo.EmitIR(code, allone)
+	irBlasts.Inc(allone)
+	packetsSent.Inc("emitir")
+	logEvent("blastir", allone, source, name)
+}
+
+// irToSend works out what to blast for a saved code, with its repeat and hold options applied
+func irToSend(ir OrviboIRCode) (string, error) {
+	if ir.Repeats == 0 && ir.HoldFor == 0 {
+		return ir.Code, nil
+	}
+	timings, err := ircode.ParseAllOne(ir.Code)
+	if err != nil {
+		return "", err
+	}
+	if timings, err = ircode.Repeat(timings, ir.Protocol, ir.Repeats, ir.RepeatGap*1000, ir.HoldFor*1000); err != nil {
+		return "", err
+	}
+	return ircode.FormatAllOne(timings)
+}
+
+// blastCode blasts a saved code, with its repeat and hold options. Anything that blasts saved codes should come through here
+func blastCode(ir OrviboIRCode, source string) error {
+	code, err := irToSend(ir)
+	if err != nil {
+		return fmt.Errorf("Unable to repeat %s: %s", ir.Name, err)
+	}
+	blastIR(code, ir.AllOne, source, ir.Name)
+	return nil
+}
+
+// findIR finds a saved code by its code and AllOne, which is how the "Saved IR / RF Codes" screen tells us which one to use
+func findIR(code string, allone string) *OrviboIRCode {
+	for i, ir := range driver.config.Codes {
+		if ir.Code == code && ir.AllOne == allone {
+			return &driver.config.Codes[i]
+		}
+	}
+	return nil
+}
+
+// describeRepeats describes a code's repeat and hold options, e.g. "held for 2000ms". Blank if it doesn't have any
+func describeRepeats(ir OrviboIRCode) string {
+	var options []string
+	if ir.Repeats > 0 {
+		options = append(options, fmt.Sprintf("sent %d more times", ir.Repeats))
+	}
+	if ir.HoldFor > 0 {
+		options = append(options, fmt.Sprintf("held for %dms", ir.HoldFor))
+	}
+	if ir.RepeatGap > 0 && len(options) > 0 {
+		options = append(options, fmt.Sprintf("%dms apart", ir.RepeatGap))
+	}
+	return strings.Join(options, ", ")
+}
+
+// parseNumber reads an address or command, which can be decimal (8) or hex (0x08)
+func parseNumber(value string) (uint32, error) {
+	number, err := strconv.ParseUint(strings.TrimSpace(value), 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%s isn't a number", value)
+	}
+	return uint32(number), nil
+}
+
+// allOneOptions is a radio button for each of our AllOnes, plus one for all of them
+func allOneOptions() []suit.RadioGroupOption {
+	allones := []suit.RadioGroupOption{suit.RadioGroupOption{
+		Title:       "All Connected AllOnes",
+		Value:       "ALL",
+		DisplayIcon: "globe",
+	}}
+	for _, allone := range driver.devices() {
+		if allone.Device.DeviceType == orvibo.ALLONE {
+			allones = append(allones, suit.RadioGroupOption{
+				Title:       allone.Device.Name,
+				DisplayIcon: "play",
+				Value:       allone.Device.MACAddress,
+			})
+		}
+	}
+	return allones
+}
+
+// groupOptions is a radio button for each of our code groups
+func groupOptions() []suit.RadioGroupOption {
+	var groups []suit.RadioGroupOption
+	for _, codegroup := range driver.config.CodeGroups {
+		groups = append(groups, suit.RadioGroupOption{
+			Title:       codegroup.Name,
+			Value:       codegroup.Name,
+			DisplayIcon: "folder-open",
+		})
+	}
+	return groups
+}
+
+// Shows the UI for making a code from a protocol, address and command, for when the remote is long gone but the codes are
+// on the internet somewhere
+func (c *configService) newprotocol() (*suit.ConfigurationScreen, error) {
+	var protocols []suit.RadioGroupOption
+	for _, protocol := range ircode.Protocols {
+		protocols = append(protocols, suit.RadioGroupOption{
+			Title: protocol,
+			Value: protocol,
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "New IR Code From Protocol",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "If you know a button's protocol, address and command (code lists on the internet often have them), the driver can make the code without learning it. Addresses and commands can be decimal (8) or hex (0x08). Repeats sends the code again, as if the button was held down",
+					},
+					suit.InputText{
+						Name:        "name",
+						Before:      "Name for this code",
+						Placeholder: "TV On",
+					},
+					suit.InputText{
+						Name:        "description",
+						Before:      "Code Description",
+						Placeholder: "Living Room TV On",
+					},
+					suit.RadioGroup{
+						Title:   "Protocol",
+						Name:    "protocol",
+						Value:   "NEC",
+						Options: protocols,
+					},
+					suit.InputText{
+						Name:        "address",
+						Before:      "Address",
+						Placeholder: "0x04",
+					},
+					suit.InputText{
+						Name:        "command",
+						Before:      "Command",
+						Placeholder: "0x08",
+					},
+					suit.InputText{
+						Name:        "repeats",
+						Before:      "Repeats",
+						Placeholder: "0",
+					},
+					suit.RadioGroup{
+						Title:   "Select an AllOne to blast from",
+						Name:    "allone",
+						Options: allOneOptions(),
+					},
+					suit.RadioGroup{
+						Title:   "Select a group to add this code to",
+						Name:    "group",
+						Options: groupOptions(),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saveprotocol",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// saveprotocol builds the code from the "New IR Code From Protocol" screen and saves it
+func (c *configService) saveprotocol(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	if strings.TrimSpace(vals["name"]) == "" {
+		return c.error("Please give this code a name")
+	}
+	code := ircode.Code{Protocol: vals["protocol"]}
+	if code.Address, err = parseNumber(vals["address"]); err != nil {
+		return c.error("Invalid address: " + err.Error())
+	}
+	if code.Command, err = parseNumber(vals["command"]); err != nil {
+		return c.error("Invalid command: " + err.Error())
+	}
+	repeats := 0
+	if strings.TrimSpace(vals["repeats"]) != "" {
+		if repeats, err = strconv.Atoi(strings.TrimSpace(vals["repeats"])); err != nil {
+			return c.error(fmt.Sprintf("Invalid number of repeats: %s", vals["repeats"]))
+		}
+	}
+
+	hex, err := ircode.EncodeAllOne(code, repeats)
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	err = driver.addIR(OrviboIRCode{
+		Name:        strings.TrimSpace(vals["name"]),
+		Description: vals["description"],
+		Code:        hex,
+		AllOne:      vals["allone"],
+		Group:       vals["group"],
+		Protocol:    code.Protocol,
+		Address:     code.Address,
+		Command:     code.Command,
+	})
+	logEvent("config", vals["allone"], "labs", fmt.Sprintf("added IR code %s (%s)", vals["name"], code))
+	return c.list()
+}
+
+// ensureGroup makes a code group, unless there's already one with that name. Used when importing a whole remote at once.
+// Doesn't save the config, so the caller can add its codes first
+func (d *OrviboDriver) ensureGroup(name string, description string) {
+	for _, group := range d.config.CodeGroups {
+		if group.Name == name {
+			return
+		}
+	}
+	d.config.CodeGroups = append(d.config.CodeGroups, OrviboIRCodeGroup{
+		ID:          len(d.config.CodeGroups),
+		Name:        name,
+		Description: description,
+	})
+}
+
+// Shows all the ways of getting codes in and out of the driver, so they don't crowd the codes screen
+func (c *configService) importexport() (*suit.ConfigurationScreen, error) {
+	screen := suit.ConfigurationScreen{
+		Title: "Import / Export IR Codes",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Bring in codes from other remotes and blasters, or take yours somewhere else. The IR code library has codes for popular TVs, amplifiers and air conditioners. Pronto hex is what most code databases use, LIRC is what Linux boxes (like a Raspberry Pi) use, and Broadlink is for Broadlink RM blasters and Home Assistant. Code packs are for sharing one remote's codes with someone who has the same device",
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "IR Code Library",
+				Name:         "library",
+				DisplayClass: "success",
+				DisplayIcon:  "book",
+			},
+			suit.ReplyAction{
+				Label:        "Import Pronto Code",
+				Name:         "newpronto",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+			suit.ReplyAction{
+				Label:        "Export Pronto Codes",
+				Name:         "exportpronto",
+				DisplayClass: "default",
+				DisplayIcon:  "export",
+			},
+			suit.ReplyAction{
+				Label:        "Import LIRC Remotes",
+				Name:         "lirc",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+			suit.ReplyAction{
+				Label:        "Import Broadlink Codes",
+				Name:         "broadlink",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+			suit.ReplyAction{
+				Label:        "Export Broadlink Codes",
+				Name:         "exportbroadlink",
+				DisplayClass: "default",
+				DisplayIcon:  "export",
+			},
+			suit.ReplyAction{
+				Label:        "Import Code Pack",
+				Name:         "codepack",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+			suit.ReplyAction{
+				Label:        "Share a Remote",
+				Name:         "sharecodepack",
+				DisplayClass: "default",
+				DisplayIcon:  "share",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// repeats shows every saved code, so you can pick one to set up repeats or a long press for
+func (c *configService) repeats() (*suit.ConfigurationScreen, error) {
+	var codes []suit.ActionListOption
+	for _, ir := range driver.config.Codes {
+		subtitle := describeRepeats(ir)
+		if subtitle == "" {
+			subtitle = "Sent once"
+		}
+		codes = append(codes, suit.ActionListOption{
+			Title:    ir.Name,
+			Subtitle: subtitle,
+			Value:    ir.Code + "|" + ir.AllOne,
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Repeat & Hold",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Some buttons need holding down, like volume, or a projector that only turns off after a long press. Pick a code to choose how many times it gets sent, or how long it's held for. NEC codes send the short 'still held' frame, like the real remote does",
+					},
+					suit.ActionList{
+						Name:    "code",
+						Options: codes,
+						PrimaryAction: &suit.ReplyAction{
+							Name:        "coderepeats",
+							Label:       "Options",
+							DisplayIcon: "repeat",
+						},
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// coderepeats lets you set the repeat and hold options for one code
+func (c *configService) coderepeats(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	codes := strings.Split(vals["code"], "|")
+	if len(codes) < 2 || findIR(codes[0], codes[1]) == nil {
+		return c.error("Unable to find that code. Has it been deleted?")
+	}
+	ir := findIR(codes[0], codes[1])
+
+	screen := suit.ConfigurationScreen{
+		Title: ir.Name,
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Leave everything on 0 to send the code once. If you set both, it's repeated at least that many times and held for at least that long",
+					},
+					suit.InputHidden{Name: "code", Value: vals["code"]},
+					suit.InputText{
+						Name:      "repeats",
+						Before:    "Send it again",
+						After:     "more times",
+						InputType: "number",
+						Value:     strconv.Itoa(ir.Repeats),
+					},
+					suit.InputText{
+						Name:      "holdfor",
+						Before:    "Hold it down for",
+						After:     "ms",
+						InputType: "number",
+						Value:     strconv.Itoa(ir.HoldFor),
+					},
+					suit.InputText{
+						Name:      "repeatgap",
+						Before:    "Gap between repeats",
+						After:     "ms (0 for what the remote normally uses)",
+						InputType: "number",
+						Value:     strconv.Itoa(ir.RepeatGap),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "repeats",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "saverepeats",
+				DisplayClass: "success",
+				DisplayIcon:  "ok",
+			},
+		},
+	}
+	return &screen, nil
+}
+
+// saverepeats checks the options actually make a code we can send, then saves them
+func (c *configService) saverepeats(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	codes := strings.Split(vals["code"], "|")
+	if len(codes) < 2 || findIR(codes[0], codes[1]) == nil {
+		return c.error("Unable to find that code. Has it been deleted?")
+	}
+	ir := findIR(codes[0], codes[1])
+
+	updated := *ir
+	for name, value := range map[string]*int{"repeats": &updated.Repeats, "holdfor": &updated.HoldFor, "repeatgap": &updated.RepeatGap} {
+		text := strings.TrimSpace(vals[name])
+		if text == "" {
+			*value = 0
+			continue
+		}
+		if *value, err = strconv.Atoi(text); err != nil {
+			return c.error(fmt.Sprintf("%s isn't a number", vals[name]))
+		}
+	}
+	if _, err = irToSend(updated); err != nil {
+		return c.error(err.Error())
+	}
+
+	*ir = updated
+	driver.saveConfig()
+	return c.repeats()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// The Kepler is Orvibo's gas detector. go-orvibo finds, subscribes to and queries them just like sockets, and when the
+// alarm goes off (or stops) the Kepler pushes a state change, which go-orvibo hands us as "statechanged" with State set to
+// whether the alarm is sounding. The actual readings aren't pushed, so we ask each Kepler for them every so often.
+//
+// Nobody has tried any of this on a real Kepler. I don't have one, and I haven't seen a packet capture of one either, so
+// the status layout below is a guess, and so is the product code (KEP001) our simulator uses. Whether go-orvibo really sends
+// "keplerfound" for them is untested too. The "simulate" command (see simulator.go) pretends to be a Kepler using the
+// same guesses, so it only shows the rest of the driver hangs together. It can't show the guesses are right.
+//
+// A gas alarm you can't trust is worse than none, so all of this is off unless KeplerSupport is set in the config. Even
+// then, the Kepler's own siren is what keeps you safe, not the Sphere. If you have one, a capture of it answering a status
+// request (and of its discovery answer) is all it'd take to check. The offsets are all in one place. We expect a status
+// answer to look like this:
+//
+//	6864 <length> 6473 <MAC> <padding> <gas (2 bytes)> <carbon monoxide (2 bytes)> <alarm>
+//
+// (see readStatus in tables.go)
+//
+// Gas is in % of the lower explosive limit, carbon monoxide is in ppm, and both are little endian
+
+// Where we think things live in a status answer (after the 18 byte header). Unverified, see above
+const (
+	keplerGasOffset   = 18
+	keplerCOOffset    = 20
+	keplerAlarmOffset = 22
+)
+
+// How often we ask our Keplers for their readings
+const keplerPollInterval = 30 * time.Second
+
+// KeplerReading is what a Kepler told us the last time we asked
+type KeplerReading struct {
+	MACAddress     string
+	Name           string
+	Gas            int  // % of the lower explosive limit
+	CarbonMonoxide int  // ppm
+	Alarm          bool // Is it sounding?
+	Time           time.Time
+}
+
+// keplerChannel is a channel we send Kepler readings and alarms through. The Sphere doesn't have gas or alarm channels of its
+// own, so we make our own. The Sphere gives us somewhere to send events when we export it
+type keplerChannel struct {
+	protocol  string
+	sendEvent func(event string, payload interface{}) error
+}
+
+// Our latest readings, keyed by MAC address. Written by pollKeplers and theloop, read by whoever
+var keplerReadings = make(map[string]*KeplerReading)
+var keplerLock sync.Mutex
+
+func newKeplerChannel(protocol string) *keplerChannel {
+	return &keplerChannel{protocol: protocol}
+}
+
+// GetProtocol tells the Sphere what kind of channel this is
+func (c *keplerChannel) GetProtocol() string {
+	return c.protocol
+}
+
+// SetEventHandler is called by the Sphere when we export the channel
+func (c *keplerChannel) SetEventHandler(sendEvent func(event string, payload interface{}) error) {
+	c.sendEvent = sendEvent
+}
+
+// SendState sends a new state (a reading, or whether the alarm is on) to the Sphere
+func (c *keplerChannel) SendState(state interface{}) error {
+	if c.sendEvent == nil {
+		return nil
+	}
+	return c.sendEvent("state", state)
+}
+
+// keplerStatus asks a Kepler for its readings
+func keplerStatus(device *orvibo.Device) (KeplerReading, error) {
+	answer, err := readStatus(device)
+	if err != nil {
+		return KeplerReading{}, err
+	}
+
+	return parseKeplerStatus(answer, device.MACAddress)
+}
+
+// parseKeplerStatus pulls the readings out of a status answer
+func parseKeplerStatus(answer []byte, mac string) (KeplerReading, error) {
+	if len(answer) <= keplerAlarmOffset {
+		return KeplerReading{}, fmt.Errorf("Status from %s is too short", mac)
+	}
+
+	return KeplerReading{
+		MACAddress:     mac,
+		Gas:            int(binary.LittleEndian.Uint16(answer[keplerGasOffset : keplerGasOffset+2])),
+		CarbonMonoxide: int(binary.LittleEndian.Uint16(answer[keplerCOOffset : keplerCOOffset+2])),
+		Alarm:          answer[keplerAlarmOffset] != 0,
+		Time:           time.Now(),
+	}, nil
+}
+
+// keplerSupport tells us whether Kepler support has been turned on (see the top of this file)
+func keplerSupport() bool {
+	return driver.config.KeplerSupport
+}
+
+// pollKeplers asks each of our Keplers for their readings. Runs every keplerPollInterval
+func pollKeplers() {
+	if !keplerSupport() {
+		return
+	}
+	for _, device := range driver.devices() {
+		if device.Device.DeviceType != orvibo.KEPLER || !device.isOnline() {
+			continue
+		}
+
+		reading, err := keplerStatus(device.Device)
+		if err != nil {
+			fmt.Println("Unable to read Kepler", device.Device.MACAddress, ":", err)
+			continue
+		}
+		device.keplerReading(reading)
+	}
+}
+
+// keplerReading passes a new reading on to the Sphere. If the alarm has changed, that gets dealt with too
+func (d *OrviboDevice) keplerReading(reading KeplerReading) {
+	reading.Name = d.Device.Name
+
+	// Leave the alarm alone for now, so keplerAlarm can tell if it's changed
+	keplerLock.Lock()
+	latest, ok := keplerReadings[d.Device.MACAddress]
+	if !ok {
+		latest = &KeplerReading{MACAddress: d.Device.MACAddress}
+		keplerReadings[d.Device.MACAddress] = latest
+	}
+	latest.Name = reading.Name
+	latest.Gas = reading.Gas
+	latest.CarbonMonoxide = reading.CarbonMonoxide
+	latest.Time = reading.Time
+	keplerLock.Unlock()
+
+	d.gasChannel.SendState(reading)
+	d.keplerAlarm(reading.Alarm, "driver")
+}
+
+// keplerAlarm is called whenever we hear whether a Kepler's alarm is going off. If it's changed, everyone hears about it.
+// Alarms are sent to the Sphere as high priority events, because that's the whole point of owning one of these things
+func (d *OrviboDevice) keplerAlarm(alarm bool, source string) {
+	// go-orvibo has already updated d.Device.State by the time we hear about it, so we go by our last reading instead
+	keplerLock.Lock()
+	reading, seen := keplerReadings[d.Device.MACAddress]
+	if !seen {
+		reading = &KeplerReading{MACAddress: d.Device.MACAddress}
+		keplerReadings[d.Device.MACAddress] = reading
+	}
+	changed := reading.Alarm != alarm
+	reading.Alarm = alarm
+	reading.Name = d.Device.Name
+	details := *reading
+	keplerLock.Unlock()
+
+	if seen && !changed {
+		return
+	}
+
+	d.alarmChannel.SendState(alarm)
+	if !changed { // First time we've heard from it, and all's well
+		return
+	}
+
+	if alarm {
+		fmt.Println("GAS ALARM on", d.Device.Name, "(", d.Device.MACAddress, ")")
+		keplerAlarms.Inc(d.Device.MACAddress)
+		logEvent("alarm", d.Device.MACAddress, source, fmt.Sprintf("alarm! gas %d%% LEL, carbon monoxide %d ppm", details.Gas, details.CarbonMonoxide))
+	} else {
+		fmt.Println("Gas alarm cleared on", d.Device.Name, "(", d.Device.MACAddress, ")")
+		logEvent("alarm", d.Device.MACAddress, source, "cleared")
+	}
+
+	event := map[string]interface{}{
+		"priority": "high",
+		"alarm":    alarm,
+		"reading":  details,
+	}
+	if d.sendEvent != nil {
+		d.sendEvent("alarm", event)
+	}
+	driver.SendEvent("alarm", event)
+}
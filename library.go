@@ -0,0 +1,613 @@
+package main
+
+import (
+	"bufio"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// The IR code library is a list of code sets for popular TVs, amplifiers and air conditioners, built into the driver, so
+// most people never have to learn a code at all. Sets live in plain text files in the library directory, one file per
+// kind of device, which look like this:
+//
+//	[Samsung / TVs (most since 2008)]   Starts a set: brand, then model
+//	kind = tv                           What sort of thing it is
+//	protocol = Samsung                  The protocol and address for buttons that only give a command
+//	address = 0x0707
+//	notes = Anything worth knowing      Shown when the set is picked
+//	Power = 0x02                        A button: a command (see above), or "NEC 0x04 0x08", "pronto 0000 ..." or "allone <hex>"
+//
+// Anyone can add sets: drop a file like that in the LibraryDirectory (see libraryDirectory) and its sets show up next to
+// the built in ones, replacing any with the same brand and model. `./driver-orvibo library -file mine.txt` checks one.
+// Since you can't tell which of a brand's sets your TV speaks just by looking at it, the Labs let you blast a set's power
+// button first, and only import it (as a code pack, see codepack.go) once the TV turns off
+
+// The built in files are compiled into the driver, so they don't need to be shipped alongside it (package.json only ships
+// the binary) and work wherever the driver is started from
+//
+//go:embed library/*.txt
+var builtinLibrary embed.FS
+
+// defaultLibraryDirectory is where we look for extra library files, if LibraryDirectory isn't set. Like a relative
+// LibraryDirectory, it's next to the driver's binary, not wherever the driver was started from
+const defaultLibraryDirectory = "library"
+
+// librarySet is one set of codes in the library, e.g. "Samsung / TVs (most since 2008)"
+type librarySet struct {
+	Brand    string
+	Model    string
+	Kind     string
+	Notes    string `json:",omitempty"`
+	Protocol string `json:",omitempty"` // What buttons that only give a command are made with
+	Address  uint32 `json:",omitempty"`
+	File     string // Which file it came from, for when it needs fixing
+	Buttons  []OrviboCodePackCode
+}
+
+// ID is how we refer to a set in the UI and the API
+func (set librarySet) ID() string {
+	return set.Brand + " / " + set.Model
+}
+
+func init() {
+	mux.HandleFunc("/api/library", libraryAPI)
+}
+
+// libraryDirectory is where extra library files go
+func libraryDirectory() string {
+	directory := defaultLibraryDirectory
+	if driver != nil && driver.config != nil && driver.config.LibraryDirectory != "" {
+		directory = driver.config.LibraryDirectory
+	}
+	return besideBinary(directory)
+}
+
+// besideBinary makes a relative path relative to the driver's binary, rather than wherever the driver was started from
+func besideBinary(path string) string {
+	if filepath.IsAbs(path) {
+		return path
+	}
+	if binary, err := os.Executable(); err == nil {
+		return filepath.Join(filepath.Dir(binary), path)
+	}
+	return path
+}
+
+// parseLibrary reads one library file. file is only used in error messages
+func parseLibrary(reader io.Reader, file string) ([]librarySet, error) {
+	var sets []librarySet
+	var set *librarySet
+
+	lines := bufio.NewScanner(reader)
+	for number := 1; lines.Scan(); number++ {
+		line := strings.TrimSpace(lines.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			names := strings.SplitN(strings.Trim(line, "[]"), "/", 2)
+			if len(names) != 2 || strings.TrimSpace(names[0]) == "" || strings.TrimSpace(names[1]) == "" {
+				return nil, fmt.Errorf("%s:%d: sets start with [Brand / Model]", file, number)
+			}
+			sets = append(sets, librarySet{Brand: strings.TrimSpace(names[0]), Model: strings.TrimSpace(names[1]), File: file})
+			set = &sets[len(sets)-1]
+			continue
+		}
+
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected name = value", file, number)
+		}
+		if set == nil {
+			return nil, fmt.Errorf("%s:%d: this needs to be after a [Brand / Model] line", file, number)
+		}
+		name, value := strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1])
+
+		switch strings.ToLower(name) {
+		case "kind":
+			set.Kind = strings.ToLower(value)
+		case "notes":
+			set.Notes = value
+		case "protocol":
+			set.Protocol = value
+		case "address":
+			address, err := parseNumber(value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, number, err)
+			}
+			set.Address = address
+		default:
+			button, err := libraryButton(set, name, value)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %s", file, number, err)
+			}
+			set.Buttons = append(set.Buttons, button)
+		}
+	}
+	if err := lines.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, set := range sets {
+		if len(set.Buttons) == 0 {
+			return nil, fmt.Errorf("%s: %s doesn't have any buttons", file, set.ID())
+		}
+	}
+	return sets, nil
+}
+
+// libraryButton makes the code for one button in a set
+func libraryButton(set *librarySet, name string, value string) (OrviboCodePackCode, error) {
+	button := OrviboCodePackCode{Name: name}
+	fields := strings.Fields(value)
+	if len(fields) == 0 {
+		return button, fmt.Errorf("%s doesn't have a code", name)
+	}
+
+	switch {
+	case strings.EqualFold(fields[0], "pronto"):
+		hex, frequency, err := ircode.ProntoToAllOne(strings.Join(fields[1:], " "))
+		if err != nil {
+			return button, err
+		}
+		button.Code, button.Frequency = hex, frequency
+	case strings.EqualFold(fields[0], "allone") && len(fields) == 2:
+		if _, err := ircode.ParseAllOne(fields[1]); err != nil {
+			return button, err
+		}
+		button.Code = fields[1]
+	default:
+		code := ircode.Code{Protocol: set.Protocol, Address: set.Address}
+		var err error
+		if len(fields) == 3 { // Protocol, address and command, for a button that's different to the rest of the set
+			code.Protocol = fields[0]
+			if code.Address, err = parseNumber(fields[1]); err != nil {
+				return button, err
+			}
+			fields = fields[2:]
+		}
+		if len(fields) != 1 {
+			return button, fmt.Errorf("%s isn't a code we understand", value)
+		}
+		if code.Protocol == "" {
+			return button, fmt.Errorf("%s only gives a command, but the set doesn't say which protocol to use", name)
+		}
+		if code.Command, err = parseNumber(fields[0]); err != nil {
+			return button, err
+		}
+		if button.Code, err = ircode.EncodeAllOne(code, 0); err != nil {
+			return button, err
+		}
+		button.Protocol, button.Address, button.Command = code.Protocol, code.Address, code.Command
+	}
+	return button, nil
+}
+
+// loadLibrary reads the built in library, then any extra files in the library directory (plus extra, if it's given).
+// Sets are sorted by brand and model. A broken extra file is skipped, and the reason is returned as a problem
+func loadLibrary(extra ...string) ([]librarySet, []string) {
+	sets := make(map[string]librarySet)
+	var problems []string
+
+	builtin, _ := builtinLibrary.ReadDir("library")
+	for _, entry := range builtin {
+		f, err := builtinLibrary.Open("library/" + entry.Name())
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		found, err := parseLibrary(f, entry.Name())
+		f.Close()
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+		for _, set := range found {
+			sets[strings.ToLower(set.ID())] = set
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(libraryDirectory(), "*.txt"))
+	for _, file := range append(files, extra...) {
+		f, err := os.Open(file)
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		found, err := parseLibrary(f, file)
+		f.Close()
+		if err != nil {
+			problems = append(problems, err.Error())
+			continue
+		}
+		for _, set := range found {
+			sets[strings.ToLower(set.ID())] = set
+		}
+	}
+
+	var library []librarySet
+	for _, set := range sets {
+		library = append(library, set)
+	}
+	sort.Slice(library, func(i, j int) bool {
+		return strings.ToLower(library[i].ID()) < strings.ToLower(library[j].ID())
+	})
+	return library, problems
+}
+
+// searchLibrary finds the sets whose brand, model or kind have every word of query in them
+func searchLibrary(library []librarySet, query string) []librarySet {
+	var found []librarySet
+	for _, set := range library {
+		text := strings.ToLower(set.Brand + " " + set.Model + " " + set.Kind)
+		matches := true
+		for _, word := range strings.Fields(strings.ToLower(query)) {
+			matches = matches && strings.Contains(text, word)
+		}
+		if matches {
+			found = append(found, set)
+		}
+	}
+	return found
+}
+
+// findLibrarySet finds a set by its ID
+func findLibrarySet(library []librarySet, id string) (*librarySet, error) {
+	for i := range library {
+		if strings.EqualFold(library[i].ID(), id) {
+			return &library[i], nil
+		}
+	}
+	return nil, fmt.Errorf("There isn't a set called %s in the library", id)
+}
+
+// powerButton is the button we blast to see if a set is the right one. A toggle is best, but anything that turns the
+// device on or off will do
+func (set librarySet) powerButton() *OrviboCodePackCode {
+	for _, names := range [][]string{{"power"}, {"power toggle", "power on/off"}, {"power on", "on"}, {"power off", "off", "standby"}} {
+		for i, button := range set.Buttons {
+			for _, name := range names {
+				if strings.EqualFold(button.Name, name) {
+					return &set.Buttons[i]
+				}
+			}
+		}
+	}
+	for i, button := range set.Buttons {
+		if strings.HasPrefix(strings.ToLower(button.Name), "power") {
+			return &set.Buttons[i]
+		}
+	}
+	return nil
+}
+
+// pack turns a set into a code pack, which is how it gets imported
+func (set librarySet) pack() *OrviboCodePack {
+	description := set.Brand + " " + set.Model
+	if set.Notes != "" {
+		description += ". " + set.Notes
+	}
+	return &OrviboCodePack{
+		Format:      codePackFormat,
+		Version:     codePackVersion,
+		Driver:      info.Version,
+		Brand:       set.Brand,
+		Model:       set.Model,
+		Description: description,
+		Group:       set.Brand + " " + set.Model,
+		Codes:       set.Buttons,
+	}
+}
+
+// libraryAPI searches the library (GET, with ?search=), or imports a set (POST, with ?set=, ?allone= and optionally ?group=)
+func libraryAPI(w http.ResponseWriter, r *http.Request) {
+	library, _ := loadLibrary()
+
+	if r.Method == "POST" {
+		set, err := findLibrarySet(library, r.FormValue("set"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		added, skipped, err := importCodePack(set.pack(), r.FormValue("allone"), r.FormValue("group"), "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int{"Imported": added, "Skipped": skipped})
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(searchLibrary(library, r.FormValue("search")))
+}
+
+// Shows the library, or the sets that match a search
+func (c *configService) library(search string) (*suit.ConfigurationScreen, error) {
+	library, problems := loadLibrary()
+	found := searchLibrary(library, search)
+
+	contents := []suit.Typed{
+		suit.StaticText{
+			Title: "About this screen",
+			Value: "These are codes for popular TVs, amplifiers and air conditioners, so you don't have to learn them. Search for your brand, pick a set, and test its power button before importing it. Brands often have a few sets, so if one doesn't work, try the next",
+		},
+		suit.InputText{
+			Name:        "search",
+			Before:      "Search",
+			Placeholder: "samsung tv",
+			Value:       search,
+		},
+	}
+	for _, problem := range problems {
+		contents = append(contents, suit.Alert{
+			Title:        "Some of the library couldn't be read",
+			Subtitle:     problem,
+			DisplayClass: "warning",
+		})
+	}
+
+	if len(found) == 0 {
+		contents = append(contents, suit.StaticText{
+			Title: "Nothing found",
+			Value: "There's nothing in the library matching " + search,
+		})
+	} else {
+		var sets []suit.ActionListOption
+		for _, set := range found {
+			sets = append(sets, suit.ActionListOption{
+				Title:    set.ID(),
+				Subtitle: fmt.Sprintf("%s, %d buttons", set.Kind, len(set.Buttons)),
+				Value:    set.ID(),
+			})
+		}
+		contents = append(contents, suit.ActionList{
+			Name:    "set",
+			Options: sets,
+			PrimaryAction: &suit.ReplyAction{
+				Name:        "librarytest",
+				Label:       "Pick",
+				DisplayIcon: "ok",
+			},
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "IR Code Library",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "importexport",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Search",
+				Name:         "library",
+				DisplayClass: "success",
+				DisplayIcon:  "search",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// librarytest shows a set, and lets you test its power button or import it
+func (c *configService) librarytest(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	library, _ := loadLibrary()
+	set, err := findLibrarySet(library, vals["set"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+	return c.showLibrarySet(set, vals["allone"])
+}
+
+// showLibrarySet is the screen for one set. allone is picked, if we already know which one they want
+func (c *configService) showLibrarySet(set *librarySet, allone string) (*suit.ConfigurationScreen, error) {
+	if allone == "" {
+		allone = "ALL"
+	}
+	var buttons []string
+	for _, button := range set.Buttons {
+		buttons = append(buttons, button.Name)
+	}
+
+	contents := []suit.Typed{
+		suit.StaticText{
+			Title: "About this screen",
+			Value: "Point the AllOne at your device and click 'Test Power Button'. If it turns on or off, this is the right set, so import it",
+		},
+		suit.StaticText{
+			Title:    set.ID(),
+			Subtitle: set.Notes,
+			Value:    strings.Join(buttons, ", "),
+		},
+		suit.InputHidden{Name: "set", Value: set.ID()},
+		suit.InputHidden{Name: "search", Value: set.Brand},
+		suit.RadioGroup{
+			Title:   "Select an AllOne to blast from",
+			Name:    "allone",
+			Value:   allone,
+			Options: allOneOptions(),
+		},
+		suit.InputText{
+			Name:   "group",
+			Before: "Import into group",
+			Value:  set.Brand + " " + set.Model,
+		},
+	}
+
+	actions := []suit.Typed{
+		suit.ReplyAction{
+			Label:        "Back",
+			Name:         "library",
+			DisplayClass: "default",
+		},
+	}
+	if set.powerButton() != nil {
+		actions = append(actions, suit.ReplyAction{
+			Label:        "Test Power Button",
+			Name:         "librarypower",
+			DisplayClass: "warning",
+			DisplayIcon:  "off",
+		})
+	}
+	actions = append(actions, suit.ReplyAction{
+		Label:        "Import",
+		Name:         "savelibrary",
+		DisplayClass: "success",
+		DisplayIcon:  "import",
+	})
+
+	return &suit.ConfigurationScreen{
+		Title: "IR Code Library",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: actions,
+	}, nil
+}
+
+// librarypower blasts a set's power button, then asks whether it worked
+func (c *configService) librarypower(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	library, _ := loadLibrary()
+	set, err := findLibrarySet(library, vals["set"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+	power := set.powerButton()
+	if power == nil {
+		return c.error(set.ID() + " doesn't have a power button to test")
+	}
+	if vals["allone"] == "" {
+		vals["allone"] = "ALL"
+	}
+	test := OrviboIRCode{ // Through blastCode, so the button's repeats and hold go with it
+		Name:      "library test of " + set.ID() + " " + power.Name,
+		Code:      power.Code,
+		AllOne:    vals["allone"],
+		Protocol:  power.Protocol,
+		Repeats:   power.Repeats,
+		RepeatGap: power.RepeatGap,
+		HoldFor:   power.HoldFor,
+	}
+	if err := blastCode(test, "labs"); err != nil {
+		return c.error(err.Error())
+	}
+
+	return &suit.ConfigurationScreen{
+		Title: "Did It Work?",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: fmt.Sprintf("We just blasted '%s' from %s. Did your device turn on or off?", power.Name, set.ID()),
+					},
+					suit.InputHidden{Name: "set", Value: set.ID()},
+					suit.InputHidden{Name: "search", Value: set.Brand},
+					suit.InputHidden{Name: "allone", Value: vals["allone"]},
+					suit.InputHidden{Name: "group", Value: vals["group"]},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Try Again",
+				Name:         "librarypower",
+				DisplayClass: "default",
+				DisplayIcon:  "repeat",
+			},
+			suit.ReplyAction{
+				Label:        "No, Try the Next Set",
+				Name:         "librarynext",
+				DisplayClass: "warning",
+				DisplayIcon:  "forward",
+			},
+			suit.ReplyAction{
+				Label:        "Yes, Import It",
+				Name:         "savelibrary",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+		},
+	}, nil
+}
+
+// librarynext moves on to the brand's next set of the same kind, after one that didn't work. If there aren't any more, we
+// go back to the brand's sets
+func (c *configService) librarynext(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	library, _ := loadLibrary()
+	set, err := findLibrarySet(library, vals["set"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+	passed := false
+	for i, other := range library {
+		if passed && other.Brand == set.Brand && other.Kind == set.Kind {
+			return c.showLibrarySet(&library[i], vals["allone"])
+		}
+		passed = passed || other.ID() == set.ID()
+	}
+	return c.library(set.Brand)
+}
+
+// savelibrary imports a set as a code group
+func (c *configService) savelibrary(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	library, _ := loadLibrary()
+	set, err := findLibrarySet(library, vals["set"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+	added, skipped, err := importCodePack(set.pack(), vals["allone"], strings.TrimSpace(vals["group"]), "labs")
+	if err != nil {
+		return c.error(err.Error())
+	}
+	if skipped > 0 {
+		return c.confirm("IR Code Library", fmt.Sprintf("Imported %d codes. %d were skipped, because there was already a code with the same name in that group", added, skipped))
+	}
+	return c.list()
+}
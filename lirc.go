@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// LIRC is what Linux boxes (like a Raspberry Pi) use for IR, and there are lircd.conf files around for almost every remote
+// ever made. This file imports them: each remote becomes a code group, and each button becomes a code in it. Importing is
+// done in two steps, so you can see what's going to be added (and what couldn't be converted) before anything is saved.
+// See ircode/lirc.go for the parsing
+
+// LIRCPreview is what would be imported from a LIRC file. Used by /api/lirc and the CLI
+type LIRCPreview struct {
+	Group   string   // The remote's name, which becomes the group's name
+	Exists  bool     // Whether there's already a group with this name. New codes are added to it
+	Buttons []string // Button names
+	Errors  []string // Buttons we couldn't convert, and why
+}
+
+func init() {
+	mux.HandleFunc("/api/lirc", lircAPI)
+}
+
+// readLIRC parses a LIRC file, either from a path (on the Sphere) or from text that's been pasted in
+func readLIRC(file string, text string) ([]ircode.LIRCRemote, error) {
+	var reader io.Reader = strings.NewReader(text)
+	if strings.TrimSpace(file) != "" {
+		f, err := os.Open(strings.TrimSpace(file))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		reader = f
+	}
+
+	remotes, err := ircode.ParseLIRC(reader)
+	if err == nil && len(remotes) == 0 {
+		err = fmt.Errorf("There aren't any remotes in there")
+	}
+	return remotes, err
+}
+
+// previewLIRC works out what importLIRC would do, without doing it
+func previewLIRC(remotes []ircode.LIRCRemote) []LIRCPreview {
+	var previews []LIRCPreview
+	for _, remote := range remotes {
+		preview := LIRCPreview{Group: remote.Name, Errors: remote.Errors}
+		for _, group := range driver.config.CodeGroups {
+			if group.Name == remote.Name {
+				preview.Exists = true
+			}
+		}
+		for _, button := range remote.Buttons {
+			preview.Buttons = append(preview.Buttons, button.Name)
+		}
+		previews = append(previews, preview)
+	}
+	return previews
+}
+
+// importLIRC saves every button on every remote as an IR code, with a group for each remote. Returns how many codes were added
+func importLIRC(remotes []ircode.LIRCRemote, allone string, source string) (int, error) {
+	added := 0
+	for _, remote := range remotes {
+		if len(remote.Buttons) == 0 {
+			continue
+		}
+		driver.ensureGroup(remote.Name, "Imported from LIRC")
+		before := added
+
+		for _, button := range remote.Buttons { // Anything that couldn't be converted is in remote.Errors instead
+			ir := OrviboIRCode{
+				Name:      button.Name,
+				Code:      button.Code,
+				AllOne:    allone,
+				Group:     remote.Name,
+				Frequency: remote.Frequency, // The AllOne doesn't care, but it's kept for exporting as Pronto
+			}
+			decodeIR(&ir)
+			driver.config.Codes = append(driver.config.Codes, ir)
+			added++
+		}
+		logEvent("config", allone, source, fmt.Sprintf("imported %d codes from LIRC remote %s", added-before, remote.Name))
+	}
+
+	if added == 0 {
+		return 0, fmt.Errorf("None of the buttons could be converted")
+	}
+	return added, driver.saveConfig()
+}
+
+// lircAPI imports a LIRC file, sent as the body of a POST. ?allone= picks the AllOne to blast from, and ?preview=true
+// shows what would be imported without saving anything
+func lircAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "POST a lircd.conf file to import it", http.StatusMethodNotAllowed)
+		return
+	}
+
+	text, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	remotes, err := readLIRC("", string(text))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	previews := previewLIRC(remotes) // Work this out before importing, so Exists is right
+	if r.URL.Query().Get("preview") != "true" {
+		allone := r.URL.Query().Get("allone")
+		if allone == "" {
+			allone = "ALL"
+		}
+		if _, err = importLIRC(remotes, allone, "api"); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(previews)
+}
+
+// Shows the UI for picking a LIRC file to import
+func (c *configService) lirc() (*suit.ConfigurationScreen, error) {
+	screen := suit.ConfigurationScreen{
+		Title: "Import LIRC Remotes",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Import the remotes in a lircd.conf file. Each remote becomes a group, and each button becomes a code. Either enter where the file is on the Sphere, or paste the whole file in. You'll see what's going to be imported before anything is saved",
+					},
+					suit.InputText{
+						Name:        "file",
+						Before:      "File on the Sphere",
+						Placeholder: "/data/lircd.conf",
+					},
+					suit.InputText{
+						Name:        "config",
+						Before:      "Or paste the file here",
+						Placeholder: "begin remote ...",
+					},
+					suit.RadioGroup{
+						Title:   "Select an AllOne to blast from",
+						Name:    "allone",
+						Value:   "ALL",
+						Options: allOneOptions(),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Preview",
+				Name:         "previewlirc",
+				DisplayClass: "success",
+				DisplayIcon:  "eye-open",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// previewlirc shows what's in a LIRC file, and carries what we were given on to savelirc
+func (c *configService) previewlirc(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	remotes, err := readLIRC(vals["file"], vals["config"])
+	if err != nil {
+		return c.error(fmt.Sprintf("Unable to read LIRC file: %s", err))
+	}
+
+	contents := []suit.Typed{
+		suit.StaticText{
+			Title: "About this screen",
+			Value: "This is what will be imported. Click 'Import' to save it",
+		},
+		suit.InputHidden{Name: "file", Value: vals["file"]},
+		suit.InputHidden{Name: "config", Value: vals["config"]},
+		suit.InputHidden{Name: "allone", Value: vals["allone"]},
+	}
+	for _, preview := range previewLIRC(remotes) {
+		subtitle := fmt.Sprintf("%d buttons, into a new group", len(preview.Buttons))
+		if preview.Exists {
+			subtitle = fmt.Sprintf("%d buttons, added to the existing group", len(preview.Buttons))
+		}
+		contents = append(contents, suit.StaticText{
+			Title:    preview.Group,
+			Subtitle: subtitle,
+			Value:    strings.Join(preview.Buttons, ", "),
+		})
+		if len(preview.Errors) > 0 {
+			contents = append(contents, suit.Alert{
+				Title:        "Some buttons on " + preview.Group + " can't be imported",
+				Subtitle:     strings.Join(preview.Errors, ". "),
+				DisplayClass: "warning",
+			})
+		}
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Import LIRC Remotes",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Import",
+				Name:         "savelirc",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savelirc imports the LIRC file we previewed
+func (c *configService) savelirc(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	remotes, err := readLIRC(vals["file"], vals["config"])
+	if err != nil {
+		return c.error(fmt.Sprintf("Unable to read LIRC file: %s", err))
+	}
+	if _, err = importLIRC(remotes, vals["allone"], "labs"); err != nil {
+		return c.error(err.Error())
+	}
+	return c.list()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// Once a device is in driver.device, we used to think it was there forever, even if it'd been unplugged. This file keeps
+// track of when we last heard from each device. Every time we resubscribe (see schedule.go for how often that is) we ask
+// every device whose subscription is getting old to subscribe again, which renews it and gives it something to reply to.
+// Anything that renewed recently (say, by answering a state check from reconcile.go) has just proved it's alive, so it's
+// left alone. Anything we haven't
+// heard from in three resubscribes is marked offline. When an offline device pipes up again, we re-subscribe to it and let the Sphere know it's back
+
+// How long a device can go without talking to us before we decide it's gone. Three missed heartbeats seems fair
+func offlineAfter() time.Duration {
+	return nextResubscribeDelay() * 3
+}
+
+// Online and LastSeen are updated from theloop and read from the Labs, so they get a lock
+var livenessLock sync.Mutex
+
+// markSeen is called whenever we get a message from a device. If it was offline, it's back now
+func markSeen(d *OrviboDriver, info *orvibo.Device) {
+	device, ok := d.getDevice(info.ID)
+	if !ok { // We haven't finished setting this one up yet (it's not been queried), so there's nothing to mark
+		return
+	}
+
+	livenessLock.Lock()
+	device.LastSeen = time.Now()
+	wasOnline := device.Online
+	device.Online = true
+	livenessLock.Unlock()
+
+	if !wasOnline {
+		fmt.Println("Device", info.MACAddress, "is back online")
+		logEvent("online", info.MACAddress, "driver", "")
+		if device.sendEvent != nil { // AllOnes aren't exported to the Sphere, so they won't have one of these
+			device.sendEvent("online", info.MACAddress)
+		}
+
+		// It may well have rebooted and forgotten about us, so subscribe again. Once that's done, the Sphere gets told the current state
+		if orvibo.Devices[info.MACAddress] != nil {
+			clearPendingSubscribe(info.MACAddress)
+			orvibo.Devices[info.MACAddress].Subscribed = false
+		}
+		subscribe()
+		if info.DeviceType == orvibo.SOCKET {
+			device.sendState(device.Device.State)
+		}
+	}
+}
+
+// isOnline tells us whether we've heard from a device recently
+func (d *OrviboDevice) isOnline() bool {
+	livenessLock.Lock()
+	defer livenessLock.Unlock()
+	return d.Online
+}
+
+// heartbeat checks who we haven't heard from in a while, then renews any subscriptions that are getting old, which gives
+// those devices something to reply to. It changes orvibo.Devices, so it runs on theloop
+func heartbeat() {
+	now := time.Now()
+	timeout := offlineAfter()
+
+	livenessLock.Lock()
+	var gone []*OrviboDevice
+	for _, device := range driver.devices() {
+		if device.Online && now.Sub(device.LastSeen) > timeout {
+			device.Online = false
+			gone = append(gone, device)
+		}
+	}
+	livenessLock.Unlock()
+
+	for _, device := range gone {
+		fmt.Println("Device", device.Device.MACAddress, "hasn't responded since", device.LastSeen, "- marking offline")
+		logEvent("offline", device.Device.MACAddress, "driver", fmt.Sprintf("last seen %s", device.LastSeen.Format("15:04:05")))
+		if device.sendEvent != nil {
+			device.sendEvent("offline", device.Device.MACAddress) // Lets the Sphere know this thing is unavailable
+		}
+	}
+
+	if len(gone) > 0 { // Someone's gone missing. Maybe they've got a new IP address, so go looking
+		discoverHarder()
+	}
+
+	// Asking a subscribed device to subscribe again makes it reply, which is all we need to know it's alive. The socket's
+	// state in the reply isn't checked (see reconcile.go), so this doesn't get in the way of reconcile's backoff
+	for mac, device := range orvibo.Devices {
+		if !subscriptionDue(mac) {
+			continue
+		}
+		if device.Subscribed { // It answered last time, so it's not a failure
+			clearPendingSubscribe(mac)
+		}
+		device.Subscribed = false
+	}
+	subscribe()
+}
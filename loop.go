@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net"
+)
+
+// go-orvibo keeps its list of devices in orvibo.Devices, a plain map that orvibo.CheckForMessages changes whenever a device
+// answers. CheckForMessages runs on theloop (see driver.go), so anything else that touches orvibo.Devices (including
+// orvibo.Subscribe and orvibo.Query, which loop over it) has to run on theloop too. If two goroutines change a map at
+// once, Go kills the whole driver. Timers, the Labs and our web server hand their work to theloop with onLoop
+
+// Work waiting to run on theloop
+var loopTasks = make(chan func(), 10)
+
+// onLoop runs what on theloop and waits for it to finish. Never call this from theloop itself, as it'd wait forever
+func onLoop(what func()) {
+	done := make(chan bool)
+	loopTasks <- func() {
+		defer close(done)
+		what()
+	}
+	wakeLoop()
+	<-done
+}
+
+// wakeLoop gets theloop's attention. orvibo.CheckForMessages waits until a packet arrives, so we send it an empty one,
+// which it ignores
+func wakeLoop() {
+	conn, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: orviboPort})
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.Write(nil)
+}
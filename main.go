@@ -8,6 +8,11 @@ import (
 
 func main() {
 
+	// Got a command? Run it instead of starting the driver. Anything else (e.g. --flags from the Sphere) is go-ninja's. See cli.go
+	if isCommand(os.Args[1:]) {
+		os.Exit(runCLI(os.Args[1:]))
+	}
+
 	NewDriver()
 
 	c := make(chan os.Signal, 1)
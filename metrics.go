@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// This file contains our Prometheus metrics. There is an official Prometheus library for Go, but it's massive and the Sphere
+// only gives us 10MB of memory (see maxMemory in package.json), so this is a tiny hand rolled version that speaks the same text format.
+// Point Prometheus at http://ninjasphere.local:<port>/metrics and away you go
+
+// counter is a Prometheus counter with (at most) one label, e.g. orvibo_state_changes_total{mac="accf23..."}
+type counter struct {
+	name   string
+	help   string
+	label  string             // The name of our label. Leave blank if this counter doesn't need one
+	values map[string]float64 // Label value => count
+}
+
+// histogram keeps track of how long things take. Buckets are in seconds
+type histogram struct {
+	name    string
+	help    string
+	buckets []float64
+	counts  []uint64 // One count per bucket. Counts are cumulative, like Prometheus expects
+	sum     float64
+	count   uint64
+}
+
+// Used when looking up the name of a device type for our metrics
+var deviceTypeNames = map[int]string{
+	orvibo.UNKNOWN: "unknown",
+	orvibo.SOCKET:  "socket",
+	orvibo.ALLONE:  "allone",
+	orvibo.KEPLER:  "kepler",
+}
+
+// Our metrics are updated from theloop and read from the HTTP server, which run in different goroutines, so everything goes through this lock
+var metricsLock sync.Mutex
+
+// All our metrics. If you add a new one, don't forget to add it to the list in writeMetrics as well
+var (
+	devicesDiscovered  = newCounter("orvibo_devices_discovered_total", "Number of new Orvibo devices discovered, by device type", "type")
+	subscribeAttempts  = newCounter("orvibo_subscribe_attempts_total", "Number of subscription requests sent to unsubscribed devices", "")
+	subscribeFailures  = newCounter("orvibo_subscribe_failures_total", "Number of subscription requests that went unanswered by the next attempt", "")
+	queryAttempts      = newCounter("orvibo_query_attempts_total", "Number of query requests sent to unqueried devices", "")
+	queryFailures      = newCounter("orvibo_query_failures_total", "Number of query requests that went unanswered by the next attempt", "")
+	stateChanges       = newCounter("orvibo_state_changes_total", "Number of state changes reported by each socket", "mac")
+	stateDrift         = newCounter("orvibo_state_drift_total", "Number of times a socket's real state didn't match what we thought, by socket", "mac")
+	irBlasts           = newCounter("orvibo_ir_blasts_total", "Number of IR codes blasted, by AllOne", "allone")
+	rfBlasts           = newCounter("orvibo_rf_blasts_total", "Number of RF codes blasted, by AllOne", "allone")
+	learningSessions   = newCounter("orvibo_learning_sessions_total", "Number of IR learning sessions, by outcome", "outcome")
+	commandRetries     = newCounter("orvibo_setstate_retries_total", "Number of times we've had to ask a socket to change state again, by socket", "mac")
+	commandFailures    = newCounter("orvibo_setstate_failures_total", "Number of state changes a socket never confirmed, by socket", "mac")
+	keplerAlarms       = newCounter("orvibo_kepler_alarms_total", "Number of gas alarms raised, by Kepler", "mac")
+	packetsSent        = newCounter("orvibo_udp_packets_sent_total", "Number of UDP packets sent to Orvibo devices, by command", "command")
+	packetsReceived    = newCounter("orvibo_udp_packets_received_total", "Number of UDP messages received from Orvibo devices, by event", "event")
+	receiveLoopLatency = newHistogram("orvibo_receive_loop_seconds", "Time taken by theloop to handle a single event", []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1})
+)
+
+// These keep track of which devices we've asked to subscribe / query, so we can count failures the next time round.
+// subscribe() is called from both theloop and setInterval, so these get their own lock
+var pendingSubscribe = make(map[string]bool)
+var pendingQuery = make(map[string]bool)
+var pendingLock sync.Mutex
+
+func newCounter(name string, help string, label string) *counter {
+	return &counter{
+		name:   name,
+		help:   help,
+		label:  label,
+		values: make(map[string]float64),
+	}
+}
+
+func newHistogram(name string, help string, buckets []float64) *histogram {
+	return &histogram{
+		name:    name,
+		help:    help,
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+// Inc adds one to the counter for the given label value. Pass "" if the counter has no label
+func (c *counter) Inc(value string) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	c.values[value]++
+}
+
+// Observe records how long something took
+func (h *histogram) Observe(d time.Duration) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	seconds := d.Seconds()
+	for i, bucket := range h.buckets {
+		if seconds <= bucket {
+			h.counts[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// subscribe wraps orvibo.Subscribe so we can count attempts. Any device that was still unsubscribed from last time counts as a failure
+func subscribe() {
+	ignoreDenied() // We never talk to denied devices. See adoption.go
+	pendingLock.Lock()
+	for mac, device := range orvibo.Devices {
+		if device.Subscribed {
+			delete(pendingSubscribe, mac)
+			continue
+		}
+		if pendingSubscribe[mac] {
+			subscribeFailures.Inc("")
+		}
+		pendingSubscribe[mac] = true
+		subscribeAttempts.Inc("")
+		packetsSent.Inc("subscribe")
+	}
+	pendingLock.Unlock()
+	orvibo.Subscribe()
+	subscribeStatic() // Devices on other subnets need subscribing directly. See static.go
+}
+
+// clearPendingSubscribe forgets that we asked a device to subscribe. Used when we un-subscribe a device that did answer, so it's not counted as a failure
+func clearPendingSubscribe(mac string) {
+	pendingLock.Lock()
+	defer pendingLock.Unlock()
+	delete(pendingSubscribe, mac)
+}
+
+// query does the same thing as subscribe, but for orvibo.Query
+func query() {
+	ignoreDenied()
+	pendingLock.Lock()
+	for mac, device := range orvibo.Devices {
+		if device.Queried || !device.Subscribed {
+			delete(pendingQuery, mac)
+			continue
+		}
+		if pendingQuery[mac] {
+			queryFailures.Inc("")
+		}
+		pendingQuery[mac] = true
+		queryAttempts.Inc("")
+		packetsSent.Inc("query")
+	}
+	pendingLock.Unlock()
+	orvibo.Query()
+	queryStatic()
+}
+
+// discover wraps orvibo.Discover. Discovery is a single broadcast packet, plus whatever static devices we've been told about
+func discover() {
+	packetsSent.Inc("discover")
+	orvibo.Discover()
+	discoverInterfaces() // Each interface we've bound to gets its own broadcast. See interfaces.go
+	discoverStatic()
+}
+
+// writeMetrics writes all of our metrics out in the Prometheus text format
+func writeMetrics(w http.ResponseWriter, r *http.Request) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	for _, c := range []*counter{devicesDiscovered, subscribeAttempts, subscribeFailures, queryAttempts, queryFailures, stateChanges, commandRetries, commandFailures, stateDrift, irBlasts, rfBlasts, learningSessions, keplerAlarms, packetsSent, packetsReceived} {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+
+		// Sort the labels so the output doesn't jump around between scrapes
+		var keys []string
+		for key := range c.values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		for _, key := range keys {
+			if c.label == "" {
+				fmt.Fprintf(w, "%s %v\n", c.name, c.values[key])
+			} else {
+				fmt.Fprintf(w, "%s{%s=\"%s\"} %v\n", c.name, c.label, escapeLabel(key), c.values[key])
+			}
+		}
+	}
+
+	h := receiveLoopLatency
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	for i, bucket := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, bucket, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.count)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, h.count)
+}
+
+// Backslashes, quotes and newlines need escaping in label values. Device names can contain anything
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// go-orvibo does all of its talking via broadcast, which is fine until the devices are on another subnet. This file lets us
+// send our own packets straight to a device (or a subnet's broadcast address). Orvibo devices answer whoever asked, on the
+// port they asked from. go-orvibo asks from port 10000, so it gets its own answers. We ask from other sockets, so we listen
+// on those too and hand whatever comes back to theloop (see handlePacket), which deals with it just like go-orvibo would
+// have. The only thing a device sends to port 10000 no matter what is the state change it tells its subscribers about when
+// someone presses its button, and go-orvibo picks those up.
+// If we've been told which interfaces to use (see interfaces.go), packets go out through the right one.
+//
+// An Orvibo packet looks like this (in hex):
+//
+//	6864       - The "magic word". Every packet starts with this
+//	0012       - The length of the whole packet, in bytes
+//	7167       - The command (7167 = discover a specific device, 7161 = discover everything, 636c = subscribe etc.)
+//	accf23...  - Whatever the command needs. Usually the MAC address, padded with 202020202020
+
+// The port Orvibo devices listen (and answer) on
+const orviboPort = 10000
+
+// Commands we know how to send
+const (
+	cmdDiscoverAll    = "7161"
+	cmdDiscoverDevice = "7167"
+	cmdSubscribe      = "636c"
+	cmdReadTable      = "7274"
+)
+
+// Six spaces. Orvibo pads MAC addresses out to 12 bytes with these
+const macPadding = "202020202020"
+
+var unicastConn *net.UDPConn
+var unicastLock sync.Mutex
+
+// buildPacket puts the magic word and length in front of a command and its payload. Both are hex strings
+func buildPacket(command string, payload string) ([]byte, error) {
+	body, err := hex.DecodeString(command + payload)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid packet %s%s: %s", command, payload, err)
+	}
+
+	length := len(body) + 4 // The magic word and the length itself count too
+	return append([]byte{0x68, 0x64, byte(length >> 8), byte(length)}, body...), nil
+}
+
+// normaliseMAC turns "AC:CF:23:12:34:56" (or "ac-cf-23-12-34-56") into "accf23123456", which is how go-orvibo stores them
+func normaliseMAC(mac string) string {
+	return strings.ToLower(strings.NewReplacer(":", "", "-", "", " ", "").Replace(mac))
+}
+
+// sendPacket sends a packet to an address. If the address doesn't have a port, we use orviboPort
+func sendPacket(address string, data []byte) error {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, fmt.Sprint(orviboPort))
+	}
+
+	addr, err := net.ResolveUDPAddr("udp4", address)
+	if err != nil {
+		return err
+	}
+
+	// Bound to specific interfaces? Use the one this address belongs to
+	if bound := interfaceFor(addr.IP); bound != nil {
+		_, err = bound.conn.WriteToUDP(data, addr)
+		if err == nil {
+			packetsSent.Inc("unicast")
+		}
+		return err
+	}
+
+	unicastLock.Lock()
+	defer unicastLock.Unlock()
+
+	if unicastConn == nil { // Any port will do, as long as we listen for the answers
+		unicastConn, err = net.ListenUDP("udp4", nil)
+		if err != nil {
+			return err
+		}
+		go listen(unicastConn)
+	}
+
+	_, err = unicastConn.WriteToUDP(data, addr)
+	if err == nil {
+		packetsSent.Inc("unicast")
+	}
+	return err
+}
+
+// reverseMAC flips a MAC address around, byte by byte. Subscribing needs this for some reason
+func reverseMAC(mac string) string {
+	var reversed string
+	for i := len(mac); i >= 2; i -= 2 {
+		reversed += mac[i-2 : i]
+	}
+	return reversed
+}
+
+// discoverAt asks whatever's at address to identify itself. If we know the MAC address we ask for that device specifically
+func discoverAt(address string, mac string) error {
+	var data []byte
+	var err error
+	if mac == "" {
+		data, err = buildPacket(cmdDiscoverAll, "")
+	} else {
+		data, err = buildPacket(cmdDiscoverDevice, normaliseMAC(mac)+macPadding)
+	}
+	if err != nil {
+		return err
+	}
+
+	return sendPacket(address, data)
+}
+
+// subscribeAt subscribes to a device at a known address, the same way go-orvibo does, but without the broadcast
+func subscribeAt(address string, mac string) error {
+	mac = normaliseMAC(mac)
+	data, err := buildPacket(cmdSubscribe, mac+macPadding+reverseMAC(mac)+macPadding)
+	if err != nil {
+		return err
+	}
+
+	return sendPacket(address, data)
+}
+
+// queryAt asks a device at a known address for its name and such (table 4 is where that lives)
+func queryAt(address string, mac string) error {
+	data, err := buildPacket(cmdReadTable, normaliseMAC(mac)+macPadding+"0000000004000000000000")
+	if err != nil {
+		return err
+	}
+
+	return sendPacket(address, data)
+}
+
+// How long a discovery answer is, and where things are in it. There's an extra byte before the MAC address, then the
+// reversed MAC address (both padded), then what kind of device it is (e.g. "SOC002"), four bytes of time and its state
+const (
+	discoveryLength     = 42
+	discoveryMACOffset  = 7
+	discoveryTypeOffset = 31
+)
+
+// listen reads answers from one of our own sockets and hands them to theloop, until the socket's closed
+func listen(conn *net.UDPConn) {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return // Closed, most likely because we've rebound our interfaces
+		}
+		if n < 12 || buf[0] != 0x68 || buf[1] != 0x64 {
+			continue // Not an Orvibo packet
+		}
+
+		data := append([]byte(nil), buf[:n]...)
+		onLoop(func() { handlePacket(driver, data, from) })
+	}
+}
+
+// handlePacket deals with the answer to one of our own packets, the same way go-orvibo deals with answers to its own. It
+// changes orvibo.Devices, so it runs on theloop
+func handlePacket(d *OrviboDriver, data []byte, from *net.UDPAddr) {
+	command := hex.EncodeToString(data[4:6]) // Not counted here, as handleEvent counts whatever it turns into
+
+	switch command {
+	case cmdDiscoverAll, cmdDiscoverDevice:
+		if len(data) < discoveryLength {
+			return
+		}
+		mac := hex.EncodeToString(data[discoveryMACOffset : discoveryMACOffset+6])
+		found := "existing"
+		device, ok := orvibo.Devices[mac]
+		if !ok {
+			device = &orvibo.Device{ID: nextDeviceID(), MACAddress: mac}
+			found = ""
+		}
+		device.IP = from
+		device.State = data[len(data)-1] == 1
+
+		switch product := string(data[discoveryTypeOffset : discoveryTypeOffset+6]); {
+		case strings.HasPrefix(product, "SOC"):
+			device.DeviceType = orvibo.SOCKET
+			found += "socketfound"
+		case strings.HasPrefix(product, "IRD"):
+			device.DeviceType = orvibo.ALLONE
+			found += "allonefound"
+		case strings.HasPrefix(product, "KEP"): // The same guess as kepler.go and our simulator make
+			if !keplerSupport() {
+				return // Not even worth remembering. See kepler.go
+			}
+			device.DeviceType = orvibo.KEPLER
+			found += "keplerfound"
+		default:
+			fmt.Println("Don't know what kind of device", mac, "is:", product)
+			return
+		}
+		orvibo.Devices[mac] = device
+		handleEvent(d, found, device)
+	case cmdSubscribe:
+		device, ok := orvibo.Devices[hex.EncodeToString(data[6:12])]
+		if !ok {
+			return
+		}
+		device.State = data[len(data)-1] == 1 // A subscription answer ends with the device's state
+		handleEvent(d, "subscribed", device)
+	case cmdReadTable: // Only queryAt asks us for tables. tables.go waits for its own answers
+		device, ok := orvibo.Devices[hex.EncodeToString(data[6:12])]
+		if !ok {
+			return
+		}
+		records, err := splitRecords(data, device.MACAddress, tableSettings)
+		if err != nil || len(records[0]) < settingsNameOffset+settingsNameLength {
+			fmt.Println("Unable to read the name of", device.MACAddress, ":", err)
+			return
+		}
+		device.Name = getField(records[0], settingsNameOffset, settingsNameLength)
+		handleEvent(d, "queried", device)
+	}
+}
+
+// nextDeviceID picks an ID for a device we've found ourselves, that go-orvibo isn't using
+func nextDeviceID() int {
+	id := 0
+	for _, device := range orvibo.Devices {
+		if device.ID >= id {
+			id = device.ID + 1
+		}
+	}
+	return id
+}
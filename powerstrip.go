@@ -0,0 +1,394 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// Orvibo's power strips look just like a socket to go-orvibo, so we can't tell them apart by ourselves. Instead, sockets are
+// marked as power strips on the "Power Strips" screen in the Labs (or PowerStrips in the config), along with how many outlets
+// they have. Each outlet becomes its own device in the Sphere (see OrviboOutlet in device.go), and the strip's own on-off
+// channel becomes a master switch for the lot. Outlets are switched by sending the usual state change, but with a bitmask of
+// outlets (bit 0 is outlet 1) instead of a plain on or off. A status request (see readStatus in tables.go) gets the bitmask back
+//
+// Be warned: I haven't got a strip, or a capture of one talking to the Orvibo app, so the bitmask (both where it goes in the
+// state change and stripMaskOffset in the status answer) is a guess based on how the socket packets are laid out. The
+// simulator's strip is built from the same guess, so it can't tell us whether it's right. If your strip doesn't do what the
+// Sphere asks, setOutlets and stripStatus are the only places that need fixing (and a capture would be very welcome)
+//
+// Outlets are switched from the Sphere's goroutines and refreshed from our own, so Outlets and each outlet's State are guarded
+// by the strip's outletLock. switchLock is held for the whole of a change (read the mask, send it, wait for the strip to confirm)
+// so that switching two outlets at once can't turn the first one back off
+
+// OrviboPowerStrip is a socket we've been told is really a power strip
+type OrviboPowerStrip struct {
+	Outlets int      // How many outlets it has
+	Names   []string // What each outlet is called. Missing names default to "<strip name> 1" etc.
+}
+
+// Strips with more outlets than this would need a bigger bitmask, and I've never seen one
+const maxOutlets = 8
+
+// Where the outlet bitmask lives in a status answer. A guess, see above
+const stripMaskOffset = 18
+
+// allOutlets returns a bitmask with every outlet on (or off)
+func allOutlets(outlets int, state bool) byte {
+	if !state {
+		return 0
+	}
+	return byte(1<<uint(outlets) - 1)
+}
+
+// outlets returns a copy of a strip's outlets (nil for a plain socket), so it can be looped over without holding outletLock
+func (d *OrviboDevice) outlets() []*OrviboOutlet {
+	d.outletLock.Lock()
+	defer d.outletLock.Unlock()
+	return append([]*OrviboOutlet(nil), d.Outlets...)
+}
+
+// state returns whether an outlet is on, as far as we know
+func (o *OrviboOutlet) state() bool {
+	o.strip.outletLock.Lock()
+	defer o.strip.outletLock.Unlock()
+	return o.State
+}
+
+// outletMask works out the bitmask for the outlets' current states
+func (d *OrviboDevice) outletMask() byte {
+	d.outletLock.Lock()
+	defer d.outletLock.Unlock()
+
+	var mask byte
+	for _, outlet := range d.Outlets {
+		if outlet.State {
+			mask |= 1 << uint(outlet.Number-1)
+		}
+	}
+	return mask
+}
+
+// stripStatus asks a power strip which outlets are on
+func (d *OrviboDevice) stripStatus() (byte, error) {
+	answer, err := readStatus(d.Device)
+	if err != nil {
+		return 0, err
+	}
+	if len(answer) <= stripMaskOffset {
+		return 0, fmt.Errorf("Status from %s is too short", d.Device.MACAddress)
+	}
+	return answer[stripMaskOffset], nil
+}
+
+// setOutlet turns one outlet on or off, leaving the others as they are
+func (d *OrviboDevice) setOutlet(number int, state bool, source string) error {
+	d.switchLock.Lock()
+	defer d.switchLock.Unlock()
+
+	mask := d.outletMask()
+	if state {
+		mask |= 1 << uint(number-1)
+	} else {
+		mask &^= 1 << uint(number-1)
+	}
+	return d.sendOutlets(mask, source)
+}
+
+// setOutlets sets every outlet on a strip at once
+func (d *OrviboDevice) setOutlets(mask byte, source string) error {
+	d.switchLock.Lock()
+	defer d.switchLock.Unlock()
+	return d.sendOutlets(mask, source)
+}
+
+// sendOutlets sends a strip its outlets' new states, then checks it worked. Like setStateAndWait, we try a few times, waiting
+// a bit longer each time. You need to be holding switchLock
+func (d *OrviboDevice) sendOutlets(mask byte, source string) error {
+	if d.Device.IP == nil {
+		return fmt.Errorf("We don't know the IP address of %s", d.Device.MACAddress)
+	}
+
+	data, err := buildPacket(cmdSetState, normaliseMAC(d.Device.MACAddress)+macPadding+"00000000"+hex.EncodeToString([]byte{mask}))
+	if err != nil {
+		return err
+	}
+
+	timeout := stateTimeout
+	for attempt := 1; attempt <= stateAttempts; attempt++ {
+		if attempt > 1 {
+			fmt.Println("Outlets on", d.Device.MACAddress, "didn't change - trying again (attempt", attempt, "of", stateAttempts, ")")
+			commandRetries.Inc(d.Device.MACAddress)
+		}
+
+		if err = sendPacket(d.Device.IP.IP.String(), data); err != nil {
+			return err
+		}
+
+		time.Sleep(timeout / 4) // Give the relays a moment
+		if confirmed, err := d.stripStatus(); err == nil && confirmed == mask {
+			d.updateOutlets(mask, source)
+			return nil
+		}
+
+		timeout *= 2
+	}
+
+	commandFailures.Inc(d.Device.MACAddress)
+	if confirmed, err := d.stripStatus(); err == nil {
+		d.updateOutlets(confirmed, "external") // Whatever the Sphere thinks happened, tell it what really happened
+	}
+	return fmt.Errorf("Power strip %s didn't confirm its outlets changed after %d attempts", d.Device.MACAddress, stateAttempts)
+}
+
+// updateOutlets tells the Sphere about any outlets that have changed, and turns the master switch on if any outlet is on
+func (d *OrviboDevice) updateOutlets(mask byte, source string) {
+	var changed []*OrviboOutlet
+	d.outletLock.Lock()
+	for _, outlet := range d.Outlets {
+		state := mask&(1<<uint(outlet.Number-1)) != 0
+		if state != outlet.State {
+			outlet.State = state
+			changed = append(changed, outlet)
+		}
+	}
+	d.outletLock.Unlock()
+
+	for _, outlet := range changed { // Tell the Sphere without holding the lock, in case it calls straight back
+		state := mask&(1<<uint(outlet.Number-1)) != 0
+		outlet.onOffChannel.SendState(state)
+		stateChanges.Inc(d.Device.MACAddress)
+		logEvent("state", d.Device.MACAddress, source, fmt.Sprintf("outlet %d %s", outlet.Number, onOff(state)))
+	}
+
+	master := mask != 0
+	onLoop(func() { d.Device.State = master }) // go-orvibo's devices belong to theloop
+	d.sendState(master)
+	d.updateEnergy(master)
+}
+
+// refreshOutlets asks a strip which outlets are on. Called when go-orvibo tells us the strip's state changed (e.g. someone
+// pressed a button on it), because all go-orvibo can tell us is "on" or "off"
+func (d *OrviboDevice) refreshOutlets() {
+	mask, err := d.stripStatus()
+	if err != nil {
+		fmt.Println("Unable to read outlets on", d.Device.MACAddress, ":", err)
+		return
+	}
+	d.updateOutlets(mask, "external")
+}
+
+// outletName works out what an outlet is called
+func outletName(mac string, strip *OrviboPowerStrip, number int) string {
+	if number <= len(strip.Names) && strip.Names[number-1] != "" {
+		return strip.Names[number-1]
+	}
+	if device := findDevice(driver, mac); device != nil {
+		return fmt.Sprintf("%s %d", device.Device.Name, number)
+	}
+	return fmt.Sprintf("Outlet %d", number)
+}
+
+// powerStrip gets a copy of what our config says about a strip, so nobody's holding on to it while the Labs or a restore
+// changes it
+func powerStrip(mac string) (*OrviboPowerStrip, bool) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	strip, ok := driver.config.PowerStrips[mac]
+	if !ok {
+		return nil, false
+	}
+	return &OrviboPowerStrip{Outlets: strip.Outlets, Names: append([]string(nil), strip.Names...)}, true
+}
+
+// setOutletName saves an outlet's name to our config
+func setOutletName(mac string, number int, name string) {
+	configLock.Lock()
+	strip, ok := driver.config.PowerStrips[mac]
+	if !ok {
+		configLock.Unlock()
+		return
+	}
+	for len(strip.Names) < number {
+		strip.Names = append(strip.Names, "")
+	}
+	strip.Names[number-1] = name
+	configLock.Unlock() // saveConfig takes it too
+
+	driver.saveConfig()
+}
+
+// exportOutlets makes sure a socket has a device for each of the outlets we've been told it has, and lets the Sphere know about
+// any new ones. Called when the socket is adopted, and again whenever the power strips are saved, so a strip can gain or lose
+// outlets (or go back to being a plain socket) without a restart. There's no way to take a device back from the Sphere, so
+// outlets that have gone are marked offline and forgotten. You can delete them in the app
+func (d *OrviboDriver) exportOutlets(device *OrviboDevice) {
+	mac := device.Device.MACAddress
+	wanted := 0
+	strip, ok := powerStrip(mac)
+	if ok {
+		wanted = strip.Outlets
+	}
+
+	var added, removed []*OrviboOutlet
+	device.outletLock.Lock()
+	for number := len(device.Outlets) + 1; number <= wanted; number++ {
+		outlet := NewOrviboOutlet(device, number, outletName(mac, strip, number))
+		device.Outlets = append(device.Outlets, outlet)
+		added = append(added, outlet)
+	}
+	if len(device.Outlets) > wanted {
+		removed = device.Outlets[wanted:]
+		device.Outlets = device.Outlets[:wanted:wanted]
+	}
+	device.outletLock.Unlock()
+
+	for _, outlet := range added {
+		_ = d.Conn.ExportDevice(outlet)
+		_ = d.Conn.ExportChannel(outlet, outlet.onOffChannel, "on-off")
+	}
+	for _, outlet := range removed {
+		if outlet.sendEvent != nil {
+			outlet.sendEvent("offline", outlet.info.NaturalID)
+		}
+		logEvent("config", mac, "labs", fmt.Sprintf("removed outlet %d", outlet.Number))
+	}
+
+	if len(added) > 0 {
+		go device.refreshOutlets() // Find out which ones are on. This can take a couple of seconds, so don't hold anyone up
+	}
+}
+
+// Shows our sockets, so we can mark which ones are power strips and name their outlets
+func (c *configService) powerstrips() (*suit.ConfigurationScreen, error) {
+	var sockets []*OrviboDevice
+	for _, device := range driver.devices() {
+		if device.Device.DeviceType == orvibo.SOCKET {
+			sockets = append(sockets, device)
+		}
+	}
+	sort.Slice(sockets, func(i, j int) bool { return sockets[i].Device.Name < sockets[j].Device.Name })
+
+	contents := []suit.Typed{
+		suit.StaticText{
+			Title: "About this screen",
+			Value: "Power strips look just like sockets to the driver. Enter how many outlets each strip has (leave it blank for an ordinary socket) and each outlet will show up in the Sphere as its own thing. Turning the strip itself on or off switches every outlet. Outlets you take away show up as offline in the Sphere, and you can delete them there",
+		},
+		suit.StaticText{
+			Title: "Experimental",
+			Value: "Nobody has checked this against a real strip yet, so the way outlets are switched is a guess. If your outlets don't do what the Sphere asks, please let us know",
+		},
+	}
+
+	for _, device := range sockets {
+		mac := device.Device.MACAddress
+		outlets, names := "", ""
+		if strip, ok := powerStrip(mac); ok {
+			outlets = strconv.Itoa(strip.Outlets)
+			var all []string
+			for number := 1; number <= strip.Outlets; number++ {
+				all = append(all, outletName(mac, strip, number))
+			}
+			names = strings.Join(all, ", ")
+		}
+
+		contents = append(contents, suit.InputText{
+			Name:        "outlets_" + mac,
+			Before:      device.Device.Name,
+			After:       "outlets",
+			Placeholder: "4",
+			Value:       outlets,
+		}, suit.InputText{
+			Name:        "names_" + mac,
+			Before:      "Outlet names",
+			Placeholder: "Lamp, TV, Heater, Fan",
+			Value:       names,
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Power Strips",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "savepowerstrips",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savepowerstrips saves which sockets are power strips, and adds or removes outlets to match straight away
+func (c *configService) savepowerstrips(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	strips := make(map[string]*OrviboPowerStrip)
+	for name, value := range vals {
+		if !strings.HasPrefix(name, "outlets_") || strings.TrimSpace(value) == "" { // Our textboxes are named outlets_<MAC address>
+			continue
+		}
+		mac := strings.TrimPrefix(name, "outlets_")
+
+		outlets, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil || outlets < 1 || outlets > maxOutlets {
+			return c.error(fmt.Sprintf("%s isn't a number of outlets (1 to %d)", value, maxOutlets))
+		}
+
+		strip := &OrviboPowerStrip{Outlets: outlets}
+		for _, outletName := range strings.Split(vals["names_"+mac], ",") {
+			strip.Names = append(strip.Names, strings.TrimSpace(outletName))
+		}
+		strips[mac] = strip
+	}
+
+	configLock.Lock()
+	driver.config.PowerStrips = strips
+	configLock.Unlock()
+	driver.saveConfig()
+	logEvent("config", "", "labs", "updated power strips")
+
+	for _, device := range driver.devices() { // Every socket, so ones that have stopped being strips lose their outlets too
+		if device.Device.DeviceType != orvibo.SOCKET {
+			continue
+		}
+		driver.exportOutlets(device)
+
+		strip, ok := strips[device.Device.MACAddress]
+		if !ok {
+			continue
+		}
+		for _, outlet := range device.outlets() { // Rename any outlets that already exist
+			if name := outletName(device.Device.MACAddress, strip, outlet.Number); name != *outlet.info.Name {
+				outlet.info.Name = &name
+				if outlet.sendEvent != nil {
+					outlet.sendEvent("renamed", name)
+				}
+			}
+		}
+	}
+
+	return c.powerstrips()
+}
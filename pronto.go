@@ -0,0 +1,213 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/Grayda/driver-orvibo/ircode"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// Pronto hex is how most IR code databases share codes (see ircode/pronto.go for what it looks like). This file lets us paste
+// Pronto codes in as new IR codes, from the Labs or /api/pronto, and get any saved code back out as Pronto
+
+// ProntoCode is a saved code, as Pronto hex. Used by /api/pronto
+type ProntoCode struct {
+	Name        string
+	Description string
+	Group       string
+	AllOne      string
+	Pronto      string
+}
+
+func init() {
+	mux.HandleFunc("/api/pronto", prontoAPI)
+}
+
+// importPronto turns a Pronto code into an AllOne code and saves it
+func importPronto(code ProntoCode, source string) (OrviboIRCode, error) {
+	if strings.TrimSpace(code.Name) == "" {
+		return OrviboIRCode{}, fmt.Errorf("Please give this code a name")
+	}
+	hex, frequency, err := ircode.ProntoToAllOne(code.Pronto)
+	if err != nil {
+		return OrviboIRCode{}, err
+	}
+
+	ir := OrviboIRCode{
+		Name:        strings.TrimSpace(code.Name),
+		Description: code.Description,
+		Code:        hex,
+		AllOne:      code.AllOne,
+		Group:       code.Group,
+		Frequency:   frequency,
+	}
+	decodeIR(&ir)
+	if err = driver.addIR(ir); err != nil {
+		return ir, err
+	}
+	logEvent("config", ir.AllOne, source, fmt.Sprintf("imported Pronto code %s (%s)", ir.Name, describeIR(ir)))
+	return ir, nil
+}
+
+// exportPronto turns all our saved codes into Pronto codes. Codes that can't be converted are left out. Codes we imported
+// keep the frequency they came with. Learned codes are marked as ircode.DefaultFrequency, because the AllOne doesn't say
+func exportPronto() []ProntoCode {
+	var codes []ProntoCode
+	for _, ir := range driver.config.Codes {
+		frequency := ir.Frequency
+		if frequency == 0 {
+			frequency = ircode.DefaultFrequency
+		}
+		pronto, err := ircode.AllOneToPronto(ir.Code, frequency)
+		if err != nil {
+			fmt.Println("Unable to convert", ir.Name, "to Pronto:", err)
+			continue
+		}
+		codes = append(codes, ProntoCode{
+			Name:        ir.Name,
+			Description: ir.Description,
+			Group:       ir.Group,
+			AllOne:      ir.AllOne,
+			Pronto:      pronto,
+		})
+	}
+	return codes
+}
+
+// prontoAPI lists our saved codes as Pronto (GET), or imports a Pronto code (POST with name, description, group, allone and pronto)
+func prontoAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "POST" {
+		_, err := importPronto(ProntoCode{
+			Name:        r.FormValue("name"),
+			Description: r.FormValue("description"),
+			Group:       r.FormValue("group"),
+			AllOne:      r.FormValue("allone"),
+			Pronto:      r.FormValue("pronto"),
+		}, "api")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(exportPronto())
+}
+
+// Shows the UI for pasting in a Pronto code
+func (c *configService) newpronto() (*suit.ConfigurationScreen, error) {
+	screen := suit.ConfigurationScreen{
+		Title: "Import Pronto Code",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "Paste in a Pronto hex code (the kind that starts with 0000) from a code database or another remote. It'll be turned into a code the AllOne can blast",
+					},
+					suit.InputText{
+						Name:        "name",
+						Before:      "Name for this code",
+						Placeholder: "TV On",
+					},
+					suit.InputText{
+						Name:        "description",
+						Before:      "Code Description",
+						Placeholder: "Living Room TV On",
+					},
+					suit.InputText{
+						Name:        "pronto",
+						Before:      "Pronto code",
+						Placeholder: "0000 006D 0022 0002 0157 00AC ...",
+					},
+					suit.RadioGroup{
+						Title:   "Select an AllOne to blast from",
+						Name:    "allone",
+						Options: allOneOptions(),
+					},
+					suit.RadioGroup{
+						Title:   "Select a group to add this code to",
+						Name:    "group",
+						Options: groupOptions(),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Cancel",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+			suit.ReplyAction{
+				Label:        "Import",
+				Name:         "savepronto",
+				DisplayClass: "success",
+				DisplayIcon:  "import",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savepronto imports the code from the "Import Pronto Code" screen
+func (c *configService) savepronto(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	_, err = importPronto(ProntoCode{
+		Name:        vals["name"],
+		Description: vals["description"],
+		Group:       vals["group"],
+		AllOne:      vals["allone"],
+		Pronto:      vals["pronto"],
+	}, "labs")
+	if err != nil {
+		return c.error(err.Error())
+	}
+	return c.list()
+}
+
+// Shows every saved code as Pronto, ready to copy into something else
+func (c *configService) exportpronto() (*suit.ConfigurationScreen, error) {
+	contents := []suit.Typed{
+		suit.StaticText{
+			Title: "About this screen",
+			Value: "Here are your saved IR codes as Pronto hex, which most remotes and code databases understand. Imported codes keep the carrier frequency they came with. The AllOne doesn't say what frequency learned codes use, so those are marked as 38kHz",
+		},
+	}
+
+	for _, code := range exportPronto() {
+		contents = append(contents, suit.StaticText{
+			Title:    code.Name,
+			Subtitle: code.Group,
+			Value:    code.Pronto,
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Export Pronto Codes",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label:        "Back",
+				Name:         "list",
+				DisplayClass: "default",
+			},
+		},
+	}
+
+	return &screen, nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// If we miss a "statechanged" packet, the Sphere's idea of a socket's state stays wrong until someone presses the button again.
+// This file fixes that. Every so often we ask each socket for its state, and compare the answer against what we think it is
+// and what we last told the Sphere. If they don't match, we fix it up and make a note in the history. Sockets that never
+// drift get asked less and less often. An S20 only tells us its state when it answers a subscribe request, so asking means
+// sending one of those to that socket alone. Only answers to our own questions count, so the heartbeat (see liveness.go)
+// renewing everyone's subscriptions doesn't upset the backoff
+
+// Defaults for ReconcileInterval and ReconcileMaxInterval (in seconds) if the config doesn't set them
+const defaultReconcileInterval = 60
+const defaultReconcileMaxInterval = 30 * 60
+
+// reconcileState is what we know about a single socket
+type reconcileState struct {
+	sent        bool          // Have we told the Sphere anything yet?
+	lastSent    bool          // What we last told the Sphere via the on-off channel
+	interval    time.Duration // How long until we check this socket again. Doubles every time it's fine, up to the max
+	lastChecked time.Time
+	asked       bool // Have we asked for its state, and not heard back yet?
+}
+
+var reconcileStates = make(map[string]*reconcileState)
+var reconcileLock sync.Mutex
+
+// reconcileIntervals reads our intervals out of the config. A negative ReconcileInterval turns reconciliation off
+func reconcileIntervals() (time.Duration, time.Duration, bool) {
+	min, max := driver.config.ReconcileInterval, driver.config.ReconcileMaxInterval
+	if min < 0 {
+		return 0, 0, false
+	}
+	if min == 0 {
+		min = defaultReconcileInterval
+	}
+	if max < min {
+		max = defaultReconcileMaxInterval
+		if max < min {
+			max = min
+		}
+	}
+	return time.Duration(min) * time.Second, time.Duration(max) * time.Second, true
+}
+
+// getReconcileState finds (or makes) the reconcileState for a socket. You need to hold reconcileLock to call this
+func getReconcileState(mac string) *reconcileState {
+	state, ok := reconcileStates[mac]
+	if !ok {
+		min, _, _ := reconcileIntervals()
+		state = &reconcileState{interval: min, lastChecked: time.Now()}
+		reconcileStates[mac] = state
+	}
+	return state
+}
+
+// sendState tells the Sphere what state our socket is in, and remembers what we said so we can check it later
+func (d *OrviboDevice) sendState(state bool) {
+	reconcileLock.Lock()
+	s := getReconcileState(d.Device.MACAddress)
+	s.sent = true
+	s.lastSent = state
+	reconcileLock.Unlock()
+
+	d.onOffChannel.SendState(state)
+}
+
+// reconcile is called when a socket answers a subscribe request. reported is the state the socket says it's in. Answers we
+// didn't ask for (see reconcileSockets) are left alone
+func reconcile(d *OrviboDriver, mac string, reported bool) {
+	device := findDevice(d, mac)
+	if device == nil || device.Device.DeviceType != orvibo.SOCKET {
+		return
+	}
+
+	min, max, enabled := reconcileIntervals()
+	if !enabled {
+		return
+	}
+
+	reconcileLock.Lock()
+	s := getReconcileState(mac)
+	if !s.asked {
+		reconcileLock.Unlock()
+		return
+	}
+	s.asked = false
+	s.lastChecked = time.Now()
+	drifted := device.Device.State != reported || (s.sent && s.lastSent != reported)
+	wasSent := s.lastSent
+	if drifted {
+		s.interval = min // Something's up. Keep a closer eye on it
+	} else {
+		s.interval *= 2 // All good. Back off a bit
+		if s.interval > max {
+			s.interval = max
+		}
+	}
+	reconcileLock.Unlock()
+
+	if !drifted {
+		noteKept(mac) // So an old drift doesn't count towards a lapsed subscription. See schedule.go
+	} else {
+		fmt.Println("Socket", mac, "says it's", onOff(reported), "but we had", onOff(device.Device.State), "and the Sphere was told", onOff(wasSent), "- fixing")
+		logEvent("drift", mac, "driver", fmt.Sprintf("socket reported %s, driver had %s, Sphere had %s", onOff(reported), onOff(device.Device.State), onOff(wasSent)))
+		stateDrift.Inc(mac)
+		noteExpired(mac) // If it changed without telling us, its subscription may have lapsed. See schedule.go
+
+		device.Device.State = reported
+		device.sendState(reported)
+		device.updateEnergy(reported)
+	}
+}
+
+// reconcileTick is how often reconcileSockets runs. Even if reconciliation is turned off we keep ticking, in case it's turned back on
+func reconcileTick() time.Duration {
+	if min, _, enabled := reconcileIntervals(); enabled {
+		return min
+	}
+	return defaultReconcileInterval * time.Second
+}
+
+// reconcileSockets runs every ReconcileInterval. Any socket that's due a check gets asked for its state, and reconcile takes
+// it from there. It uses orvibo.Devices, so it runs on theloop
+func reconcileSockets() {
+	if _, _, enabled := reconcileIntervals(); !enabled {
+		return
+	}
+
+	now := time.Now()
+	var due []string
+
+	reconcileLock.Lock()
+	for _, device := range driver.devices() {
+		if device.Device.DeviceType != orvibo.SOCKET {
+			continue
+		}
+		s := getReconcileState(device.Device.MACAddress)
+		if now.Sub(s.lastChecked) >= s.interval {
+			s.asked = true
+			s.lastChecked = now // If it doesn't answer, ask again once the interval's up
+			due = append(due, device.Device.MACAddress)
+		}
+	}
+	reconcileLock.Unlock()
+
+	for _, mac := range due {
+		askState(mac)
+	}
+}
+
+// askState asks one socket for its state, by sending it (and only it) a subscribe request. That renews its subscription too
+func askState(mac string) {
+	device := orvibo.Devices[mac]
+	if device == nil || device.IP == nil {
+		return
+	}
+	if err := subscribeAt(device.IP.IP.String(), mac); err != nil {
+		fmt.Println("Unable to ask", mac, "for its state:", err)
+	}
+}
+
+// findDevice looks up one of our devices by MAC address. driver.device is keyed by go-orvibo's ID, which isn't always handy
+func findDevice(d *OrviboDriver, mac string) *OrviboDevice {
+	for _, device := range d.devices() {
+		if device.Device.MACAddress == mac {
+			return device
+		}
+	}
+	return nil
+}
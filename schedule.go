@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// This file works out how often we discover and resubscribe. Both intervals can be set in the config (and on the
+// "Driver Settings" screen). In adaptive mode, we discover every few seconds when we start up or when a device goes
+// missing, then back off towards DiscoverInterval once nothing new has turned up for a while.
+// S20 subscriptions expire after a while, and a socket whose subscription has expired stops telling us when it changes
+// state. When reconcile.go catches a socket that's drifted, its subscription probably lapsed sometime after we last renewed
+// it. One drift could just be a lost packet, so we only believe it once the same socket drifts twice in a row. In adaptive
+// mode we resubscribe at half the typical lifetime (the median of the last few), so one odd socket can't drag everything
+// down to minimumResubscribeInterval, and longer lifetimes push it back up again
+
+// Defaults (in seconds) for DiscoverInterval and ResubscribeInterval
+const defaultDiscoverInterval = 60
+const defaultResubscribeInterval = 60
+
+// In adaptive mode, this is how often we discover when we're looking hard
+const aggressiveDiscoverInterval = 10 * time.Second
+
+// We never resubscribe more often than this, no matter how short lived subscriptions seem to be
+const minimumResubscribeInterval = 20 * time.Second
+
+// How many times in a row a socket has to drift before we believe its subscription lapsed, and how many lifetimes we keep
+const expiryMissesNeeded = 2
+const expirySamples = 5
+
+var scheduleLock sync.Mutex
+var discoverDelay = aggressiveDiscoverInterval // The current discovery interval in adaptive mode
+var devicesAtLastDiscover = -1                 // How many devices we had last time we discovered. -1 means we haven't yet
+var observedExpiry time.Duration               // The median of expiryLifetimes. 0 if we haven't seen one expire
+var expiryLifetimes []time.Duration            // The last few subscription lifetimes we've seen, oldest first
+var expiryMisses = make(map[string]int)        // How many times in a row each device has drifted
+var subscribedAt = make(map[string]time.Time)  // When each device last confirmed a subscription
+
+// configuredInterval turns a number of seconds from the config into a time.Duration, using def if it's not set
+func configuredInterval(seconds int, def int) time.Duration {
+	if seconds <= 0 {
+		seconds = def
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// nextDiscoverDelay is how long we wait before discovering again
+func nextDiscoverDelay() time.Duration {
+	max := configuredInterval(driver.config.DiscoverInterval, defaultDiscoverInterval)
+	if !driver.config.AdaptiveScheduling {
+		return max
+	}
+
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	// If nothing new turned up since last time, the network is settling down, so back off
+	devices := len(driver.devices())
+	if devices == devicesAtLastDiscover {
+		discoverDelay *= 2
+	} else {
+		discoverDelay = aggressiveDiscoverInterval
+	}
+	devicesAtLastDiscover = devices
+
+	if discoverDelay > max {
+		discoverDelay = max
+	}
+	return discoverDelay
+}
+
+// discoverHarder puts discovery back into aggressive mode. Called when a device goes missing
+func discoverHarder() {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	discoverDelay = aggressiveDiscoverInterval
+	devicesAtLastDiscover = -1
+}
+
+// nextResubscribeDelay is how long we wait before resubscribing (and checking who's still alive) again
+func nextResubscribeDelay() time.Duration {
+	delay := configuredInterval(driver.config.ResubscribeInterval, defaultResubscribeInterval)
+	if !driver.config.AdaptiveScheduling {
+		return delay
+	}
+
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	if observedExpiry > 0 && observedExpiry/2 < delay {
+		delay = observedExpiry / 2
+	}
+	if delay < minimumResubscribeInterval {
+		delay = minimumResubscribeInterval
+	}
+	return delay
+}
+
+// noteSubscribed records when a device confirmed its subscription
+func noteSubscribed(mac string) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	subscribedAt[mac] = time.Now()
+}
+
+// subscriptionDue tells the heartbeat whether a device's subscription needs renewing. One that was renewed in the last half
+// a resubscribe interval can wait until next time, which is still well before it expires
+func subscriptionDue(mac string) bool {
+	delay := nextResubscribeDelay()
+
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	at, ok := subscribedAt[mac]
+	return !ok || time.Since(at) >= delay/2
+}
+
+// noteExpired is called when we find out a device's subscription lapsed (e.g. it changed state without telling us)
+func noteExpired(mac string) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	at, ok := subscribedAt[mac]
+	if !ok {
+		return
+	}
+
+	expiryMisses[mac]++
+	if expiryMisses[mac] < expiryMissesNeeded {
+		return
+	}
+	expiryMisses[mac] = 0
+
+	lifetime := time.Since(at)
+	expiryLifetimes = append(expiryLifetimes, lifetime)
+	if len(expiryLifetimes) > expirySamples {
+		expiryLifetimes = expiryLifetimes[1:]
+	}
+	sorted := append([]time.Duration(nil), expiryLifetimes...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	observedExpiry = sorted[len(sorted)/2]
+	fmt.Println("Subscription for", mac, "lapsed within", lifetime, "- subscriptions seem to last about", observedExpiry)
+}
+
+// noteKept is called when a socket's state checks out. Any drift it had before was probably just a lost packet
+func noteKept(mac string) {
+	scheduleLock.Lock()
+	defer scheduleLock.Unlock()
+
+	delete(expiryMisses, mac)
+}
+
+// Like setInterval, but the delay is worked out again every time round, so it can change while we're running
+func setAdaptiveInterval(what func(), delay func() time.Duration) chan bool {
+	stop := make(chan bool)
+
+	go func() {
+		for {
+			what()
+			select {
+			case <-time.After(delay()):
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	return stop
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// The "Driver Settings" screen in the Labs. This is for the knobs that used to be hard coded, like how often we discover
+
+// Shows our driver settings
+func (c *configService) settings() (*suit.ConfigurationScreen, error) {
+	// Which interface each of our devices was seen on, if we're bound to any
+	var seen []string
+	for _, device := range driver.devices() {
+		if iface := deviceInterface(device.Device.MACAddress); iface != "" {
+			seen = append(seen, fmt.Sprintf("%s: %s", device.Device.Name, iface))
+		}
+	}
+	sort.Strings(seen)
+	if len(seen) == 0 {
+		seen = append(seen, "Using all interfaces")
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Driver Settings",
+		Sections: []suit.Section{
+			suit.Section{
+				Title: "Discovery",
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "All times are in seconds. In adaptive mode, the driver looks for new devices every few seconds when it starts or when a device goes missing, then slows down to the discovery interval. It also resubscribes more often if it notices subscriptions expiring",
+					},
+					suit.InputText{
+						Name:        "discover",
+						Before:      "Discover every",
+						After:       "seconds",
+						Placeholder: strconv.Itoa(defaultDiscoverInterval),
+						Value:       strconv.Itoa(driver.config.DiscoverInterval),
+					},
+					suit.InputText{
+						Name:        "resubscribe",
+						Before:      "Resubscribe every",
+						After:       "seconds",
+						Placeholder: strconv.Itoa(defaultResubscribeInterval),
+						Value:       strconv.Itoa(driver.config.ResubscribeInterval),
+					},
+					suit.RadioGroup{
+						Title: "Adaptive scheduling",
+						Name:  "adaptive",
+						Value: strconv.FormatBool(driver.config.AdaptiveScheduling),
+						Options: []suit.RadioGroupOption{
+							suit.RadioGroupOption{
+								Title:       "On",
+								Value:       "true",
+								DisplayIcon: "ok",
+							},
+							suit.RadioGroupOption{
+								Title:       "Off",
+								Value:       "false",
+								DisplayIcon: "remove",
+							},
+						},
+					},
+				},
+			},
+			suit.Section{
+				Title: "Network",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "interfaces",
+						Before:      "Only use these interfaces",
+						Placeholder: "eth0, wlan0 or 192.168.1.10. Leave blank for all",
+						Value:       strings.Join(driver.config.Interfaces, ", "),
+					},
+					suit.StaticText{
+						Title: "Devices by interface",
+						Value: strings.Join(seen, ", "),
+					},
+					suit.InputText{
+						Name:        "httptoken",
+						Before:      "HTTP API token",
+						Placeholder: "Needed to change anything through port 8100. Leave blank to only allow reading",
+						Value:       driver.config.HTTPToken,
+					},
+				},
+			},
+			suit.Section{
+				Title: "State checking",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "reconcile",
+						Before:      "Check socket state every",
+						After:       "seconds (-1 to turn off)",
+						Placeholder: strconv.Itoa(defaultReconcileInterval),
+						Value:       strconv.Itoa(driver.config.ReconcileInterval),
+					},
+					suit.InputText{
+						Name:        "reconcilemax",
+						Before:      "Back off to at most every",
+						After:       "seconds",
+						Placeholder: strconv.Itoa(defaultReconcileMaxInterval),
+						Value:       strconv.Itoa(driver.config.ReconcileMaxInterval),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "savesettings",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savesettings is called when we hit "Save" on the settings screen. New intervals kick in the next time each job runs
+func (c *configService) savesettings(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	// Our numbers. Blank means "use the default", which we store as 0
+	fields := map[string]*int{
+		"discover":     &driver.config.DiscoverInterval,
+		"resubscribe":  &driver.config.ResubscribeInterval,
+		"reconcile":    &driver.config.ReconcileInterval,
+		"reconcilemax": &driver.config.ReconcileMaxInterval,
+	}
+
+	values := make(map[string]int)
+	for name := range fields {
+		if vals[name] == "" {
+			continue
+		}
+		value, err := strconv.Atoi(vals[name])
+		if err != nil {
+			return c.error(fmt.Sprintf("%s isn't a number of seconds", vals[name]))
+		}
+		if value < 0 && name != "reconcile" { // -1 turns reconciliation off, but nothing else
+			return c.error(fmt.Sprintf("%d isn't a number of seconds", value))
+		}
+		values[name] = value
+	}
+
+	var interfaces []string
+	for _, iface := range strings.Split(vals["interfaces"], ",") {
+		if iface = strings.TrimSpace(iface); iface != "" {
+			interfaces = append(interfaces, iface)
+		}
+	}
+	if err := openInterfaces(interfaces); err != nil { // The old ones are still open
+		return c.error(fmt.Sprintf("Unable to use those interfaces: %s", err))
+	}
+
+	// Only save once we know everything is valid
+	for name, field := range fields {
+		*field = values[name]
+	}
+	driver.config.AdaptiveScheduling = stringToBool(vals["adaptive"])
+	driver.config.Interfaces = interfaces
+	driver.config.HTTPToken = strings.TrimSpace(vals["httptoken"])
+
+	driver.saveConfig()
+	logEvent("config", "", "labs", "updated driver settings")
+
+	return c.settings()
+}
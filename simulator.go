@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// This file contains our simulator, which pretends to be an Orvibo device so the driver can be tried out without one:
+//
+//	driver-orvibo simulate -kind socket -mac accf23000001 -name "Heater"
+//
+// It answers discovery, subscriptions, table reads and writes (so names, settings and timers work), state changes for
+// sockets and status requests for Keplers. The Kepler and the power strip are built from the same guesses as kepler.go and
+// powerstrip.go, so they can't tell us whether they're right. Press Enter to set off (or clear) a gas alarm, or flick a socket on or off as if
+// someone had pressed its button. The simulator needs port 10000 to itself, just like the driver does, so run it on another
+// machine on the same network (a VM or a container with its own network is fine)
+
+// Commands the simulator understands, on top of the ones in packets.go, tables.go and kepler.go
+const (
+	cmdSetState     = "6463"
+	cmdStateChanged = "7366"
+)
+
+// go-orvibo works out what kind of device it's talking to from these. The Kepler one is a guess (see kepler.go)
+var simulatedProducts = map[string]string{
+	"socket": "SOC002",
+	"allone": "IRD005",
+	"kepler": "KEP001",
+	"strip":  "SOC002", // Power strips look just like sockets. See powerstrip.go
+}
+
+// How long a settings (table 4) record is
+const simulatedSettingsLength = 164
+
+// simulatedDevice is the device we're pretending to be
+type simulatedDevice struct {
+	kind       string
+	mac        []byte
+	state      bool // On or off for a socket, alarm or no alarm for a Kepler
+	outlets    int  // Power strips only
+	mask       byte // Which outlets are on
+	gas        int  // Kepler readings
+	co         int
+	settings   []byte   // Our table 4 record
+	timers     [][]byte // Our table 3 records
+	subscriber net.IP   // Who to tell when our state changes
+	conn       *net.UDPConn
+	lock       sync.Mutex
+}
+
+// driver-orvibo simulate [-kind socket] [-mac accf23000001] [-name Simulated] [-address 0.0.0.0] [-alarm 0]
+func simulateCommand(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	kind := flags.String("kind", "socket", "What to pretend to be: socket, strip, allone or kepler")
+	outlets := flags.Int("outlets", 4, "How many outlets, if we're a power strip")
+	mac := flags.String("mac", "accf23000001", "Our MAC address")
+	name := flags.String("name", "Simulated", "Our name")
+	address := flags.String("address", "0.0.0.0", "The address to listen on")
+	alarm := flags.Duration("alarm", 0, "Set off (or clear) the gas alarm this often, e.g. 1m. 0 means only when Enter is pressed")
+	flags.Parse(args)
+
+	if _, ok := simulatedProducts[*kind]; !ok {
+		fmt.Fprintln(os.Stderr, "Unknown kind:", *kind, "(try socket, strip, allone or kepler)")
+		return 2
+	}
+	if *kind == "kepler" {
+		fmt.Println("Warning: nobody knows what a real Kepler sends, so this one is a guess. See kepler.go")
+	}
+	if *kind == "strip" {
+		fmt.Println("Warning: the outlet bitmask is a guess, not taken from a real strip. See powerstrip.go")
+	}
+	if *outlets < 1 || *outlets > maxOutlets {
+		fmt.Fprintln(os.Stderr, "Power strips can have 1 to", maxOutlets, "outlets")
+		return 2
+	}
+	macBytes, err := hex.DecodeString(normaliseMAC(*mac))
+	if err != nil || len(macBytes) != 6 {
+		fmt.Fprintln(os.Stderr, *mac, "isn't a MAC address")
+		return 2
+	}
+
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.ParseIP(*address), Port: orviboPort})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Unable to listen on port", orviboPort, ":", err)
+		return 1
+	}
+	defer conn.Close()
+
+	device := &simulatedDevice{kind: *kind, mac: macBytes, outlets: *outlets, conn: conn}
+	device.settings = make([]byte, simulatedSettingsLength)
+	binary.LittleEndian.PutUint16(device.settings[0:2], 1) // Record ID
+	copy(device.settings[4:10], macBytes)
+	setField(device.settings, 10, 6, "")
+	copy(device.settings[16:22], reverseBytes(macBytes))
+	setField(device.settings, 22, 6, "")
+	setField(device.settings, settingsPasswordOffset, settingsPasswordLength, defaultDevicePassword)
+	setField(device.settings, settingsNameOffset, settingsNameLength, *name)
+
+	fmt.Printf("Pretending to be a %s called %s (%s) on %s:%d. Press Enter to ", *kind, *name, normaliseMAC(*mac), *address, orviboPort)
+	if *kind == "kepler" {
+		fmt.Println("set off or clear the gas alarm")
+	} else {
+		fmt.Println("press our button")
+	}
+
+	// Enter (or the alarm timer) flips our state, as if something had happened in the real world
+	go func() {
+		lines := bufio.NewScanner(os.Stdin)
+		for lines.Scan() {
+			device.flip()
+		}
+	}()
+	if *alarm > 0 {
+		go func() {
+			for range time.Tick(*alarm) {
+				device.flip()
+			}
+		}()
+	}
+
+	local := conn.LocalAddr().(*net.UDPAddr)
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to read:", err)
+			return 1
+		}
+		if n < 6 || buf[0] != 0x68 || buf[1] != 0x64 {
+			continue // Not an Orvibo packet
+		}
+		if from.Port == local.Port && from.IP.Equal(local.IP) {
+			continue // One of our own answers, come back to us
+		}
+		device.handle(append([]byte(nil), buf[:n]...), from)
+	}
+}
+
+// handle answers a packet from the driver (or anything else that talks Orvibo). Answers go back to the port that asked,
+// like a real device's do (see packets.go)
+func (s *simulatedDevice) handle(data []byte, from *net.UDPAddr) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	command := hex.EncodeToString(data[4:6])
+	forUs := len(data) >= 12 && bytes.Equal(data[6:12], s.mac)
+
+	switch {
+	case command == cmdDiscoverAll, command == cmdDiscoverDevice && forUs:
+		fmt.Println("Discovered by", from.IP)
+		reply := append([]byte{0x00}, s.identity()...)
+		reply = append(reply, []byte(simulatedProducts[s.kind])...)
+		reply = append(reply, 0, 0, 0, 0, s.stateByte()) // Four bytes of time since 1900, which nobody looks at
+		s.send(command, reply, from)
+	case command == cmdSubscribe && forUs:
+		fmt.Println("Subscribed to by", from.IP)
+		s.subscriber = from.IP
+		s.send(command, append(s.header(), 0, 0, 0, 0, 0, s.stateByte()), from)
+	case command == cmdReadTable && forUs && len(data) > 22:
+		table := int(data[22])
+		fmt.Println("Table", table, "read by", from)
+		reply := append(s.header(), 0x02, 0x00, 0x00, 0x00, 0x00, byte(table), 0x00) // Our seven bytes of table info
+		for _, record := range s.table(table) {
+			reply = append(reply, byte(len(record)), byte(len(record)>>8))
+			reply = append(reply, record...)
+		}
+		s.send(command, reply, from)
+	case command == cmdWriteTable && forUs && len(data) >= 27:
+		table, mode := int(data[22]), int(data[24])
+		fmt.Println("Table", table, "written by", from)
+		s.write(table, mode, data[25:]) // The record length, then the record
+		s.send(command, append(s.header(), 0, 0, 0, 0, 0), from)
+	case command == cmdSetState && forUs && len(data) > 22 && (s.kind == "socket" || s.kind == "strip"):
+		if s.kind == "strip" {
+			s.mask = data[22] & allOutlets(s.outlets, true)
+			s.state = s.mask != 0
+			fmt.Printf("Outlets set to %08b by %s\n", s.mask, from.IP)
+		} else {
+			s.state = data[22] == 1
+			fmt.Println("Turned", onOff(s.state), "by", from.IP)
+		}
+		s.send(command, append(s.header(), 0, 0, 0, 0, s.stateByte()), from)
+		s.stateChanged()
+	case command == cmdStatus && forUs && s.kind == "kepler":
+		reply := append(s.header(), byte(s.gas), byte(s.gas>>8), byte(s.co), byte(s.co>>8), s.stateByte())
+		s.send(command, reply, from)
+	case command == cmdStatus && forUs && s.kind == "strip":
+		s.send(command, append(s.header(), s.mask), from)
+	}
+}
+
+// flip changes our state, as if someone had pressed our button (or there was gas in the air)
+func (s *simulatedDevice) flip() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.state = !s.state
+	if s.kind == "kepler" {
+		s.gas, s.co = 0, 0
+		if s.state {
+			s.gas, s.co = 25, 120 // Enough to set anything off
+		}
+		fmt.Println("Gas alarm", map[bool]string{true: "going off!", false: "cleared"}[s.state])
+	} else {
+		s.mask = allOutlets(s.outlets, s.state)
+		fmt.Println("Button pressed. Now", onOff(s.state))
+	}
+	s.stateChanged()
+}
+
+// stateChanged tells our subscriber about our new state, like a real device would
+func (s *simulatedDevice) stateChanged() {
+	if s.subscriber == nil {
+		fmt.Println("Nobody has subscribed to us yet, so nobody's been told")
+		return
+	}
+	s.send(cmdStateChanged, append(s.header(), 0, 0, 0, 0, s.stateByte()), &net.UDPAddr{IP: s.subscriber, Port: orviboPort})
+}
+
+// table returns the records in one of our tables
+func (s *simulatedDevice) table(table int) [][]byte {
+	switch table {
+	case tableSettings:
+		return [][]byte{s.settings}
+	case tableTimers:
+		return s.timers
+	}
+	return nil
+}
+
+// write changes one of our tables. mode is 1 to change a record, 0 to add one and 2 to delete one (see writeRecord)
+func (s *simulatedDevice) write(table int, mode int, data []byte) {
+	length := int(data[0]) | int(data[1])<<8
+	if len(data) < 2+length || length < 2 {
+		return
+	}
+	record := append([]byte(nil), data[2:2+length]...)
+
+	if table == tableSettings {
+		if len(record) == len(s.settings) {
+			s.settings = record
+		}
+		return
+	}
+	if table != tableTimers {
+		return
+	}
+
+	var timers [][]byte
+	for _, existing := range s.timers {
+		if binary.LittleEndian.Uint16(existing[0:2]) != binary.LittleEndian.Uint16(record[0:2]) {
+			timers = append(timers, existing)
+		}
+	}
+	if mode != 2 {
+		timers = append(timers, record)
+	}
+	s.timers = timers
+}
+
+// identity is our MAC address and reversed MAC address, each padded out, like discovery answers have
+func (s *simulatedDevice) identity() []byte {
+	padding, _ := hex.DecodeString(macPadding)
+	identity := append(append([]byte(nil), s.mac...), padding...)
+	identity = append(identity, reverseBytes(s.mac)...)
+	return append(identity, padding...)
+}
+
+// header is our MAC address and padding, which most answers start with
+func (s *simulatedDevice) header() []byte {
+	padding, _ := hex.DecodeString(macPadding)
+	return append(append([]byte(nil), s.mac...), padding...)
+}
+
+func (s *simulatedDevice) stateByte() byte {
+	if s.state {
+		return 1
+	}
+	return 0
+}
+
+// send wraps up a packet and sends it
+func (s *simulatedDevice) send(command string, payload []byte, to *net.UDPAddr) {
+	data, err := buildPacket(command, hex.EncodeToString(payload))
+	if err != nil {
+		fmt.Println("Unable to build packet:", err)
+		return
+	}
+	if _, err = s.conn.WriteToUDP(data, to); err != nil {
+		fmt.Println("Unable to send to", to, ":", err)
+	}
+}
+
+// reverseBytes is reverseMAC, but for bytes
+func reverseBytes(data []byte) []byte {
+	reversed := make([]byte, len(data))
+	for i := range data {
+		reversed[len(data)-1-i] = data[i]
+	}
+	return reversed
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/Grayda/go-orvibo"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// Discovery relies on broadcast, which doesn't get past routers (or VLANs). This file lets us list devices by IP address
+// and MAC address, which we then discover, subscribe to and query directly. We can also discover on extra broadcast
+// addresses (e.g. 192.168.2.255 for another subnet). Once a static device answers, it's added to orvibo.Devices (see
+// handlePacket in packets.go) just like a broadcast-discovered one, so if a device is found both ways it still only shows up once
+
+// OrviboStaticDevice is a device we've been told about, rather than found
+type OrviboStaticDevice struct {
+	Name       string // Just so we know which one is which in the Labs
+	IP         string
+	MACAddress string // Optional. If it's blank, we ask whatever's at IP to identify itself
+}
+
+// discoverStatic discovers our static devices and anything on our extra broadcast addresses. Called whenever we discover
+func discoverStatic() {
+	for _, device := range driver.config.StaticDevices {
+		if err := discoverAt(device.IP, device.MACAddress); err != nil {
+			fmt.Println("Unable to discover static device", device.IP, ":", err)
+		}
+	}
+
+	for _, address := range driver.config.BroadcastAddresses {
+		if err := discoverAt(address, ""); err != nil {
+			fmt.Println("Unable to discover on", address, ":", err)
+		}
+	}
+}
+
+// subscribeStatic subscribes to any static devices that aren't subscribed yet. go-orvibo will have a go too, but its packets may not get through
+func subscribeStatic() {
+	for _, device := range driver.config.StaticDevices {
+		mac := normaliseMAC(device.MACAddress)
+		if found, ok := orvibo.Devices[mac]; mac == "" || !ok || found.Subscribed {
+			continue // We can't subscribe until we know the MAC, and there's no point if it's already done
+		}
+		if err := subscribeAt(device.IP, mac); err != nil {
+			fmt.Println("Unable to subscribe to static device", device.IP, ":", err)
+		}
+	}
+}
+
+// queryStatic does the same as subscribeStatic, but for queries
+func queryStatic() {
+	for _, device := range driver.config.StaticDevices {
+		mac := normaliseMAC(device.MACAddress)
+		if found, ok := orvibo.Devices[mac]; mac == "" || !ok || !found.Subscribed || found.Queried {
+			continue
+		}
+		if err := queryAt(device.IP, mac); err != nil {
+			fmt.Println("Unable to query static device", device.IP, ":", err)
+		}
+	}
+}
+
+// Shows our static devices and broadcast addresses, and lets us add more
+func (c *configService) static() (*suit.ConfigurationScreen, error) {
+	found := make(map[string]bool) // orvibo.Devices can only be looked at from theloop. See loop.go
+	onLoop(func() {
+		for mac := range orvibo.Devices {
+			found[mac] = true
+		}
+	})
+
+	var devices []suit.ActionListOption
+	for i, device := range driver.config.StaticDevices {
+		status := "Not found yet"
+		if found[normaliseMAC(device.MACAddress)] {
+			status = "Found"
+		}
+		devices = append(devices, suit.ActionListOption{
+			Title:    fmt.Sprintf("%s (%s)", device.Name, device.IP),
+			Subtitle: fmt.Sprintf("%s - %s", device.MACAddress, status),
+			Value:    fmt.Sprint(i),
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title: "Static Devices",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: []suit.Typed{
+					suit.StaticText{
+						Title: "About this screen",
+						Value: "If your devices are on another subnet or VLAN, broadcast discovery won't find them. Add them here by IP address (and MAC address, if you know it) and the driver will talk to them directly",
+					},
+					suit.ActionList{
+						Name:    "device",
+						Options: devices,
+						PrimaryAction: &suit.ReplyAction{
+							Name:         "deletestatic",
+							Label:        "Remove",
+							DisplayIcon:  "trash",
+							DisplayClass: "danger",
+						},
+					},
+				},
+			},
+			suit.Section{
+				Title: "Add a device",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "name",
+						Before:      "Name",
+						Placeholder: "Garage socket",
+					},
+					suit.InputText{
+						Name:        "ip",
+						Before:      "IP address",
+						Placeholder: "192.168.2.50",
+					},
+					suit.InputText{
+						Name:        "mac",
+						Before:      "MAC address",
+						Placeholder: "ac:cf:23:12:34:56",
+					},
+				},
+			},
+			suit.Section{
+				Title: "Extra broadcast addresses",
+				Contents: []suit.Typed{
+					suit.InputText{
+						Name:        "broadcast",
+						Before:      "Also discover on",
+						Placeholder: "192.168.2.255, 10.0.5.255",
+						Value:       strings.Join(driver.config.BroadcastAddresses, ", "),
+					},
+				},
+			},
+		},
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "savestatic",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savestatic adds a new static device (if one was filled in) and saves our broadcast addresses
+func (c *configService) savestatic(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	var addresses []string
+	for _, address := range strings.Split(vals["broadcast"], ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		if net.ParseIP(address) == nil {
+			return c.error(fmt.Sprintf("%s isn't an IP address", address))
+		}
+		addresses = append(addresses, address)
+	}
+	driver.config.BroadcastAddresses = addresses
+
+	if vals["ip"] != "" {
+		if net.ParseIP(vals["ip"]) == nil {
+			return c.error(fmt.Sprintf("%s isn't an IP address", vals["ip"]))
+		}
+		mac := normaliseMAC(vals["mac"])
+		if mac != "" && len(mac) != 12 {
+			return c.error(fmt.Sprintf("%s isn't a MAC address", vals["mac"]))
+		}
+
+		driver.config.StaticDevices = append(driver.config.StaticDevices, OrviboStaticDevice{
+			Name:       vals["name"],
+			IP:         vals["ip"],
+			MACAddress: mac,
+		})
+		logEvent("config", mac, "labs", "added static device "+vals["ip"])
+	}
+
+	driver.saveConfig()
+	discoverStatic() // Go and find it now, rather than waiting for the next discovery
+
+	return c.static()
+}
+
+// deletestatic removes a static device. Anything already found stays found until the driver restarts
+func (c *configService) deletestatic(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	var devices []OrviboStaticDevice
+	for i, device := range driver.config.StaticDevices {
+		if fmt.Sprint(i) != vals["device"] {
+			devices = append(devices, device)
+		} else {
+			logEvent("config", device.MACAddress, "labs", "removed static device "+device.IP)
+		}
+	}
+
+	driver.config.StaticDevices = devices
+	driver.saveConfig()
+
+	return c.static()
+}
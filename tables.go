@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+)
+
+// Orvibo devices keep their settings (name, password, timezone, timers etc.) in "tables". Table 4 holds the device's own
+// settings, table 3 holds its timers. go-orvibo only ever reads the name out of table 4, so this file lets us read and
+// write whole tables ourselves. Like every other answer (see packets.go), table answers come back to the port that asked,
+// so each request gets its own socket and we wait for the answer on it.
+//
+// A "rt" (read table) answer looks roughly like this:
+//
+//	6864 <length> 7274 <MAC> <padding> <a few bytes of table info> <record length> <record> [<record length> <record> ...]
+//
+// Every record starts with a two byte record ID and a two byte version. For table 4 the MAC address comes next, which is
+// how we find where the record starts. Record lengths are little endian, because of course they are
+
+// Commands for reading and writing tables
+const (
+	cmdWriteTable = "746d"
+	replyRead     = "rt"
+	replyWrite    = "tm"
+	cmdStatus     = "6473" // Asks a Kepler for its readings, or a power strip for its outlets. See kepler.go and powerstrip.go
+	replyStatus   = "ds"
+)
+
+// The tables we know about
+const (
+	tableTimers   = 3
+	tableSettings = 4
+)
+
+// Where things live in the table 4 (settings) record. Text fields are padded out with spaces. The record starts with its ID,
+// version, the MAC address and the MAC address backwards (each padded to 12 bytes), then the password and the name. That's
+// the layout people who've captured S20 traffic describe, and it's what tables_test.go checks. The fields from the timezone on
+// are further in, and I've only seen them described, not checked them against a capture. If a socket's timezone or countdown
+// comes out as nonsense, these are the numbers to look at
+const (
+	settingsPasswordOffset  = 28 // The remote access password
+	settingsPasswordLength  = 12
+	settingsNameOffset      = 40
+	settingsNameLength      = 16
+	settingsTimezoneOffset  = 136 // Whole hours from UTC, as a signed byte
+	settingsAutoDSTOffset   = 137 // 1 if the device looks after daylight saving itself
+	settingsLockOffset      = 138 // 1 if the button on the device is locked
+	settingsCountdownOffset = 140 // Countdown on / off, what to do when it finishes, then the number of seconds (two bytes, little endian)
+)
+
+// How long we wait for a device to answer a table request
+const tableTimeout = 2 * time.Second
+
+// tableRequest sends a packet to a device and waits for an answer with the given command
+func tableRequest(device *orvibo.Device, data []byte, reply string) ([]byte, error) {
+	if device.IP == nil {
+		return nil, fmt.Errorf("We don't know the IP address of %s", device.MACAddress)
+	}
+
+	// Send from whichever interface this device lives on (see interfaces.go). nil means "anywhere"
+	var local *net.UDPAddr
+	if bound := interfaceFor(device.IP.IP); bound != nil {
+		local = &net.UDPAddr{IP: bound.Address}
+	}
+
+	conn, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	remote := &net.UDPAddr{IP: device.IP.IP, Port: orviboPort}
+	if _, err = conn.WriteToUDP(data, remote); err != nil {
+		return nil, err
+	}
+	packetsSent.Inc("table")
+
+	conn.SetReadDeadline(time.Now().Add(tableTimeout))
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			return nil, fmt.Errorf("No answer from %s: %s", device.MACAddress, err)
+		}
+		if !from.IP.Equal(device.IP.IP) || n < 6 || string(buf[4:6]) != reply {
+			continue // Not for us
+		}
+		return append([]byte(nil), buf[:n]...), nil
+	}
+}
+
+// readTable reads all of the records in one of a device's tables
+func readTable(device *orvibo.Device, table int) ([][]byte, error) {
+	data, err := buildPacket(cmdReadTable, normaliseMAC(device.MACAddress)+macPadding+fmt.Sprintf("00000000%02x000000000000", table))
+	if err != nil {
+		return nil, err
+	}
+
+	answer, err := tableRequest(device, data, replyRead)
+	if err != nil {
+		return nil, err
+	}
+
+	return splitRecords(answer, device.MACAddress, table)
+}
+
+// splitRecords pulls the records out of a "rt" answer
+func splitRecords(answer []byte, mac string, table int) ([][]byte, error) {
+	macBytes, err := hex.DecodeString(normaliseMAC(mac))
+	if err != nil {
+		return nil, err
+	}
+
+	// The answer starts with 6864, the length, "rt", then the MAC and padding (18 bytes all up)
+	const headerLength = 18
+	if len(answer) < headerLength {
+		return nil, fmt.Errorf("Table answer from %s is too short", mac)
+	}
+
+	var start int
+	if table == tableSettings {
+		// The MAC address is four bytes into the record, and the record length is just before that
+		index := bytes.Index(answer[headerLength:], macBytes)
+		if index < 0 {
+			return nil, fmt.Errorf("Couldn't find the settings record in the answer from %s", mac)
+		}
+		start = headerLength + index - 6
+	} else {
+		// Other tables have seven bytes of table info before the first record length. As far as I can tell, anyway
+		start = headerLength + 7
+	}
+
+	var records [][]byte
+	for start >= headerLength && start+2 <= len(answer) {
+		length := int(answer[start]) | int(answer[start+1])<<8
+		if length == 0 || start+2+length > len(answer) {
+			break
+		}
+		records = append(records, answer[start+2:start+2+length])
+		start += 2 + length
+	}
+
+	if len(records) == 0 && table == tableSettings {
+		return nil, fmt.Errorf("Settings record from %s was empty", mac)
+	}
+	return records, nil
+}
+
+// writeRecord writes (or adds) a single record to one of a device's tables. mode is 1 to change a record, 0 to add one and 2 to delete one
+func writeRecord(device *orvibo.Device, table int, mode int, record []byte) error {
+	length := fmt.Sprintf("%02x%02x", len(record)&0xff, len(record)>>8)
+	data, err := buildPacket(cmdWriteTable, normaliseMAC(device.MACAddress)+macPadding+fmt.Sprintf("00000000%02x00%02x", table, mode)+length+hex.EncodeToString(record))
+	if err != nil {
+		return err
+	}
+
+	_, err = tableRequest(device, data, replyWrite)
+	return err
+}
+
+// readStatus asks a device how it's going. It's not a table, but it's answered the same way. What comes back depends on the device
+func readStatus(device *orvibo.Device) ([]byte, error) {
+	data, err := buildPacket(cmdStatus, normaliseMAC(device.MACAddress)+macPadding)
+	if err != nil {
+		return nil, err
+	}
+	return tableRequest(device, data, replyStatus)
+}
+
+// readSettings reads a device's settings record (table 4)
+func readSettings(device *orvibo.Device) ([]byte, error) {
+	records, err := readTable(device, tableSettings)
+	if err != nil {
+		return nil, err
+	}
+	if len(records[0]) < settingsNameOffset+settingsNameLength {
+		return nil, fmt.Errorf("Settings record from %s is too short", device.MACAddress)
+	}
+	return records[0], nil
+}
+
+// getField pulls a space padded text field out of a record
+func getField(record []byte, offset int, length int) string {
+	return string(bytes.TrimRight(record[offset:offset+length], " \x00"))
+}
+
+// setField puts a text field into a record, padding it out with spaces
+func setField(record []byte, offset int, length int, value string) {
+	copy(record[offset:offset+length], bytes.Repeat([]byte(" "), length))
+	copy(record[offset:offset+length], value)
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+)
+
+// A settings record laid out the way people who've captured S20 traffic describe it: record ID, version, MAC address and
+// reversed MAC address (each padded to 12 bytes), the remote password ("888888" out of the box), the name, then the rest.
+// It's built by hand, not copied from a capture, but if our offsets drift from that layout this will say so
+func settingsRecord(mac string, name string) []byte {
+	macBytes, _ := hex.DecodeString(mac)
+	reversed, _ := hex.DecodeString(reverseMAC(mac))
+	padding, _ := hex.DecodeString(macPadding)
+
+	record := []byte{0x01, 0x00, 0x43, 0x25}
+	record = append(append(record, macBytes...), padding...)
+	record = append(append(record, reversed...), padding...)
+	record = append(record, []byte("888888      ")...)
+	record = append(record, []byte(name+string(bytes.Repeat([]byte(" "), 16-len(name))))...)
+	return append(record, make([]byte, 168-len(record))...)
+}
+
+// settingsAnswer wraps a record up in an "rt" answer
+func settingsAnswer(mac string, record []byte) []byte {
+	macBytes, _ := hex.DecodeString(mac)
+	padding, _ := hex.DecodeString(macPadding)
+
+	answer := []byte{0x68, 0x64, 0x00, 0x00, 'r', 't'}
+	answer = append(append(answer, macBytes...), padding...)
+	answer = append(answer, 0x02, 0x00, 0x00, 0x00, 0x00, tableSettings, 0x00) // The table info
+	answer = append(answer, byte(len(record)), byte(len(record)>>8))
+	return append(answer, record...)
+}
+
+func TestSplitSettings(t *testing.T) {
+	const mac = "accf23123456"
+	record := settingsRecord(mac, "Heater")
+
+	records, err := splitRecords(settingsAnswer(mac, record), mac, tableSettings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 1 || !bytes.Equal(records[0], record) {
+		t.Fatalf("Got %d records (%x), want the one we sent", len(records), records)
+	}
+
+	if got := getField(records[0], settingsNameOffset, settingsNameLength); got != "Heater" {
+		t.Errorf("Got name %q, want %q", got, "Heater")
+	}
+	if got := getField(records[0], settingsPasswordOffset, settingsPasswordLength); got != "888888" {
+		t.Errorf("Got password %q, want %q", got, "888888")
+	}
+}
+
+// Renaming should only touch the name, and pad it out with spaces
+func TestSetName(t *testing.T) {
+	const mac = "accf23123456"
+	record := settingsRecord(mac, "Kitchen kettle")
+	want := settingsRecord(mac, "Lamp")
+
+	setField(record, settingsNameOffset, settingsNameLength, "Lamp")
+	if !bytes.Equal(record, want) {
+		t.Errorf("Got %x, want %x", record, want)
+	}
+}
+
+func TestSplitSettingsErrors(t *testing.T) {
+	const mac = "accf23123456"
+	for _, test := range []struct {
+		name   string
+		answer []byte
+	}{
+		{"too short", []byte{0x68, 0x64, 0x00, 0x06, 'r', 't'}},
+		{"someone else's", settingsAnswer("accf23654321", settingsRecord("accf23654321", "Lamp"))},
+		{"empty", settingsAnswer(mac, nil)[:25]},
+	} {
+		if _, err := splitRecords(test.answer, mac, tableSettings); err == nil {
+			t.Errorf("%s: should have failed", test.name)
+		}
+	}
+}
@@ -0,0 +1,693 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grayda/go-orvibo"
+	"github.com/ninjasphere/go-ninja/model"
+	"github.com/ninjasphere/go-ninja/suit"
+)
+
+// The S20 can run timers by itself, which keep working even if the Sphere is off (handy for a heater that MUST turn off).
+// Timers live in table 3 (see tables.go), one record each. The countdown ("turn off in 30 minutes") lives in the settings
+// record in table 4 (see settingsCountdownOffset in tables.go). As far as I can tell, a timer record looks like this:
+//
+//	<record ID (2 bytes)> <version (2 bytes)> <name (16 bytes, space padded)> <state (2 bytes)>
+//	<year (2 bytes)> <month> <day> <hour> <minute> <second> <repeat>
+//
+// The repeat byte has one bit per day (bit 0 is Monday, bit 6 is Sunday) and bit 7 set if the timer repeats. Times are in
+// the socket's own time, which is whatever timezone it was set up with in the Orvibo app
+//
+// I haven't got a capture of a real socket's timers, so that layout is pieced together from other people's notes on the
+// protocol. timers_test.go makes sure we read and write it consistently, but not that a real S20 agrees. Try a timer on
+// something that doesn't matter before trusting a heater to it
+
+// How long a timer record is, and where things live in it
+const (
+	timerRecordLength = 30
+	timerNameOffset   = 4
+	timerNameLength   = 16
+	timerStateOffset  = 20
+	timerYearOffset   = 22
+	timerRepeatOffset = 29
+	timerRepeatBit    = 0x80
+)
+
+// OrviboTimer is a timer stored on a socket
+type OrviboTimer struct {
+	ID      int
+	Name    string
+	State   bool           // What the socket does when the timer goes off
+	At      time.Time      // When it goes off. For repeating timers, only the time of day matters
+	Days    []time.Weekday // Which days it repeats on. Empty means it only goes off once
+	version int
+}
+
+// OrviboCountdown is a socket's countdown timer
+type OrviboCountdown struct {
+	Enabled bool
+	State   bool // What the socket does when the countdown finishes
+	Seconds int  // How long the countdown runs for
+}
+
+// parseTimer turns a table 3 record into an OrviboTimer
+func parseTimer(record []byte) (OrviboTimer, error) {
+	if len(record) < timerRecordLength {
+		return OrviboTimer{}, fmt.Errorf("Timer record is too short (%d bytes)", len(record))
+	}
+
+	timer := OrviboTimer{
+		ID:      int(binary.LittleEndian.Uint16(record[0:2])),
+		version: int(binary.LittleEndian.Uint16(record[2:4])),
+		Name:    getField(record, timerNameOffset, timerNameLength),
+		State:   record[timerStateOffset] == 1,
+		At: time.Date(int(binary.LittleEndian.Uint16(record[timerYearOffset:timerYearOffset+2])), time.Month(record[timerYearOffset+2]),
+			int(record[timerYearOffset+3]), int(record[timerYearOffset+4]), int(record[timerYearOffset+5]), int(record[timerYearOffset+6]), 0, time.Local),
+	}
+
+	if repeat := record[timerRepeatOffset]; repeat&timerRepeatBit != 0 {
+		for bit := uint(0); bit < 7; bit++ {
+			if repeat&(1<<bit) != 0 {
+				timer.Days = append(timer.Days, time.Weekday((bit+1)%7)) // Bit 0 is Monday, but time.Weekday starts at Sunday
+			}
+		}
+	}
+
+	return timer, nil
+}
+
+// record turns an OrviboTimer back into a table 3 record
+func (t OrviboTimer) record() []byte {
+	record := make([]byte, timerRecordLength)
+	binary.LittleEndian.PutUint16(record[0:2], uint16(t.ID))
+	binary.LittleEndian.PutUint16(record[2:4], uint16(t.version))
+	setField(record, timerNameOffset, timerNameLength, t.Name)
+	if t.State {
+		record[timerStateOffset] = 1
+	}
+
+	binary.LittleEndian.PutUint16(record[timerYearOffset:timerYearOffset+2], uint16(t.At.Year()))
+	record[timerYearOffset+2] = byte(t.At.Month())
+	record[timerYearOffset+3] = byte(t.At.Day())
+	record[timerYearOffset+4] = byte(t.At.Hour())
+	record[timerYearOffset+5] = byte(t.At.Minute())
+	record[timerYearOffset+6] = byte(t.At.Second())
+
+	if len(t.Days) > 0 {
+		repeat := byte(timerRepeatBit)
+		for _, day := range t.Days {
+			repeat |= 1 << uint((int(day)+6)%7)
+		}
+		record[timerRepeatOffset] = repeat
+	}
+
+	return record
+}
+
+// String describes a timer, e.g. "Heater off: off at 22:30 every Mon, Tue"
+func (t OrviboTimer) String() string {
+	when := "at " + t.At.Format("2006-01-02 15:04")
+	if len(t.Days) > 0 {
+		var days []string
+		for _, day := range t.Days {
+			days = append(days, day.String()[0:3])
+		}
+		when = fmt.Sprintf("at %s every %s", t.At.Format("15:04"), strings.Join(days, ", "))
+	}
+	return fmt.Sprintf("%s: %s %s", t.Name, onOff(t.State), when)
+}
+
+// readTimers reads all of the timers stored on a socket
+func readTimers(device *orvibo.Device) ([]OrviboTimer, error) {
+	records, err := readTable(device, tableTimers)
+	if err != nil {
+		return nil, err
+	}
+
+	var timers []OrviboTimer
+	for _, record := range records {
+		timer, err := parseTimer(record)
+		if err != nil {
+			return nil, err
+		}
+		timers = append(timers, timer)
+	}
+
+	sort.Slice(timers, func(i, j int) bool { return timers[i].ID < timers[j].ID })
+	return timers, nil
+}
+
+// saveTimer adds a timer to a socket (if its ID is 0) or changes an existing one
+func saveTimer(device *orvibo.Device, timer OrviboTimer) error {
+	timers, err := readTimers(device)
+	if err != nil {
+		return err
+	}
+
+	if timer.ID == 0 {
+		timer.ID = 1
+		for _, existing := range timers {
+			if existing.ID >= timer.ID {
+				timer.ID = existing.ID + 1
+			}
+		}
+		return writeRecord(device, tableTimers, 0, timer.record())
+	}
+
+	for _, existing := range timers {
+		if existing.ID == timer.ID {
+			timer.version = existing.version
+			return writeRecord(device, tableTimers, 1, timer.record())
+		}
+	}
+	return fmt.Errorf("%s doesn't have a timer %d", device.MACAddress, timer.ID)
+}
+
+// deleteTimer removes a timer from a socket
+func deleteTimer(device *orvibo.Device, id int) error {
+	timers, err := readTimers(device)
+	if err != nil {
+		return err
+	}
+
+	for _, existing := range timers {
+		if existing.ID == id {
+			return writeRecord(device, tableTimers, 2, existing.record())
+		}
+	}
+	return fmt.Errorf("%s doesn't have a timer %d", device.MACAddress, id)
+}
+
+// readCountdown reads a socket's countdown out of its settings
+func readCountdown(device *orvibo.Device) (OrviboCountdown, error) {
+	record, err := readSettings(device)
+	if err != nil {
+		return OrviboCountdown{}, err
+	}
+	if len(record) < settingsCountdownOffset+4 {
+		return OrviboCountdown{}, fmt.Errorf("%s doesn't seem to support countdowns", device.MACAddress)
+	}
+
+	return OrviboCountdown{
+		Enabled: record[settingsCountdownOffset] == 1,
+		State:   record[settingsCountdownOffset+1] == 1,
+		Seconds: int(binary.LittleEndian.Uint16(record[settingsCountdownOffset+2 : settingsCountdownOffset+4])),
+	}, nil
+}
+
+// setCountdown starts (or stops) a socket's countdown
+func setCountdown(device *orvibo.Device, countdown OrviboCountdown) error {
+	record, err := readSettings(device)
+	if err != nil {
+		return err
+	}
+	if len(record) < settingsCountdownOffset+4 {
+		return fmt.Errorf("%s doesn't seem to support countdowns", device.MACAddress)
+	}
+	if countdown.Seconds < 0 || countdown.Seconds > 0xffff {
+		return fmt.Errorf("Countdowns can only be up to %d minutes", 0xffff/60)
+	}
+
+	record[settingsCountdownOffset] = 0
+	if countdown.Enabled {
+		record[settingsCountdownOffset] = 1
+	}
+	record[settingsCountdownOffset+1] = 0
+	if countdown.State {
+		record[settingsCountdownOffset+1] = 1
+	}
+	binary.LittleEndian.PutUint16(record[settingsCountdownOffset+2:settingsCountdownOffset+4], uint16(countdown.Seconds))
+
+	return writeRecord(device, tableSettings, 1, record)
+}
+
+// parseTimerTime turns "22:30" or "2026-12-25 22:30" into a time. A time without a date means the next time it comes around
+func parseTimerTime(at string) (time.Time, error) {
+	at = strings.TrimSpace(at)
+	if when, err := time.ParseInLocation("2006-01-02 15:04", at, time.Local); err == nil {
+		return when, nil
+	}
+
+	clock, err := time.ParseInLocation("15:04", at, time.Local)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s isn't a time. Try 22:30 or 2026-12-25 22:30", at)
+	}
+
+	now := time.Now()
+	when := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, time.Local)
+	if when.Before(now) {
+		when = when.AddDate(0, 0, 1)
+	}
+	return when, nil
+}
+
+// parseDays turns "mon, wed, fri" (or "daily", "weekdays", "weekends") into a list of days. Blank means no days (i.e. just once)
+func parseDays(list string) ([]time.Weekday, error) {
+	switch strings.ToLower(strings.TrimSpace(list)) {
+	case "":
+		return nil, nil
+	case "daily", "everyday", "every day":
+		return []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday, time.Sunday}, nil
+	case "weekdays":
+		return []time.Weekday{time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday}, nil
+	case "weekends":
+		return []time.Weekday{time.Saturday, time.Sunday}, nil
+	}
+
+	var days []time.Weekday
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		found := false
+		for day := time.Sunday; day <= time.Saturday; day++ {
+			if len(name) >= 3 && strings.HasPrefix(strings.ToLower(day.String()), name) {
+				days = append(days, day)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("%s isn't a day of the week", name)
+		}
+	}
+	return days, nil
+}
+
+// formatDays turns a list of days back into something parseDays understands
+func formatDays(days []time.Weekday) string {
+	var names []string
+	for _, day := range days {
+		names = append(names, strings.ToLower(day.String()[0:3]))
+	}
+	return strings.Join(names, ", ")
+}
+
+// What we read off one socket for the timers screen
+type socketTimers struct {
+	timers       []OrviboTimer
+	timersErr    error
+	countdown    OrviboCountdown
+	countdownErr error
+}
+
+// How long the timers screen waits for the sockets to answer. They're all asked at once, so one missing socket doesn't hold up
+// the rest
+const timersDeadline = tableTimeout + time.Second
+
+// readAllTimers reads the timers and countdown off each socket at the same time. Sockets that haven't answered by
+// timersDeadline are left out
+func readAllTimers(sockets []*OrviboDevice) map[string]socketTimers {
+	type answer struct {
+		mac  string
+		read socketTimers
+	}
+	answers := make(chan answer, len(sockets)) // Room for everyone, so latecomers don't get stuck after we've stopped listening
+
+	for _, device := range sockets {
+		go func(device *OrviboDevice) {
+			var read socketTimers
+			done := make(chan bool)
+			go func() {
+				read.countdown, read.countdownErr = readCountdown(device.Device)
+				close(done)
+			}()
+			read.timers, read.timersErr = readTimers(device.Device)
+			<-done
+			answers <- answer{device.Device.MACAddress, read}
+		}(device)
+	}
+
+	all := make(map[string]socketTimers)
+	deadline := time.After(timersDeadline)
+	for range sockets {
+		select {
+		case answer := <-answers:
+			all[answer.mac] = answer.read
+		case <-deadline:
+			return all
+		}
+	}
+	return all
+}
+
+// Shows the timers and countdown on each of our sockets
+func (c *configService) timers() (*suit.ConfigurationScreen, error) {
+	sections := []suit.Section{
+		suit.Section{
+			Contents: []suit.Typed{
+				suit.StaticText{
+					Title: "About this screen",
+					Value: "These timers are stored on the sockets themselves, so they keep working even if the Sphere is off. Times are in the socket's own time. Set a countdown to 0 minutes to cancel it",
+				},
+			},
+		},
+	}
+
+	var sockets []*OrviboDevice
+	for _, device := range driver.devices() {
+		if device.Device.DeviceType == orvibo.SOCKET {
+			sockets = append(sockets, device)
+		}
+	}
+	all := readAllTimers(sockets)
+
+	for _, device := range sockets {
+		var contents []suit.Typed
+		read, answered := all[device.Device.MACAddress]
+		if !answered {
+			contents = append(contents, suit.StaticText{
+				Title: "No answer",
+				Value: "This socket didn't answer in time. Close this screen and open it again to have another go",
+			})
+		} else if read.timersErr != nil {
+			contents = append(contents, suit.StaticText{
+				Title: "Unable to read timers",
+				Value: read.timersErr.Error(),
+			})
+		} else {
+			timers := read.timers
+			var options []suit.ActionListOption
+			for _, timer := range timers {
+				options = append(options, suit.ActionListOption{
+					Title: timer.String(),
+					Value: fmt.Sprintf("%s|%d", device.Device.MACAddress, timer.ID),
+				})
+			}
+			if len(options) == 0 {
+				contents = append(contents, suit.StaticText{
+					Title: "No timers",
+					Value: "Hit 'New Timer' to add one",
+				})
+			} else {
+				contents = append(contents, suit.ActionList{
+					Name:    "timer",
+					Options: options,
+					PrimaryAction: &suit.ReplyAction{
+						Name:        "edittimer",
+						Label:       "Edit",
+						DisplayIcon: "pencil",
+					},
+					SecondaryAction: &suit.ReplyAction{
+						Name:         "deletetimer",
+						Label:        "Delete",
+						DisplayIcon:  "trash",
+						DisplayClass: "danger",
+					},
+				})
+			}
+		}
+
+		// The countdown. If we can't read it, we just leave it out
+		if countdown := read.countdown; answered && read.countdownErr == nil {
+			minutes := ""
+			if countdown.Enabled {
+				minutes = strconv.Itoa(countdown.Seconds / 60)
+			}
+			contents = append(contents, suit.InputText{
+				Name:        "countdown_" + device.Device.MACAddress,
+				Before:      "Countdown",
+				After:       "minutes",
+				Placeholder: "0",
+				Value:       minutes,
+			}, suit.RadioGroup{
+				Title: "Then turn",
+				Name:  "countdownstate_" + device.Device.MACAddress,
+				Value: strconv.FormatBool(countdown.State),
+				Options: []suit.RadioGroupOption{
+					suit.RadioGroupOption{
+						Title:       "Off",
+						Value:       "false",
+						DisplayIcon: "off",
+					},
+					suit.RadioGroupOption{
+						Title:       "On",
+						Value:       "true",
+						DisplayIcon: "ok",
+					},
+				},
+			})
+		}
+
+		sections = append(sections, suit.Section{
+			Title:    device.Device.Name,
+			Contents: contents,
+		})
+	}
+
+	screen := suit.ConfigurationScreen{
+		Title:    "Socket Timers",
+		Sections: sections,
+		Actions: []suit.Typed{
+			suit.CloseAction{
+				Label: "Close",
+			},
+			suit.ReplyAction{
+				Label:       "New Timer",
+				Name:        "edittimer",
+				DisplayIcon: "plus",
+			},
+			suit.ReplyAction{
+				Label:        "Save Countdowns",
+				Name:         "savecountdown",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// edittimer shows the form for a new timer, or an existing one if we came from the Edit button
+func (c *configService) edittimer(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	json.Unmarshal(request.Data, &vals) // "New Timer" doesn't send anything, so there's nothing to complain about here
+
+	timer := OrviboTimer{At: time.Now().Add(time.Hour).Truncate(time.Minute)}
+	var contents []suit.Typed
+
+	if vals["timer"] != "" {
+		device, id, err := findTimerDevice(vals["timer"])
+		if err != nil {
+			return c.error(err.Error())
+		}
+		timers, err := readTimers(device.Device)
+		if err != nil {
+			return c.error(fmt.Sprintf("Unable to read timers from %s: %s", device.Device.Name, err))
+		}
+		for _, existing := range timers {
+			if existing.ID == id {
+				timer = existing
+			}
+		}
+		contents = append(contents, suit.InputHidden{
+			Name:  "timer",
+			Value: vals["timer"],
+		})
+	} else {
+		// Which socket is this for?
+		var sockets []suit.RadioGroupOption
+		for _, device := range driver.devices() {
+			if device.Device.DeviceType == orvibo.SOCKET {
+				sockets = append(sockets, suit.RadioGroupOption{
+					Title: device.Device.Name,
+					Value: device.Device.MACAddress,
+				})
+			}
+		}
+		if len(sockets) == 0 {
+			return c.error("There aren't any sockets to add a timer to")
+		}
+		contents = append(contents, suit.RadioGroup{
+			Title:   "Socket",
+			Name:    "socket",
+			Value:   sockets[0].Value,
+			Options: sockets,
+		})
+	}
+
+	at := timer.At.Format("2006-01-02 15:04")
+	if len(timer.Days) > 0 {
+		at = timer.At.Format("15:04")
+	}
+
+	contents = append(contents, suit.InputText{
+		Name:        "name",
+		Before:      "Name",
+		Placeholder: "Heater off",
+		Value:       timer.Name,
+	}, suit.RadioGroup{
+		Title: "Turn the socket",
+		Name:  "state",
+		Value: strconv.FormatBool(timer.State),
+		Options: []suit.RadioGroupOption{
+			suit.RadioGroupOption{
+				Title:       "Off",
+				Value:       "false",
+				DisplayIcon: "off",
+			},
+			suit.RadioGroupOption{
+				Title:       "On",
+				Value:       "true",
+				DisplayIcon: "ok",
+			},
+		},
+	}, suit.InputText{
+		Name:        "at",
+		Before:      "At",
+		Placeholder: "22:30 or 2026-12-25 22:30",
+		Value:       at,
+	}, suit.InputText{
+		Name:        "days",
+		Before:      "Every",
+		Placeholder: "mon, wed, fri (or daily, weekdays, weekends). Leave blank for once",
+		Value:       formatDays(timer.Days),
+	})
+
+	screen := suit.ConfigurationScreen{
+		Title: "Socket Timer",
+		Sections: []suit.Section{
+			suit.Section{
+				Contents: contents,
+			},
+		},
+		Actions: []suit.Typed{
+			suit.ReplyAction{
+				Label: "Cancel",
+				Name:  "timers",
+			},
+			suit.ReplyAction{
+				Label:        "Save",
+				Name:         "savetimer",
+				DisplayClass: "success",
+				DisplayIcon:  "star",
+			},
+		},
+	}
+
+	return &screen, nil
+}
+
+// savetimer saves a new or edited timer to the socket
+func (c *configService) savetimer(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	var device *OrviboDevice
+	timer := OrviboTimer{Name: vals["name"], State: stringToBool(vals["state"])}
+
+	if vals["timer"] != "" {
+		device, timer.ID, err = findTimerDevice(vals["timer"])
+	} else if device = findDevice(driver, vals["socket"]); device == nil {
+		err = fmt.Errorf("Can't find socket %s", vals["socket"])
+	}
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	if timer.At, err = parseTimerTime(vals["at"]); err != nil {
+		return c.error(err.Error())
+	}
+	if timer.Days, err = parseDays(vals["days"]); err != nil {
+		return c.error(err.Error())
+	}
+
+	if err = saveTimer(device.Device, timer); err != nil {
+		return c.error(fmt.Sprintf("Unable to save timer on %s: %s", device.Device.Name, err))
+	}
+
+	logEvent("config", device.Device.MACAddress, "labs", "saved timer "+timer.String())
+	return c.timers()
+}
+
+// deletetimer removes a timer from a socket
+func (c *configService) deletetimer(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	device, id, err := findTimerDevice(vals["timer"])
+	if err != nil {
+		return c.error(err.Error())
+	}
+
+	if err = deleteTimer(device.Device, id); err != nil {
+		return c.error(fmt.Sprintf("Unable to delete timer from %s: %s", device.Device.Name, err))
+	}
+
+	logEvent("config", device.Device.MACAddress, "labs", fmt.Sprintf("deleted timer %d", id))
+	return c.timers()
+}
+
+// savecountdown starts (or cancels) the countdown on any socket whose countdown has changed
+func (c *configService) savecountdown(request *model.ConfigurationRequest) (*suit.ConfigurationScreen, error) {
+	var vals map[string]string
+	err := json.Unmarshal(request.Data, &vals)
+	if err != nil {
+		return c.error(fmt.Sprintf("Failed to unmarshal save config request %s: %s", request.Data, err))
+	}
+
+	for name, value := range vals {
+		if !strings.HasPrefix(name, "countdown_") { // Our countdown textboxes are named countdown_<MAC address>
+			continue
+		}
+
+		mac := strings.TrimPrefix(name, "countdown_")
+		device := findDevice(driver, mac)
+		if device == nil {
+			continue
+		}
+
+		minutes := 0
+		if strings.TrimSpace(value) != "" {
+			if minutes, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || minutes < 0 {
+				return c.error(fmt.Sprintf("%s isn't a number of minutes", value))
+			}
+		}
+
+		countdown := OrviboCountdown{Enabled: minutes > 0, State: stringToBool(vals["countdownstate_"+mac]), Seconds: minutes * 60}
+		current, err := readCountdown(device.Device)
+		if err != nil {
+			return c.error(fmt.Sprintf("Unable to read countdown from %s: %s", device.Device.Name, err))
+		}
+		if current.Enabled == countdown.Enabled && current.State == countdown.State && (!countdown.Enabled || current.Seconds == countdown.Seconds) {
+			continue // Nothing's changed, so leave it be
+		}
+
+		if err = setCountdown(device.Device, countdown); err != nil {
+			return c.error(fmt.Sprintf("Unable to set countdown on %s: %s", device.Device.Name, err))
+		}
+		logEvent("config", mac, "labs", fmt.Sprintf("countdown %d minutes, then %s", minutes, onOff(countdown.State)))
+	}
+
+	return c.timers()
+}
+
+// findTimerDevice splits "<MAC address>|<timer ID>" (from our ActionList) and finds the socket
+func findTimerDevice(value string) (*OrviboDevice, int, error) {
+	parts := strings.Split(value, "|")
+	if len(parts) != 2 {
+		return nil, 0, fmt.Errorf("%s isn't a timer", value)
+	}
+
+	id, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s isn't a timer", value)
+	}
+
+	device := findDevice(driver, parts[0])
+	if device == nil {
+		return nil, 0, fmt.Errorf("Can't find socket %s", parts[0])
+	}
+	return device, id, nil
+}
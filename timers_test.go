@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// A timer record laid out the way the comment at the top of timers.go describes: ID 3, version 2, "Heater off", turn off, at
+// 22:30 on 25 December 2026, repeating on Mondays and Fridays. It's built by hand, not copied from a socket
+var heaterOff = []byte{
+	0x03, 0x00, 0x02, 0x00,
+	'H', 'e', 'a', 't', 'e', 'r', ' ', 'o', 'f', 'f', ' ', ' ', ' ', ' ', ' ', ' ',
+	0x00, 0x00,
+	0xea, 0x07, 12, 25, 22, 30, 0,
+	0x80 | 0x01 | 0x10,
+}
+
+func TestParseTimer(t *testing.T) {
+	timer, err := parseTimer(heaterOff)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if timer.ID != 3 || timer.version != 2 || timer.Name != "Heater off" || timer.State {
+		t.Errorf("Got %+v, want timer 3 (version 2) called Heater off that turns it off", timer)
+	}
+	if want := time.Date(2026, time.December, 25, 22, 30, 0, 0, time.Local); !timer.At.Equal(want) {
+		t.Errorf("Got %s, want %s", timer.At, want)
+	}
+	if len(timer.Days) != 2 || timer.Days[0] != time.Monday || timer.Days[1] != time.Friday {
+		t.Errorf("Got %v, want Monday and Friday", timer.Days)
+	}
+
+	if again := timer.record(); !bytes.Equal(again, heaterOff) {
+		t.Errorf("Wrote it back as %x, want %x", again, heaterOff)
+	}
+}
+
+// Every day should land on its own bit, Sunday included, and come back as the same day
+func TestTimerDays(t *testing.T) {
+	for day := time.Sunday; day <= time.Saturday; day++ {
+		timer := OrviboTimer{ID: 1, Name: "Lamp", State: true, At: time.Date(2026, time.January, 1, 7, 0, 0, 0, time.Local), Days: []time.Weekday{day}}
+		record := timer.record()
+		if want := byte(timerRepeatBit | 1<<uint((int(day)+6)%7)); record[timerRepeatOffset] != want {
+			t.Errorf("%s: got repeat byte %08b, want %08b", day, record[timerRepeatOffset], want)
+		}
+
+		again, err := parseTimer(record)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again.Days) != 1 || again.Days[0] != day || !again.State {
+			t.Errorf("%s: came back as %+v", day, again)
+		}
+	}
+}
+
+// A timer that only goes off once shouldn't have the repeat bit set
+func TestTimerOnce(t *testing.T) {
+	timer := OrviboTimer{ID: 1, Name: "Once", At: time.Date(2026, time.March, 1, 6, 15, 0, 0, time.Local)}
+	if record := timer.record(); record[timerRepeatOffset] != 0 {
+		t.Errorf("Got repeat byte %08b, want 0", record[timerRepeatOffset])
+	}
+
+	if _, err := parseTimer(heaterOff[:timerRecordLength-1]); err == nil {
+		t.Errorf("A short record should have failed")
+	}
+}